@@ -0,0 +1,161 @@
+package fsutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// ChecksumOpt controls how Checksum computes the digests.
+type ChecksumOpt struct {
+	// ContentHasher returns the hash of an entry. The contents of regular
+	// files are written to it, and for directories the names and digests of
+	// the children. The stat fields that are part of the digests are
+	// selected by the hasher, for example with hashers.Metadata. Defaults to
+	// hashing the mode, the symlink target and the contents.
+	ContentHasher ContentHasher
+}
+
+// Checksums holds the digests of a tree computed by Checksum.
+type Checksums struct {
+	root    digest.Digest
+	digests map[string]digest.Digest
+}
+
+// Root returns the digest of the whole tree.
+func (c *Checksums) Root() digest.Digest {
+	return c.root
+}
+
+// Digest returns the digest of the entry at p. The digest of a directory
+// covers everything under it.
+func (c *Checksums) Digest(p string) (digest.Digest, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		return c.root, nil
+	}
+	dgst, ok := c.digests[p]
+	if !ok {
+		return "", errors.WithStack(&os.PathError{Op: "checksum", Path: p, Err: syscall.ENOENT})
+	}
+	return dgst, nil
+}
+
+// Checksum walks fs and computes a Merkle tree of digests for it. The digest
+// of a directory is made from its own stat and the names and digests of its
+// children, in walk order, so the root digest changes whenever any entry
+// in the tree does. Wrap fs with NewFilterFS to checksum a subset of it.
+//
+// Hardlinks have the digest of the path they are linked to, so the result
+// does not depend on which of the links is walked first.
+func Checksum(ctx context.Context, fs FS, opt *ChecksumOpt) (*Checksums, error) {
+	ch := defaultChecksumHasher
+	if opt != nil && opt.ContentHasher != nil {
+		ch = opt.ContentHasher
+	}
+
+	c := &Checksums{digests: map[string]digest.Digest{}}
+	root := sha256.New()
+	type dir struct {
+		path string
+		h    hash.Hash
+	}
+	var stack []dir
+
+	// add writes the record of the entry at p to the hash of its parent
+	add := func(p string, dgst digest.Digest) {
+		c.digests[p] = dgst
+		h := root
+		if len(stack) > 0 {
+			h = stack[len(stack)-1].h
+		}
+		h.Write([]byte(filepath.Base(p) + "\x00" + dgst.String() + "\x00"))
+	}
+	// pop finishes the directories on the stack that are not parents of p
+	pop := func(p string) {
+		for len(stack) > 0 {
+			d := stack[len(stack)-1]
+			if p != d.path && hasPathPrefix(p, d.path) {
+				return
+			}
+			stack = stack[:len(stack)-1]
+			add(d.path, digest.NewDigest(digest.SHA256, d.h))
+		}
+	}
+
+	err := fs.Walk(ctx, "", func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+		pop(p)
+
+		if stat.IsDir() {
+			h, err := ch(stat)
+			if err != nil {
+				return err
+			}
+			stack = append(stack, dir{path: p, h: h})
+			return nil
+		}
+
+		if os.FileMode(stat.Mode).IsRegular() && stat.Linkname != "" {
+			if dgst, ok := c.digests[stat.Linkname]; ok {
+				add(p, dgst)
+				return nil
+			}
+		}
+		h, err := ch(stat)
+		if err != nil {
+			return err
+		}
+		if os.FileMode(stat.Mode).IsRegular() {
+			rc, err := fs.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, rc)
+			rc.Close()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		add(p, digest.NewDigest(digest.SHA256, h))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pop("")
+	c.root = digest.NewDigest(digest.SHA256, root)
+	return c, nil
+}
+
+func defaultChecksumHasher(stat *types.Stat) (hash.Hash, error) {
+	h := sha256.New()
+	h.Write([]byte("mode\x00" + strconv.FormatUint(uint64(stat.Mode), 10) + "\x00"))
+	if os.FileMode(stat.Mode)&os.ModeSymlink != 0 {
+		h.Write([]byte("linkname\x00" + stat.Linkname + "\x00"))
+	}
+	return h, nil
+}
@@ -0,0 +1,143 @@
+package fsutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestChecksum(t *testing.T) {
+	ctx := context.TODO()
+	changes := changeStream([]string{
+		"ADD a dir",
+		"ADD a/b dir",
+		"ADD a/b/c file data1",
+		"ADD a/d file data2",
+		"ADD a/e symlink d",
+		"ADD f dir",
+		"ADD f/g file data3",
+		"ADD h file >a/d",
+	})
+	m1, err := memTree(changes)
+	require.NoError(t, err)
+	m2, err := memTree(changes)
+	require.NoError(t, err)
+	c1, err := Checksum(ctx, m1, nil)
+	require.NoError(t, err)
+	c2, err := Checksum(ctx, m2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, c1.Root(), c2.Root())
+
+	dgst, err := c1.Digest("/")
+	require.NoError(t, err)
+	assert.Equal(t, c1.Root(), dgst)
+
+	d1, err := c1.Digest("a/d")
+	require.NoError(t, err)
+	d2, err := c1.Digest("h")
+	require.NoError(t, err)
+	assert.Equal(t, d1, d2)
+
+	_, err = c1.Digest("missing")
+	require.ErrorIs(t, err, syscall.ENOENT)
+
+	// a changed file changes the digests of all its parents only
+	changes[2] = parseChange("ADD a/b/c file data11")
+	m2, err = memTree(changes)
+	require.NoError(t, err)
+	c2, err = Checksum(ctx, m2, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, c1.Root(), c2.Root())
+	for p, changed := range map[string]bool{
+		"a":     true,
+		"a/b":   true,
+		"a/b/c": true,
+		"a/d":   false,
+		"a/e":   false,
+		"f":     false,
+		"f/g":   false,
+		"h":     false,
+	} {
+		d1, err := c1.Digest(filepath.FromSlash(p))
+		require.NoError(t, err)
+		d2, err := c2.Digest(filepath.FromSlash(p))
+		require.NoError(t, err)
+		assert.Equal(t, changed, d1 != d2, p)
+	}
+
+	// a filtered subset matches the same tree without the excluded files
+	fs, err := NewFilterFS(m1, &FilterOpt{
+		ExcludePatterns: []string{"f/g"},
+	})
+	require.NoError(t, err)
+	c2, err = Checksum(ctx, fs, nil)
+	require.NoError(t, err)
+	m3, err := memTree(changeStream([]string{"ADD f dir"}))
+	require.NoError(t, err)
+	c3, err := Checksum(ctx, m3, nil)
+	require.NoError(t, err)
+	d1, err = c2.Digest("f")
+	require.NoError(t, err)
+	d2, err = c3.Digest("f")
+	require.NoError(t, err)
+	assert.Equal(t, d1, d2)
+	assert.NotEqual(t, c1.Root(), c2.Root())
+}
+
+func TestChecksumContentHasher(t *testing.T) {
+	ctx := context.TODO()
+	var dirs int
+	opt := &ChecksumOpt{
+		// only the type and the contents are part of the digests
+		ContentHasher: func(stat *types.Stat) (hash.Hash, error) {
+			h := sha256.New()
+			if stat.IsDir() {
+				dirs++
+				h.Write([]byte("dir"))
+			}
+			return h, nil
+		},
+	}
+
+	// the same tree with a different mode for a/b/c
+	changes := changeStream([]string{
+		"ADD a dir",
+		"ADD a/b dir",
+		"ADD a/d file data2",
+		"ADD a/e symlink d",
+		"ADD f dir",
+		"ADD f/g file data3",
+		"ADD h file >a/d",
+	})
+	m1, err := memTree(changes)
+	require.NoError(t, err)
+	require.NoError(t, m1.AddFile("a/b/c", []byte("data1"), 0644))
+	m2, err := memTree(changes)
+	require.NoError(t, err)
+	require.NoError(t, m2.AddFile("a/b/c", []byte("data1"), 0755))
+
+	c1, err := Checksum(ctx, m1, opt)
+	require.NoError(t, err)
+	assert.Equal(t, 3, dirs)
+	c2, err := Checksum(ctx, m2, opt)
+	require.NoError(t, err)
+	assert.Equal(t, c1.Root(), c2.Root())
+
+	dgst, err := c1.Digest("f/g")
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString("data3"), dgst)
+
+	c1, err = Checksum(ctx, m1, nil)
+	require.NoError(t, err)
+	c2, err = Checksum(ctx, m2, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, c1.Root(), c2.Root())
+}
@@ -10,6 +10,8 @@ import (
 )
 
 func main() {
+	ignoreFile := flag.String("ignorefile", "", "comma separated names of ignore files to read from each directory, e.g. .gitignore")
+	dereference := flag.Bool("dereference", false, "replace symlinks with the entries they point to")
 	flag.Parse()
 	if len(flag.Args()) == 0 {
 		panic("source path not set")
@@ -25,9 +27,20 @@ func main() {
 		excludes = strings.Split(string(dt), "\n")
 	}
 
-	if err := fsutil.Walk(context.Background(), flag.Args()[0], &fsutil.FilterOpt{
+	var ignoreFiles []string
+	if *ignoreFile != "" {
+		ignoreFiles = strings.Split(*ignoreFile, ",")
+	}
+
+	opt := &fsutil.FilterOpt{
 		ExcludePatterns: excludes,
-	}, func(path string, fi os.FileInfo, err error) error {
+		IgnoreFiles:     ignoreFiles,
+	}
+	if *dereference {
+		opt.Dereference = &fsutil.DereferenceOpt{}
+	}
+
+	if err := fsutil.Walk(context.Background(), flag.Args()[0], opt, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -112,6 +112,8 @@ func Copy(ctx context.Context, srcRoot, src, dstRoot, dst string, opts ...Opt) e
 		return err
 	}
 	c.testHookLstat = ci.testHookLstat
+	c.oneFileSystem = ci.OneFileSystem
+	c.notifySkippedMount = ci.NotifySkippedMount
 	srcs := []string{src}
 
 	if ci.AllowWildcards {
@@ -207,6 +209,13 @@ type CopyInfo struct {
 	// replace any existing symlink or file)
 	AlwaysReplaceExistingDestPaths bool
 	ChangeFunc                     fsutil.ChangeFunc
+	// If true, the contents of directories on a different device than the
+	// source are not copied, like cp -x. Such mount points are copied as
+	// empty directories.
+	OneFileSystem bool
+	// NotifySkippedMount is called with the source path of every mount point
+	// whose contents are not copied because of OneFileSystem.
+	NotifySkippedMount func(src string)
 
 	// testHookLstat is called before each os.Lstat if non-nil (for testing only)
 	testHookLstat func(path string)
@@ -263,6 +272,15 @@ func WithChangeNotifier(fn fsutil.ChangeFunc) Opt {
 	}
 }
 
+// WithOneFileSystem does not copy the contents of mount points inside the
+// source, reporting them to fn if it is not nil.
+func WithOneFileSystem(fn func(src string)) Opt {
+	return func(ci *CopyInfo) {
+		ci.OneFileSystem = true
+		ci.NotifySkippedMount = fn
+	}
+}
+
 type copier struct {
 	chown                          Chowner
 	utime                          *time.Time
@@ -276,7 +294,11 @@ type copier struct {
 	changefn                       fsutil.ChangeFunc
 	root                           string
 	alwaysReplaceExistingDestPaths bool
-	testHookLstat                  func(string)
+	oneFileSystem                  bool
+	notifySkippedMount             func(string)
+	// srcDev is the device of the source that is being copied
+	srcDev        uint64
+	testHookLstat func(string)
 }
 
 type parentDir struct {
@@ -384,6 +406,10 @@ func (c *copier) copy(ctx context.Context, src, srcComponents, target string, ov
 		return errors.Wrapf(err, "failed to stat %s", src)
 	}
 
+	if srcComponents == "" {
+		c.srcDev, _ = getDev(fi)
+	}
+
 	// After Lstat, if this item is excluded and is NOT a directory, skip it
 	if !include && !fi.IsDir() {
 		return nil
@@ -619,6 +645,15 @@ func (c *copier) copyDirectory(
 		return false, nil
 	}
 
+	if c.oneFileSystem {
+		if dev, ok := getDev(stat); ok && dev != c.srcDev {
+			if c.notifySkippedMount != nil {
+				c.notifySkippedMount(src)
+			}
+			return created, nil
+		}
+	}
+
 	fis, err := os.ReadDir(src)
 	if err != nil {
 		return false, errors.Wrapf(err, "failed to read %s", src)
@@ -0,0 +1,46 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyOneFileSystem(t *testing.T) {
+	requiresRoot(t)
+
+	t1 := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(t1, "src/mnt"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(t1, "src/foo"), []byte("foo"), 0644))
+	if err := unix.Mount("tmpfs", filepath.Join(t1, "src/mnt"), "tmpfs", 0, ""); err != nil {
+		t.Skipf("mounting tmpfs is not permitted: %v", err)
+	}
+	defer unix.Unmount(filepath.Join(t1, "src/mnt"), unix.MNT_DETACH)
+	require.NoError(t, os.WriteFile(filepath.Join(t1, "src/mnt/bar"), []byte("bar"), 0644))
+
+	t2 := t.TempDir()
+	var skipped []string
+	err := Copy(context.TODO(), t1, "src", t2, "dst", WithOneFileSystem(func(src string) {
+		skipped = append(skipped, src)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(t1, "src/mnt")}, skipped)
+
+	dt, err := os.ReadFile(filepath.Join(t2, "dst/foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(dt))
+	entries, err := os.ReadDir(filepath.Join(t2, "dst/mnt"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// the mount point itself can be copied
+	err = Copy(context.TODO(), t1, "src/mnt", t2, "mnt", WithOneFileSystem(nil))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(t2, "mnt/bar"))
+	require.NoError(t, err)
+}
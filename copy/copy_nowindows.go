@@ -43,3 +43,12 @@ func copyDevice(dst string, fi os.FileInfo) error {
 	mode &^= syscall.S_IFSOCK // socket copied as stub
 	return mknod(dst, uint32(mode), rDev)
 }
+
+// getDev returns the device of fi.
+func getDev(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
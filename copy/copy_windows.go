@@ -17,6 +17,11 @@ func getUIDGID(_ os.FileInfo) (uid, gid int) {
 	return 0, 0
 }
 
+// getDev returns the device of fi, which is not known on Windows.
+func getDev(_ os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
 func getFileSecurityInfo(name string) (*windows.SID, *windows.ACL, error) {
 	secInfo, err := windows.GetNamedSecurityInfo(
 		name, windows.SE_FILE_OBJECT,
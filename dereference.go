@@ -0,0 +1,364 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/moby/patternmatcher"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// maxSymlinkHops is the number of symlinks that are followed while resolving
+// a single path before it is considered a loop.
+const maxSymlinkHops = 255
+
+var errLinkOutsideRoot = errors.New("symlink points outside of the root")
+
+// DereferencePolicy controls the symlinks that can not be dereferenced.
+type DereferencePolicy int
+
+const (
+	// DereferenceKeepLink keeps the symlinks that can not be dereferenced as
+	// symlinks.
+	DereferenceKeepLink DereferencePolicy = iota
+	// DereferenceReject reports an error for the symlinks that can not be
+	// dereferenced.
+	DereferenceReject
+)
+
+// DereferenceOpt controls the symlinks that NewDereferenceFS replaces.
+type DereferenceOpt struct {
+	// Patterns limits dereferencing to the symlinks whose path matches one of
+	// the patterns, or is inside a directory that matches. All symlinks are
+	// dereferenced if empty.
+	Patterns []string
+	// Unresolvable controls the symlinks that point outside of the root, to
+	// paths that do not exist, or to one of their own parent directories.
+	// Defaults to DereferenceKeepLink.
+	Unresolvable DereferencePolicy
+	// AbsoluteInRoot resolves absolute symlinks relative to the root, as for
+	// container root filesystems. Otherwise they point outside of the root.
+	AbsoluteInRoot bool
+}
+
+// NewDereferenceFS returns an FS that presents the content and stat of the
+// targets of the symlinks of fs in place of the symlinks, like cp -L or
+// tar -h. Symlinks to directories are walked as directories. A nil opt
+// dereferences all symlinks.
+func NewDereferenceFS(fs FS, opt *DereferenceOpt) (FS, error) {
+	if opt == nil {
+		opt = &DereferenceOpt{}
+	}
+	dfs := &dereferenceFS{fs: fs, opt: *opt}
+	if len(opt.Patterns) > 0 {
+		pm, err := patternmatcher.New(opt.Patterns)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid dereference patterns: %s", opt.Patterns)
+		}
+		dfs.matcher = pm
+	}
+	if _, ok := fs.(ReaderAtFS); ok {
+		return &dereferenceReaderAtFS{dfs}, nil
+	}
+	return dfs, nil
+}
+
+type dereferenceFS struct {
+	fs  FS
+	opt DereferenceOpt
+
+	// mu protects matcher, which is not safe for concurrent use
+	mu      sync.Mutex
+	matcher *patternmatcher.PatternMatcher
+}
+
+var _ StatFS = &dereferenceFS{}
+
+// dereferenced reports whether the symlink at the path p of the FS is
+// dereferenced.
+func (fs *dereferenceFS) dereferenced(p string) (bool, error) {
+	if fs.matcher == nil {
+		return true, nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.matcher.MatchesOrParentMatches(p)
+}
+
+// resolve returns the path of the underlying FS that the symlink at the path
+// p of the underlying FS points to, and its stat.
+func (fs *dereferenceFS) resolve(ctx context.Context, p string) (string, *types.Stat, error) {
+	hops := 0
+	parts := []string{p}
+	real := ""
+	for len(parts) > 0 {
+		next := filepath.Join(real, parts[0])
+		parts = parts[1:]
+		if next == "." {
+			// the root
+			real = ""
+			continue
+		}
+		stat, err := statPath(ctx, fs.fs, next)
+		if err != nil {
+			return "", nil, err
+		}
+		if os.FileMode(stat.Mode)&os.ModeSymlink != 0 {
+			if hops++; hops > maxSymlinkHops {
+				return "", nil, errors.WithStack(&os.PathError{Op: "dereference", Path: p, Err: syscall.ELOOP})
+			}
+			link := filepath.FromSlash(stat.Linkname)
+			base := filepath.Dir(next)
+			if filepath.IsAbs(link) || strings.HasPrefix(link, string(filepath.Separator)) {
+				if !fs.opt.AbsoluteInRoot {
+					return "", nil, errors.WithStack(&os.PathError{Op: "dereference", Path: p, Err: errLinkOutsideRoot})
+				}
+				link = strings.TrimLeft(link[len(filepath.VolumeName(link)):], string(filepath.Separator))
+				base = ""
+			}
+			target := filepath.Join(base, link)
+			if target == ".." || strings.HasPrefix(target, ".."+string(filepath.Separator)) {
+				return "", nil, errors.WithStack(&os.PathError{Op: "dereference", Path: p, Err: errLinkOutsideRoot})
+			}
+			real = ""
+			parts = append(strings.Split(target, string(filepath.Separator)), parts...)
+			continue
+		}
+		if len(parts) > 0 && !stat.IsDir() {
+			return "", nil, errors.WithStack(&os.PathError{Op: "dereference", Path: p, Err: syscall.ENOTDIR})
+		}
+		real = next
+		if len(parts) == 0 {
+			return real, stat, nil
+		}
+	}
+	// the root contains every symlink that points to it
+	return "", nil, errors.WithStack(&os.PathError{Op: "dereference", Path: p, Err: syscall.ELOOP})
+}
+
+// resolveLink resolves the symlink at the path p of the underlying FS. links
+// are the symlinks of the underlying FS that were already dereferenced to
+// reach p. A symlink that points to a directory that contains p or one of
+// links is a loop.
+func (fs *dereferenceFS) resolveLink(ctx context.Context, p string, links []string) (string, *types.Stat, error) {
+	real, stat, err := fs.resolve(ctx, p)
+	if err != nil {
+		return "", nil, err
+	}
+	if stat.IsDir() {
+		for _, l := range append(links, p) {
+			if l == real || strings.HasPrefix(l, real+string(filepath.Separator)) {
+				return "", nil, errors.WithStack(&os.PathError{Op: "dereference", Path: p, Err: syscall.ELOOP})
+			}
+		}
+	}
+	return real, stat, nil
+}
+
+// unresolvable reports whether err from resolveLink is handled by the
+// Unresolvable policy.
+func unresolvable(err error) bool {
+	return isNotExist(err) || errors.Is(err, errLinkOutsideRoot) || errors.Is(err, syscall.ELOOP)
+}
+
+// realPath returns the path of the underlying FS for the path p of the FS,
+// the symlinks that were dereferenced for it, and its stat. The last component
+// is only dereferenced if followLast is set.
+func (fs *dereferenceFS) realPath(ctx context.Context, p string, followLast bool) (string, []string, *types.Stat, error) {
+	var (
+		real    string
+		virtual string
+		links   []string
+		stat    *types.Stat
+	)
+	parts := strings.Split(p, string(filepath.Separator))
+	for i, name := range parts {
+		virtual = filepath.Join(virtual, name)
+		next := filepath.Join(real, name)
+		var err error
+		stat, err = statPath(ctx, fs.fs, next)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if os.FileMode(stat.Mode)&os.ModeSymlink != 0 && (followLast || i < len(parts)-1) {
+			ok, err := fs.dereferenced(virtual)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			if ok {
+				resolved, rstat, err := fs.resolveLink(ctx, next, links)
+				switch {
+				case err == nil:
+					links = append(links, next)
+					next, stat = resolved, rstat
+				case !unresolvable(err) || fs.opt.Unresolvable == DereferenceReject:
+					return "", nil, nil, err
+				}
+			}
+		}
+		if i < len(parts)-1 && !stat.IsDir() {
+			return "", nil, nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.ENOTDIR})
+		}
+		real = next
+	}
+	return real, links, stat, nil
+}
+
+func (fs *dereferenceFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	target = cleanFSPath(target)
+	if target == "" {
+		return fs.walk(ctx, "", "", nil, fn)
+	}
+	// only the parent directories of target are resolved, so that a symlink
+	// target is reported with its own path
+	real := target
+	var links []string
+	if dir := filepath.Dir(target); dir != "." {
+		realDir, l, _, err := fs.realPath(ctx, dir, true)
+		if err != nil {
+			if isNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		real, links = filepath.Join(realDir, filepath.Base(target)), l
+	}
+	return fs.walk(ctx, real, target, links, fn)
+}
+
+// walk walks the path real of the underlying FS and reports it as virtual.
+// links are the symlinks that were dereferenced to reach real.
+func (fs *dereferenceFS) walk(ctx context.Context, real, virtual string, links []string, fn gofs.WalkDirFunc) error {
+	return fs.fs.Walk(ctx, real, func(p string, entry gofs.DirEntry, err error) error {
+		vp := p
+		if real != virtual {
+			vp = virtual + strings.TrimPrefix(p, real)
+		}
+		if err != nil {
+			return fn(vp, entry, err)
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return fn(vp, entry, err)
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+
+		if os.FileMode(stat.Mode)&os.ModeSymlink != 0 {
+			ok, err := fs.dereferenced(vp)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return fs.walkLink(ctx, p, vp, entry, stat, links, fn)
+			}
+		}
+		if real != virtual {
+			entry = &DirEntryInfo{Stat: rebaseStat(stat, real, virtual)}
+		}
+		return fn(vp, entry, nil)
+	})
+}
+
+// walkLink reports the target of the symlink at the path p of the underlying
+// FS as vp, and walks it if it is a directory.
+func (fs *dereferenceFS) walkLink(ctx context.Context, p, vp string, entry gofs.DirEntry, stat *types.Stat, links []string, fn gofs.WalkDirFunc) error {
+	real, rstat, err := fs.resolveLink(ctx, p, links)
+	if err != nil {
+		if unresolvable(err) && fs.opt.Unresolvable == DereferenceKeepLink {
+			if p != vp {
+				stat = stat.Clone()
+				stat.Path = filepath.ToSlash(vp)
+				entry = &DirEntryInfo{Stat: stat}
+			}
+			return fn(vp, entry, nil)
+		}
+		return fn(vp, entry, err)
+	}
+
+	rstat = rstat.Clone()
+	rstat.Path = filepath.ToSlash(vp)
+	// the target is a separate copy from the hardlinks of the FS
+	rstat.Linkname = ""
+	if err := fn(vp, &DirEntryInfo{Stat: rstat}, nil); err != nil {
+		if err == filepath.SkipDir && rstat.IsDir() {
+			return nil
+		}
+		return err
+	}
+	if !rstat.IsDir() {
+		return nil
+	}
+	links = append(links[:len(links):len(links)], p)
+	return fs.walk(ctx, real, vp, links, func(path string, entry gofs.DirEntry, err error) error {
+		if path == vp {
+			// reported above
+			return nil
+		}
+		return fn(path, entry, err)
+	})
+}
+
+// rebaseStat returns a copy of stat for the path under virtual that has the
+// path under real in the underlying FS.
+func rebaseStat(stat *types.Stat, real, virtual string) *types.Stat {
+	stat = stat.Clone()
+	stat.Path = filepath.ToSlash(virtual + strings.TrimPrefix(filepath.FromSlash(stat.Path), real))
+	if os.FileMode(stat.Mode).IsRegular() && stat.Linkname != "" {
+		// hardlinks are kept if the other path is also under real
+		if link := filepath.FromSlash(stat.Linkname); strings.HasPrefix(link, real+string(filepath.Separator)) {
+			stat.Linkname = filepath.ToSlash(virtual + strings.TrimPrefix(link, real))
+		} else {
+			stat.Linkname = ""
+		}
+	}
+	return stat
+}
+
+func (fs *dereferenceFS) Stat(ctx context.Context, p string) (*types.Stat, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.EINVAL})
+	}
+	_, links, stat, err := fs.realPath(ctx, p, true)
+	if err != nil {
+		return nil, err
+	}
+	stat = stat.Clone()
+	stat.Path = filepath.ToSlash(p)
+	if len(links) > 0 && os.FileMode(stat.Mode).IsRegular() {
+		stat.Linkname = ""
+	}
+	return stat, nil
+}
+
+func (fs *dereferenceFS) Open(p string) (io.ReadCloser, error) {
+	real, _, _, err := fs.realPath(context.TODO(), cleanFSPath(p), true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fs.Open(real)
+}
+
+// dereferenceReaderAtFS is a dereferenceFS over an FS that implements
+// ReaderAtFS.
+type dereferenceReaderAtFS struct {
+	*dereferenceFS
+}
+
+func (fs *dereferenceReaderAtFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	real, _, _, err := fs.realPath(context.TODO(), cleanFSPath(p), true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fs.(ReaderAtFS).OpenReaderAt(real)
+}
@@ -0,0 +1,164 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDereference(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/f file data1",
+		"ADD a/self symlink ../a",
+		"ADD a/sub dir",
+		"ADD a/sub/g file data2",
+		"ADD abs symlink /a/f",
+		"ADD chain symlink l2",
+		"ADD l1 symlink a",
+		"ADD l2 symlink a/f",
+		"ADD l3 symlink ../outside",
+		"ADD l4 symlink missing",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	base, err := NewFS(d)
+	require.NoError(t, err)
+
+	fs, err := NewDereferenceFS(base, nil)
+	require.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir a
+file a/f
+symlink:../a a/self
+dir a/sub
+file a/sub/g
+symlink:/a/f abs
+file chain
+dir l1
+file l1/f
+symlink:../a l1/self
+dir l1/sub
+file l1/sub/g
+file l2
+symlink:../outside l3
+symlink:missing l4
+`), b.String())
+
+	for p, expected := range map[string]string{
+		"chain":    "data1",
+		"l1/f":     "data1",
+		"l1/sub/g": "data2",
+		"l2":       "data1",
+	} {
+		rc, err := fs.Open(filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		dt, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(dt), p)
+
+		stat, err := statPath(context.TODO(), fs, filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		assert.Equal(t, p, stat.Path)
+		assert.True(t, os.FileMode(stat.Mode).IsRegular(), p)
+	}
+
+	b.Reset()
+	err = fs.Walk(context.TODO(), filepath.FromSlash("l1/sub"), bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir l1/sub
+file l1/sub/g
+`), b.String())
+
+	stats, err := readDirPath(context.TODO(), fs, "l1")
+	require.NoError(t, err)
+	require.Len(t, stats, 3)
+	assert.Equal(t, filepath.FromSlash("l1/f"), filepath.FromSlash(stats[0].Path))
+
+	// absolute symlinks can point inside the root
+	fs, err = NewDereferenceFS(base, &DereferenceOpt{Patterns: []string{"abs"}, AbsoluteInRoot: true})
+	require.NoError(t, err)
+	b.Reset()
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir a
+file a/f
+symlink:../a a/self
+dir a/sub
+file a/sub/g
+file abs
+symlink:l2 chain
+symlink:a l1
+symlink:a/f l2
+symlink:../outside l3
+symlink:missing l4
+`), b.String())
+}
+
+func TestDereferenceReject(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/f file data1",
+		"ADD a/self symlink ../a",
+		"ADD a/sub dir",
+		"ADD a/sub/g file data2",
+		"ADD abs symlink /a/f",
+		"ADD chain symlink l2",
+		"ADD l1 symlink a",
+		"ADD l2 symlink a/f",
+		"ADD l3 symlink ../outside",
+		"ADD l4 symlink missing",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	base, err := NewFS(d)
+	require.NoError(t, err)
+
+	fs, err := NewDereferenceFS(base, &DereferenceOpt{Unresolvable: DereferenceReject})
+	require.NoError(t, err)
+	err = fs.Walk(context.TODO(), "", func(string, os.DirEntry, error) error { return nil })
+	require.NoError(t, err)
+	err = fs.Walk(context.TODO(), "", func(_ string, _ os.DirEntry, err error) error { return err })
+	require.ErrorIs(t, err, syscall.ELOOP)
+
+	_, err = fs.Open(filepath.FromSlash("l3"))
+	require.ErrorIs(t, err, errLinkOutsideRoot)
+	_, err = fs.Open(filepath.FromSlash("l4"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// the walk errors are handled by the filter, and the patterns match the
+	// dereferenced paths
+	ffs, err := NewFilterFS(base, &FilterOpt{
+		Dereference:     &DereferenceOpt{Unresolvable: DereferenceReject},
+		ExcludePatterns: []string{"a/sub"},
+		WalkErrorPolicy: WalkErrorCollect,
+	})
+	require.NoError(t, err)
+	b := &bytes.Buffer{}
+	err = ffs.Walk(context.TODO(), "", bufWalkDir(b))
+	var walkErrs WalkErrors
+	require.ErrorAs(t, err, &walkErrs)
+	require.Len(t, walkErrs, 4)
+	assert.ErrorIs(t, walkErrs[0], syscall.ELOOP)
+	assert.ErrorIs(t, walkErrs[1], errLinkOutsideRoot)
+	assert.Equal(t, filepath.FromSlash(`dir a
+file a/f
+file chain
+dir l1
+file l1/f
+dir l1/sub
+file l1/sub/g
+file l2
+`), b.String())
+}
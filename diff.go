@@ -30,6 +30,37 @@ func getRootWalkerFn(root Root) walkerFn {
 	})
 }
 
+// Changes computes the changes between the trees a and b and calls changeFn
+// for every path that was added, modified or deleted in b. Entries are compared
+// by their metadata; file contents are not read.
+func Changes(ctx context.Context, a, b FS, changeFn ChangeFunc) error {
+	return ChangesWithOpt(ctx, a, b, nil, changeFn)
+}
+
+// ChangesOpt controls ChangesWithOpt.
+type ChangesOpt struct {
+	// DetectRenames reports the files that are moved as ChangeKindRename
+	// instead of a delete and an add. With detection, the deletes and the
+	// changes of regular files are reported after all other changes.
+	DetectRenames RenameDetection
+}
+
+// ChangesWithOpt is like Changes, with the given options.
+func ChangesWithOpt(ctx context.Context, a, b FS, opt *ChangesOpt, changeFn ChangeFunc) error {
+	if opt == nil {
+		opt = &ChangesOpt{}
+	}
+	renames, err := newRenameDetector(opt.DetectRenames, a, b)
+	if err != nil {
+		return err
+	}
+	return doubleWalkDiff(ctx, changeFn, getFSWalkerFn(func() (FS, error) {
+		return a, nil
+	}), getFSWalkerFn(func() (FS, error) {
+		return b, nil
+	}), nil, DiffMetadata, renames)
+}
+
 func getFSWalkerFn(newFS func() (FS, error)) walkerFn {
 	return func(ctx context.Context, pathC chan<- *currentPath) error {
 		fs, err := newFS()
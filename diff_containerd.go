@@ -32,6 +32,11 @@ const (
 	// ChangeKindDelete represents a delete of
 	// a file
 	ChangeKindDelete
+
+	// ChangeKindRename represents a file that
+	// is moved, with a *RenameInfo that has
+	// the old path
+	ChangeKindRename
 )
 
 func (k ChangeKind) String() string {
@@ -42,6 +47,8 @@ func (k ChangeKind) String() string {
 		return "modify"
 	case ChangeKindDelete:
 		return "delete"
+	case ChangeKindRename:
+		return "rename"
 	default:
 		return "unknown"
 	}
@@ -59,8 +66,9 @@ type currentPath struct {
 	//	fullPath string
 }
 
-// doubleWalkDiff walks both directories to create a diff
-func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, filter FilterFunc, differ DiffType) (err error) {
+// doubleWalkDiff walks both directories to create a diff. If renames is set,
+// the moved files are reported as renames after the walk.
+func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, filter FilterFunc, differ DiffType, renames *renameDetector) (err error) {
 	g, ctx := errgroup.WithContext(ctx)
 
 	var (
@@ -69,6 +77,9 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, fil
 
 		f1, f2 *currentPath
 		rmdir  string
+		// rmdirDeleted is set if rmdir is deleted, and not replaced by a
+		// modify
+		rmdirDeleted bool
 	)
 	g.Go(func() error {
 		defer close(c1)
@@ -121,17 +132,30 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, fil
 				}
 				f = f2.stat
 				f2 = nil
+				if renames != nil && os.FileMode(f.Mode).IsRegular() {
+					renames.change(k, f2copy, f)
+					continue
+				}
 			case ChangeKindDelete:
 				// Check if this file is already removed by being
 				// under of a removed directory
 				if rmdir != "" && strings.HasPrefix(f1.path, rmdir) {
+					if renames != nil && rmdirDeleted {
+						renames.delete(f1, false)
+					}
 					f1 = nil
 					continue
 				} else if rmdir == "" && f1.stat.IsDir() {
 					rmdir = f1.path + string(filepath.Separator)
+					rmdirDeleted = true
 				} else if rmdir != "" {
 					rmdir = ""
 				}
+				if renames != nil {
+					renames.delete(f1, true)
+					f1 = nil
+					continue
+				}
 				f1 = nil
 			case ChangeKindModify:
 				same, err := sameFile(f1, f2copy, differ)
@@ -140,6 +164,7 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, fil
 				}
 				if f1.stat.IsDir() && !f2copy.stat.IsDir() {
 					rmdir = f1.path + string(filepath.Separator)
+					rmdirDeleted = false
 				} else if rmdir != "" {
 					rmdir = ""
 				}
@@ -149,11 +174,19 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, fil
 				if same {
 					continue loop0
 				}
+				if renames != nil && os.FileMode(f.Mode).IsRegular() {
+					// a hardlink can point to a deferred file
+					renames.change(k, f2copy, f)
+					continue loop0
+				}
 			}
 			if err := changeFn(k, p, &StatInfo{f}, nil); err != nil {
 				return err
 			}
 		}
+		if renames != nil {
+			return renames.flush(changeFn)
+		}
 		return nil
 	})
 
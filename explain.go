@@ -0,0 +1,345 @@
+package fsutil
+
+import (
+	"context"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// FilterResult is the decision of a filter FS for a path.
+type FilterResult int
+
+const (
+	// FilterIncluded paths are part of the FS.
+	FilterIncluded FilterResult = iota
+	// FilterExcluded paths are not part of the FS. The contents of excluded
+	// directories are still walked.
+	FilterExcluded
+	// FilterPruned directories are excluded together with their contents.
+	FilterPruned
+	// FilterParent directories are only included if anything inside them is
+	// included.
+	FilterParent
+)
+
+func (r FilterResult) String() string {
+	switch r {
+	case FilterIncluded:
+		return "included"
+	case FilterExcluded:
+		return "excluded"
+	case FilterPruned:
+		return "pruned"
+	case FilterParent:
+		return "parent"
+	}
+	return "unknown"
+}
+
+// FilterReason is what made the decision of a filter FS for a path.
+type FilterReason int
+
+const (
+	// FilterReasonNone means that no filter applied to the path.
+	FilterReasonNone FilterReason = iota
+	// FilterReasonPattern means that the decision was made by
+	// FilterDecision.Pattern.
+	FilterReasonPattern
+	// FilterReasonNoIncludeMatch means that the path did not match any of the
+	// include patterns.
+	FilterReasonNoIncludeMatch
+	// FilterReasonMap means that the decision was made by the Map function or
+	// the StatFilter.
+	FilterReasonMap
+	// FilterReasonChild means that a FilterParent directory is included
+	// because something inside it is included.
+	FilterReasonChild
+)
+
+func (r FilterReason) String() string {
+	switch r {
+	case FilterReasonNone:
+		return "none"
+	case FilterReasonPattern:
+		return "pattern"
+	case FilterReasonNoIncludeMatch:
+		return "no include match"
+	case FilterReasonMap:
+		return "map"
+	case FilterReasonChild:
+		return "child"
+	}
+	return "unknown"
+}
+
+// FilterPatternSource is where a FilterPattern comes from.
+type FilterPatternSource int
+
+const (
+	FilterIncludePatterns FilterPatternSource = iota
+	FilterExcludePatterns
+	FilterIgnoreFile
+)
+
+// FilterPattern identifies a single pattern of a filter FS.
+type FilterPattern struct {
+	Source FilterPatternSource
+	// Index is the index of the pattern in FilterOpt.IncludePatterns or
+	// FilterOpt.ExcludePatterns, or -1 for the patterns that were added for
+	// FollowPaths. For ignore files it is the line number of the pattern.
+	Index int
+	// File is the path of the ignore file.
+	File string
+	// Pattern is the pattern as it was written.
+	Pattern string
+}
+
+// FilterDecision explains why a filter FS includes or excludes a path.
+type FilterDecision struct {
+	Path   string
+	Result FilterResult
+	Reason FilterReason
+	// Pattern is the pattern that made the decision if Reason is
+	// FilterReasonPattern.
+	Pattern *FilterPattern
+	// Parent is set if Path is excluded because its parent directory Parent
+	// is pruned. The other fields then describe the decision for Parent.
+	Parent string
+}
+
+// FilterExplainer is implemented by the FS returned by NewFilterFS.
+type FilterExplainer interface {
+	// Explain returns the decision of the filter for the path p.
+	Explain(ctx context.Context, p string) (*FilterDecision, error)
+	// UnusedPatterns returns the include and exclude patterns that do not
+	// match any path of the unfiltered FS.
+	UnusedPatterns(ctx context.Context) ([]FilterPattern, error)
+}
+
+var _ FilterExplainer = &filterFS{}
+
+// filterPatterns returns the FilterPatterns for the patterns that a
+// patternmatcher was created with. If orig is not the same list as patterns,
+// the indexes are looked up from orig.
+func filterPatterns(source FilterPatternSource, patterns, orig []string, sameList bool) []FilterPattern {
+	var out []FilterPattern
+	for i, p := range patterns {
+		// patternmatcher ignores empty patterns
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		if !sameList {
+			i = slices.Index(orig, p)
+		}
+		out = append(out, FilterPattern{Source: source, Index: i, Pattern: p})
+	}
+	return out
+}
+
+func ignoreFilterPattern(p *ignorePattern) *FilterPattern {
+	return &FilterPattern{Source: FilterIgnoreFile, Index: p.line, File: p.file, Pattern: p.text}
+}
+
+// patternMatchers returns a matcher for each single pattern of source, so
+// that the pattern that made a decision can be found. The matchers only
+// report the combined result.
+func (fs *filterFS) patternMatchers(source FilterPatternSource) []*filterMatcher {
+	if ms, ok := fs.explainMatchers[source]; ok {
+		return ms
+	}
+	fm := fs.includeMatcher
+	if source == FilterExcludePatterns {
+		fm = fs.excludeMatcher
+	}
+	var ms []*filterMatcher
+	if fm != nil {
+		for _, p := range fm.patterns {
+			// the pattern does not contain the "!" of exclusions
+			m, err := fm.single(p)
+			if err != nil {
+				m = nil
+			}
+			ms = append(ms, m)
+		}
+	}
+	fs.explainMatchers[source] = ms
+	return ms
+}
+
+// findPattern returns the last pattern of source that matches p, or one of
+// its parent directories, and is an exclusion if exclusion is set.
+func (fs *filterFS) findPattern(source FilterPatternSource, p string, exclusion bool) (*FilterPattern, error) {
+	fs.explainMu.Lock()
+	defer fs.explainMu.Unlock()
+
+	fm, patterns := fs.includeMatcher, fs.includePatterns
+	if source == FilterExcludePatterns {
+		fm, patterns = fs.excludeMatcher, fs.excludePatterns
+	}
+	if fm == nil {
+		return nil, nil
+	}
+	ms := fs.patternMatchers(source)
+	for i := len(ms) - 1; i >= 0; i-- {
+		if ms[i] == nil || fm.patterns[i].exclusion != exclusion {
+			continue
+		}
+		m, err := ms[i].MatchesOrParentMatches(p)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			return &patterns[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// patternDecision returns the decision for p, which was excluded by the
+// patterns of source.
+func (fs *filterFS) patternDecision(p string, res FilterResult, source FilterPatternSource) (*FilterDecision, error) {
+	d := &FilterDecision{Path: p, Result: res}
+	// include patterns exclude with their exclusions, or with no match, and
+	// exclude patterns exclude with their regular patterns
+	pattern, err := fs.findPattern(source, p, source == FilterIncludePatterns)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case pattern != nil:
+		d.Reason, d.Pattern = FilterReasonPattern, pattern
+	case source == FilterIncludePatterns:
+		d.Reason = FilterReasonNoIncludeMatch
+	}
+	return d, nil
+}
+
+// includedDecision returns the decision for p, which was included.
+func (fs *filterFS) includedDecision(p string) (*FilterDecision, error) {
+	d := &FilterDecision{Path: p, Result: FilterIncluded}
+	pattern, err := fs.findPattern(FilterExcludePatterns, p, true)
+	if err != nil {
+		return nil, err
+	}
+	if pattern == nil {
+		if pattern, err = fs.findPattern(FilterIncludePatterns, p, false); err != nil {
+			return nil, err
+		}
+	}
+	if pattern != nil {
+		d.Reason, d.Pattern = FilterReasonPattern, pattern
+	}
+	return d, nil
+}
+
+// traceDecision reports the decision returned by decide to trace, if set.
+// The decision is only computed for tracing.
+func traceDecision(trace func(*FilterDecision), decide func() (*FilterDecision, error)) error {
+	if trace == nil {
+		return nil
+	}
+	d, err := decide()
+	if err != nil {
+		return err
+	}
+	trace(d)
+	return nil
+}
+
+func (fs *filterFS) Explain(ctx context.Context, p string) (*FilterDecision, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		return nil, errors.WithStack(&os.PathError{Op: "explain", Path: p, Err: syscall.EINVAL})
+	}
+	var parent filterVisitedDir
+	parts := strings.Split(p, string(filepath.Separator))
+	for i := range parts {
+		dirPath := filepath.Join(parts[:i+1]...)
+		stat, err := statPath(ctx, fs.fs, dirPath)
+		if err != nil {
+			return nil, err
+		}
+		dir, m, err := fs.decide(dirPath, stat.IsDir(), parent, stat)
+		if err != nil {
+			return nil, err
+		}
+		d, err := fs.decision(dirPath, m)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(parts)-1 {
+			return d, nil
+		}
+		if d.Result == FilterPruned {
+			d.Path, d.Parent = p, dirPath
+			d.Result = FilterExcluded
+			return d, nil
+		}
+		parent = dir
+	}
+	return nil, errors.WithStack(&os.PathError{Op: "explain", Path: p, Err: syscall.ENOENT})
+}
+
+// decision returns the FilterDecision for the result of decide for p.
+func (fs *filterFS) decision(p string, m filterMatch) (*FilterDecision, error) {
+	switch {
+	case m.mapResult != MapResultKeep:
+		return &FilterDecision{Path: p, Result: m.result, Reason: FilterReasonMap}, nil
+	case m.ignore != nil:
+		return &FilterDecision{Path: p, Result: m.result, Reason: FilterReasonPattern, Pattern: ignoreFilterPattern(m.ignore)}, nil
+	case m.result == FilterIncluded:
+		return fs.includedDecision(p)
+	}
+	return fs.patternDecision(p, m.result, m.source)
+}
+
+func (fs *filterFS) UnusedPatterns(ctx context.Context) ([]FilterPattern, error) {
+	type unused struct {
+		pattern *FilterPattern
+		m       *filterMatcher
+	}
+	var patterns []unused
+	fs.explainMu.Lock()
+	for _, source := range []FilterPatternSource{FilterIncludePatterns, FilterExcludePatterns} {
+		all := fs.includePatterns
+		if source == FilterExcludePatterns {
+			all = fs.excludePatterns
+		}
+		for i, m := range fs.patternMatchers(source) {
+			if m != nil {
+				patterns = append(patterns, unused{pattern: &all[i], m: m})
+			}
+		}
+	}
+	fs.explainMu.Unlock()
+
+	err := fs.fs.Walk(ctx, "", func(p string, _ gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fs.explainMu.Lock()
+		defer fs.explainMu.Unlock()
+		patterns = slices.DeleteFunc(patterns, func(u unused) bool {
+			m, _ := u.m.MatchesOrParentMatches(p)
+			return m
+		})
+		if len(patterns) == 0 {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]FilterPattern, 0, len(patterns))
+	for _, u := range patterns {
+		out = append(out, *u.pattern)
+	}
+	return out, nil
+}
@@ -0,0 +1,193 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func formatFilterDecision(d *FilterDecision) string {
+	s := fmt.Sprintf("%s %s %s", d.Result, d.Reason, filepath.ToSlash(d.Path))
+	if d.Parent != "" {
+		s += " parent=" + filepath.ToSlash(d.Parent)
+	}
+	if d.Pattern != nil {
+		s += fmt.Sprintf(" %d:%d:%s", d.Pattern.Source, d.Pattern.Index, d.Pattern.Pattern)
+		if d.Pattern.File != "" {
+			s += " file=" + filepath.ToSlash(d.Pattern.File)
+		}
+	}
+	return s
+}
+
+func TestFilterExplain(t *testing.T) {
+	var decisions []string
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file",
+		"ADD a/c.go file",
+		"ADD build dir",
+		"ADD build/out file",
+		"ADD docs dir",
+		"ADD docs/x.md file",
+		"ADD docs/y.txt file",
+		"ADD src dir",
+		"ADD src/main.go file",
+		"ADD src/main_test.go file",
+		"ADD src/x.tmp file",
+		"ADD vendor dir",
+		"ADD vendor/v.go file",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	require.NoError(t, os.WriteFile(filepath.Join(d, "src/.ignore"), []byte("# temporary files\n*.tmp\n"), 0600))
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+	fs, err := NewFilterFS(base, &FilterOpt{
+		IncludePatterns: []string{"a", "src", "docs/*.md"},
+		ExcludePatterns: []string{"**/*_test.go", "build", "a/c.go", "!a/c.go", "", "unused/**"},
+		IgnoreFiles:     []string{".ignore"},
+		Trace: func(d *FilterDecision) {
+			decisions = append(decisions, formatFilterDecision(d))
+		},
+	})
+	require.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir a
+file a/b
+file a/c.go
+dir docs
+file docs/x.md
+dir src
+file src/.ignore
+file src/main.go
+`), b.String())
+
+	assert.Equal(t, []string{
+		"included pattern a 0:0:a",
+		"included pattern a/b 0:0:a",
+		"included pattern a/c.go 1:3:!a/c.go",
+		"pruned pattern build 1:1:build",
+		"parent no include match docs",
+		"included child docs",
+		"included pattern docs/x.md 0:2:docs/*.md",
+		"excluded no include match docs/y.txt",
+		"included pattern src 0:1:src",
+		"included pattern src/.ignore 0:1:src",
+		"included pattern src/main.go 0:1:src",
+		"excluded pattern src/main_test.go 1:0:**/*_test.go",
+		"excluded pattern src/x.tmp 2:2:*.tmp file=src/.ignore",
+		"parent no include match vendor",
+		"excluded no include match vendor/v.go",
+	}, decisions)
+
+	explainer, ok := fs.(FilterExplainer)
+	require.True(t, ok)
+
+	for p, expected := range map[string]string{
+		"a":                "included pattern a 0:0:a",
+		"a/b":              "included pattern a/b 0:0:a",
+		"a/c.go":           "included pattern a/c.go 1:3:!a/c.go",
+		"build":            "pruned pattern build 1:1:build",
+		"build/out":        "excluded pattern build/out parent=build 1:1:build",
+		"docs":             "parent no include match docs",
+		"docs/x.md":        "included pattern docs/x.md 0:2:docs/*.md",
+		"docs/y.txt":       "excluded no include match docs/y.txt",
+		"src/main.go":      "included pattern src/main.go 0:1:src",
+		"src/main_test.go": "excluded pattern src/main_test.go 1:0:**/*_test.go",
+		"src/x.tmp":        "excluded pattern src/x.tmp 2:2:*.tmp file=src/.ignore",
+	} {
+		d, err := explainer.Explain(context.TODO(), filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		assert.Equal(t, expected, formatFilterDecision(d), p)
+	}
+
+	_, err = explainer.Explain(context.TODO(), "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	unused, err := explainer.UnusedPatterns(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, []FilterPattern{{Source: FilterExcludePatterns, Index: 5, Pattern: "unused/**"}}, unused)
+}
+
+func TestFilterExplainMap(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD docs dir",
+		"ADD docs/x.md file",
+		"ADD src dir",
+		"ADD src/main.go file",
+		"ADD src/old dir",
+		"ADD src/old/x.go file",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+	var decisions []string
+	fs, err := NewFilterFS(base, &FilterOpt{
+		IncludePatterns: []string{"**/*.md", "**/*.go"},
+		Map: func(p string, _ *types.Stat) MapResult {
+			switch filepath.ToSlash(p) {
+			case "docs":
+				return MapResultSkipDir
+			case "src/old":
+				return MapResultExclude
+			}
+			return MapResultKeep
+		},
+		Trace: func(d *FilterDecision) {
+			decisions = append(decisions, formatFilterDecision(d))
+		},
+	})
+	require.NoError(t, err)
+
+	// the directories that are only included for their contents are mapped
+	// like walk maps them
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir src
+file src/main.go
+file src/old/x.go
+`), b.String())
+	assert.Equal(t, []string{
+		"parent no include match docs",
+		"pruned map docs",
+		"parent no include match src",
+		"included child src",
+		"included pattern src/main.go 0:1:**/*.go",
+		"parent no include match src/old",
+		"excluded map src/old",
+		"included pattern src/old/x.go 0:1:**/*.go",
+	}, decisions)
+
+	explainer := fs.(FilterExplainer)
+	for p, expected := range map[string]string{
+		"docs":         "pruned map docs",
+		"docs/x.md":    "excluded map docs/x.md parent=docs",
+		"src":          "parent no include match src",
+		"src/old":      "excluded map src/old",
+		"src/old/x.go": "included pattern src/old/x.go 0:1:**/*.go",
+	} {
+		d, err := explainer.Explain(context.TODO(), filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		assert.Equal(t, expected, formatFilterDecision(d), p)
+	}
+
+	for _, p := range []string{"docs", "docs/x.md", "src/old"} {
+		_, err := statPath(context.TODO(), fs, filepath.FromSlash(p))
+		require.ErrorIs(t, err, os.ErrNotExist, p)
+	}
+}
@@ -6,7 +6,10 @@ import (
 	gofs "io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/moby/patternmatcher"
@@ -27,10 +30,61 @@ type FilterOpt struct {
 	// at the time of the call to NewFilterFS.
 	FollowPaths []string
 
+	// Dereference, if set, replaces symlinks with the entries they point to
+	// before the other filters are applied, so the patterns match the paths
+	// of the symlinks.
+	Dereference *DereferenceOpt
+
+	// PatternMode controls the syntax of IncludePatterns and
+	// ExcludePatterns. Defaults to PatternModeGlob.
+	PatternMode PatternMode
+
+	// CaseInsensitive matches IncludePatterns and ExcludePatterns ignoring
+	// case, for trees that come from case-insensitive filesystems.
+	CaseInsensitive bool
+
+	// IgnoreFiles contains the names of ignore files, like .gitignore, that
+	// are read from every directory while walking. Their patterns use the
+	// gitignore syntax and apply to the directory of the file and everything
+	// under it, with the files of deeper directories and later lines taking
+	// precedence. Paths that they ignore are excluded in addition to
+	// ExcludePatterns, and a path can not be re-included if its parent
+	// directory is ignored. The files are read again on every Walk.
+	IgnoreFiles []string
+
+	// Trace, if set, is called during Walk with the decision for every path
+	// that is visited or pruned. Directories that are first reported as
+	// FilterParent are reported again when something inside them is
+	// included.
+	Trace func(*FilterDecision)
+
+	// StatFilter, if set, excludes paths by their stat info. It is applied
+	// before Map, so Map is not called for the paths that it excludes.
+	StatFilter *StatFilter
+
 	// Map is called for each path that is included in the result.
 	// The function can modify the stat info for each element, while the result
 	// of the function controls both how Walk continues.
 	Map MapFunc
+
+	// Rewrite, if set, changes the paths of the entries that are included,
+	// after Map. Changing stat.Path in Map breaks the walk order, while the
+	// entries of Rewrite are sorted again. See NewRewriteFS.
+	//
+	// With Rewrite, the returned FS does not implement FilterExplainer,
+	// StatFS or ReadDirFS, and Stat and ReadDir fall back to walking. To
+	// explain the decisions for the paths before the rewrite, call
+	// NewRewriteFS on an FS from NewFilterFS without Rewrite instead.
+	Rewrite RewriteFunc
+
+	// WalkErrorPolicy controls how Walk handles entries that can not be
+	// read. Entries that are excluded by the patterns are always skipped.
+	// Defaults to WalkErrorFail.
+	WalkErrorPolicy WalkErrorPolicy
+
+	// WalkErrorHandler, if set, is called for every included entry that can
+	// not be read and decides the policy for it instead of WalkErrorPolicy.
+	WalkErrorHandler WalkErrorHandler
 }
 
 type MapFunc func(string, *types.Stat) MapResult
@@ -56,12 +110,27 @@ const (
 type filterFS struct {
 	fs FS
 
-	includeMatcher              *patternmatcher.PatternMatcher
-	excludeMatcher              *patternmatcher.PatternMatcher
-	onlyPrefixIncludes          bool
-	onlyPrefixExcludeExceptions bool
+	includeMatcher *filterMatcher
+	excludeMatcher *filterMatcher
 
 	mapFn MapFunc
+
+	walkErrorPolicy  WalkErrorPolicy
+	walkErrorHandler WalkErrorHandler
+
+	ignoreFileNames []string
+	ignoreMu        sync.Mutex
+	// ignoreCache contains the parsed ignore files by directory, reset by
+	// every Walk
+	ignoreCache map[string][]ignorePattern
+
+	trace           func(*FilterDecision)
+	includePatterns []FilterPattern
+	excludePatterns []FilterPattern
+	explainMu       sync.Mutex
+	// explainMatchers contains a matcher for each single include and exclude
+	// pattern, created on first use
+	explainMatchers map[FilterPatternSource][]*filterMatcher
 }
 
 // NewFilterFS creates a new FS that filters the given FS using the given
@@ -79,6 +148,13 @@ func NewFilterFS(fs FS, opt *FilterOpt) (FS, error) {
 		return fs, nil
 	}
 
+	if opt.Dereference != nil {
+		var err error
+		if fs, err = NewDereferenceFS(fs, opt.Dereference); err != nil {
+			return nil, err
+		}
+	}
+
 	var includePatterns []string
 	if opt.IncludePatterns != nil {
 		includePatterns = make([]string, len(opt.IncludePatterns))
@@ -90,98 +166,147 @@ func NewFilterFS(fs FS, opt *FilterOpt) (FS, error) {
 			return nil, err
 		}
 		if targets != nil {
+			if opt.PatternMode == PatternModeRegexp {
+				for i, t := range targets {
+					targets[i] = regexp.QuoteMeta(filepath.ToSlash(t))
+				}
+			}
 			includePatterns = append(includePatterns, targets...)
 			includePatterns = dedupePaths(includePatterns)
 		}
 	}
 
-	patternChars := "*[]?^"
-	if filepath.Separator != '\\' {
-		patternChars += `\`
-	}
-
 	var (
-		includeMatcher              *patternmatcher.PatternMatcher
-		excludeMatcher              *patternmatcher.PatternMatcher
-		err                         error
-		onlyPrefixIncludes          = true
-		onlyPrefixExcludeExceptions = true
+		includeMatcher *filterMatcher
+		excludeMatcher *filterMatcher
+		err            error
 	)
 
 	if len(includePatterns) > 0 {
-		includeMatcher, err = patternmatcher.New(includePatterns)
+		includeMatcher, err = newFilterMatcher(includePatterns, opt.PatternMode, opt.CaseInsensitive)
 		if err != nil {
 			return nil, errors.Wrapf(err, "invalid includepatterns: %s", includePatterns)
 		}
-
-		for _, p := range includeMatcher.Patterns() {
-			if !p.Exclusion() && strings.ContainsAny(patternWithoutTrailingGlob(p), patternChars) {
-				onlyPrefixIncludes = false
-				break
-			}
-		}
-
 	}
 
 	if len(opt.ExcludePatterns) > 0 {
-		excludeMatcher, err = patternmatcher.New(opt.ExcludePatterns)
+		excludeMatcher, err = newFilterMatcher(opt.ExcludePatterns, opt.PatternMode, opt.CaseInsensitive)
 		if err != nil {
 			return nil, errors.Wrapf(err, "invalid excludepatterns: %s", opt.ExcludePatterns)
 		}
+	}
 
-		for _, p := range excludeMatcher.Patterns() {
-			if p.Exclusion() && strings.ContainsAny(patternWithoutTrailingGlob(p), patternChars) {
-				onlyPrefixExcludeExceptions = false
-				break
-			}
+	mapFn := opt.Map
+	if opt.StatFilter != nil {
+		if err := opt.StatFilter.validate(); err != nil {
+			return nil, err
 		}
+		mapFn = opt.StatFilter.mapFunc(opt.Map)
 	}
 
-	return &filterFS{
-		fs:                          fs,
-		includeMatcher:              includeMatcher,
-		excludeMatcher:              excludeMatcher,
-		onlyPrefixIncludes:          onlyPrefixIncludes,
-		onlyPrefixExcludeExceptions: onlyPrefixExcludeExceptions,
-		mapFn:                       opt.Map,
-	}, nil
+	f := &filterFS{
+		fs:               fs,
+		includeMatcher:   includeMatcher,
+		excludeMatcher:   excludeMatcher,
+		mapFn:            mapFn,
+		walkErrorPolicy:  opt.WalkErrorPolicy,
+		walkErrorHandler: opt.WalkErrorHandler,
+		ignoreFileNames:  slices.Clone(opt.IgnoreFiles),
+		ignoreCache:      map[string][]ignorePattern{},
+		trace:            opt.Trace,
+		includePatterns:  filterPatterns(FilterIncludePatterns, includePatterns, opt.IncludePatterns, len(opt.FollowPaths) == 0),
+		excludePatterns:  filterPatterns(FilterExcludePatterns, opt.ExcludePatterns, opt.ExcludePatterns, true),
+		explainMatchers:  map[FilterPatternSource][]*filterMatcher{},
+	}
+	var ffs FS = f
+	if _, ok := fs.(ReaderAtFS); ok {
+		ffs = &filterReaderAtFS{f}
+	}
+	if opt.Rewrite != nil {
+		ffs = NewRewriteFS(ffs, opt.Rewrite)
+	}
+	return ffs, nil
 }
 
 func (fs *filterFS) Open(p string) (io.ReadCloser, error) {
+	if err := fs.checkOpen(p); err != nil {
+		return nil, err
+	}
+	return fs.fs.Open(p)
+}
+
+// filterReaderAtFS is a filterFS over an FS that implements ReaderAtFS.
+type filterReaderAtFS struct {
+	*filterFS
+}
+
+func (fs *filterReaderAtFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	if err := fs.checkOpen(p); err != nil {
+		return nil, err
+	}
+	return fs.fs.(ReaderAtFS).OpenReaderAt(p)
+}
+
+// checkOpen returns an error if p is filtered out by the patterns.
+func (fs *filterFS) checkOpen(p string) error {
 	if fs.includeMatcher != nil {
 		m, err := fs.includeMatcher.MatchesOrParentMatches(p)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if !m {
-			return nil, errors.Wrapf(os.ErrNotExist, "open %s", p)
+			return errors.Wrapf(os.ErrNotExist, "open %s", p)
 		}
 	}
 	if fs.excludeMatcher != nil {
 		m, err := fs.excludeMatcher.MatchesOrParentMatches(p)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if m {
-			return nil, errors.Wrapf(os.ErrNotExist, "open %s", p)
+			return errors.Wrapf(os.ErrNotExist, "open %s", p)
 		}
 	}
-	return fs.fs.Open(p)
+	if cleaned := cleanFSPath(p); cleaned != "" {
+		ignored, err := fs.ignoredOrParent(cleaned, false)
+		if err != nil {
+			return err
+		}
+		if ignored {
+			return errors.Wrapf(os.ErrNotExist, "open %s", p)
+		}
+	}
+	return nil
 }
 
-func (fs *filterFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
-	type visitedDir struct {
-		entry            gofs.DirEntry
-		pathWithSep      string
-		includeMatchInfo patternmatcher.MatchInfo
-		excludeMatchInfo patternmatcher.MatchInfo
-		calledFn         bool
-		skipFn           bool
-	}
+type filterVisitedDir struct {
+	entry            gofs.DirEntry
+	pathWithSep      string
+	includeMatchInfo filterMatchInfo
+	excludeMatchInfo filterMatchInfo
+	calledFn         bool
+	skipFn           bool
+}
 
-	// used only for include/exclude handling
-	var parentDirs []visitedDir
+func (fs *filterFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	fs.ignoreMu.Lock()
+	clear(fs.ignoreCache)
+	fs.ignoreMu.Unlock()
+	h := newWalkErrorHandler(fs.walkErrorPolicy, fs.walkErrorHandler)
+	return h.result(fs.walk(ctx, target, nil, h, fs.trace, fn))
+}
 
+// walk walks target. parentDirs contains the already visited parent
+// directories of target, used only for include/exclude handling. h applies
+// the walk error policy to the included entries and trace is called with the
+// decisions, if set.
+func (fs *filterFS) walk(ctx context.Context, target string, parentDirs []filterVisitedDir, h *walkErrorHandler, trace func(*FilterDecision), fn gofs.WalkDirFunc) error {
+	if dir := filepath.Dir(cleanFSPath(target)); dir != "." {
+		ignored, err := fs.ignoredOrParent(dir, true)
+		if err != nil || ignored {
+			return err
+		}
+	}
 	return fs.fs.Walk(ctx, target, func(path string, dirEntry gofs.DirEntry, walkErr error) (retErr error) {
 		defer func() {
 			if retErr != nil && isNotExist(retErr) {
@@ -189,14 +314,12 @@ func (fs *filterFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc
 			}
 		}()
 
-		var (
-			dir   visitedDir
-			isDir bool
-		)
+		var isDir bool
 		if dirEntry != nil {
 			isDir = dirEntry.IsDir()
 		}
 
+		var parent filterVisitedDir
 		if fs.includeMatcher != nil || fs.excludeMatcher != nil {
 			for len(parentDirs) != 0 {
 				lastParentDir := parentDirs[len(parentDirs)-1].pathWithSep
@@ -205,116 +328,55 @@ func (fs *filterFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc
 				}
 				parentDirs = parentDirs[:len(parentDirs)-1]
 			}
-
-			if isDir {
-				dir = visitedDir{
-					entry:       dirEntry,
-					pathWithSep: path + string(filepath.Separator),
-				}
-			}
-		}
-
-		skip := false
-
-		if fs.includeMatcher != nil {
-			var parentIncludeMatchInfo patternmatcher.MatchInfo
 			if len(parentDirs) != 0 {
-				parentIncludeMatchInfo = parentDirs[len(parentDirs)-1].includeMatchInfo
-			}
-			m, matchInfo, err := fs.includeMatcher.MatchesUsingParentResults(path, parentIncludeMatchInfo)
-			if err != nil {
-				return errors.Wrap(err, "failed to match includepatterns")
-			}
-
-			if isDir {
-				dir.includeMatchInfo = matchInfo
+				parent = parentDirs[len(parentDirs)-1]
 			}
+		}
 
-			if !m {
-				if isDir && fs.onlyPrefixIncludes {
-					// Optimization: we can skip walking this dir if no include
-					// patterns could match anything inside it.
-					dirSlash := path + string(filepath.Separator)
-					for _, pat := range fs.includeMatcher.Patterns() {
-						if pat.Exclusion() {
-							continue
-						}
-						patStr := patternWithoutTrailingGlob(pat) + string(filepath.Separator)
-						if strings.HasPrefix(patStr, dirSlash) {
-							goto passedIncludeFilter
-						}
-					}
-					return filepath.SkipDir
-				}
-			passedIncludeFilter:
-				skip = true
-			}
+		// the stat info is only loaded for the entries that the patterns
+		// include, so Map is applied below
+		dir, m, err := fs.decide(path, isDir, parent, nil)
+		if err != nil {
+			return err
 		}
+		dir.entry, dir.calledFn = dirEntry, false
 
-		if fs.excludeMatcher != nil {
-			var parentExcludeMatchInfo patternmatcher.MatchInfo
-			if len(parentDirs) != 0 {
-				parentExcludeMatchInfo = parentDirs[len(parentDirs)-1].excludeMatchInfo
-			}
-			m, matchInfo, err := fs.excludeMatcher.MatchesUsingParentResults(path, parentExcludeMatchInfo)
-			if err != nil {
-				return errors.Wrap(err, "failed to match excludepatterns")
+		if m.result == FilterPruned || m.ignore != nil {
+			if err := traceDecision(trace, func() (*FilterDecision, error) {
+				return fs.decision(path, m)
+			}); err != nil {
+				return err
 			}
-
 			if isDir {
-				dir.excludeMatchInfo = matchInfo
-			}
-
-			if m {
-				if isDir && fs.onlyPrefixExcludeExceptions {
-					// Optimization: we can skip walking this dir if no
-					// exceptions to exclude patterns could match anything
-					// inside it.
-					if !fs.excludeMatcher.Exclusions() {
-						return filepath.SkipDir
-					}
-
-					dirSlash := path + string(filepath.Separator)
-					for _, pat := range fs.excludeMatcher.Patterns() {
-						if !pat.Exclusion() {
-							continue
-						}
-						patStr := patternWithoutTrailingGlob(pat) + string(filepath.Separator)
-						if strings.HasPrefix(patStr, dirSlash) {
-							goto passedExcludeFilter
-						}
-					}
-					return filepath.SkipDir
-				}
-			passedExcludeFilter:
-				skip = true
+				return filepath.SkipDir
 			}
+			return nil
 		}
 
 		if walkErr != nil {
-			if skip && errors.Is(walkErr, os.ErrPermission) {
+			if m.result != FilterIncluded && errors.Is(walkErr, os.ErrPermission) {
 				return nil
 			}
-			return walkErr
+			return h.handle(path, walkErr)
 		}
 
-		if fs.includeMatcher != nil || fs.excludeMatcher != nil {
+		if isDir && (fs.includeMatcher != nil || fs.excludeMatcher != nil) {
 			defer func() {
-				if isDir {
-					parentDirs = append(parentDirs, dir)
-				}
+				parentDirs = append(parentDirs, dir)
 			}()
 		}
 
-		if skip {
-			return nil
+		if m.result != FilterIncluded {
+			return traceDecision(trace, func() (*FilterDecision, error) {
+				return fs.decision(path, m)
+			})
 		}
 
 		dir.calledFn = true
 
 		fi, err := dirEntry.Info()
 		if err != nil {
-			return err
+			return h.skipEntry(path, dirEntry, err)
 		}
 		stat, ok := fi.Sys().(*types.Stat)
 		if !ok {
@@ -325,59 +387,333 @@ func (fs *filterFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			if fs.mapFn != nil {
-				switch result := fs.mapFn(stat.Path, stat); result {
-				case MapResultSkipDir:
-					return filepath.SkipDir
-				case MapResultExclude:
-					return nil
-				}
+		}
+		if m = fs.mapDecision(stat, m); m.mapResult != MapResultKeep {
+			if err := traceDecision(trace, func() (*FilterDecision, error) {
+				return fs.decision(path, m)
+			}); err != nil {
+				return err
 			}
-			for i, parentDir := range parentDirs {
-				if parentDir.skipFn {
-					return filepath.SkipDir
-				}
-				if parentDir.calledFn {
-					continue
-				}
-				parentFi, err := parentDir.entry.Info()
-				if err != nil {
+			if m.mapResult == MapResultSkipDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for i, parentDir := range parentDirs {
+			if parentDir.skipFn {
+				return filepath.SkipDir
+			}
+			if parentDir.calledFn {
+				continue
+			}
+			parentFi, err := parentDir.entry.Info()
+			if err != nil {
+				return err
+			}
+			parentStat, ok := parentFi.Sys().(*types.Stat)
+			if !ok {
+				return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			// the directories that are only included for their contents
+			// are mapped once something inside them is included
+			if pm := fs.mapDecision(parentStat, filterMatch{result: FilterParent}); pm.mapResult != MapResultKeep {
+				if err := traceDecision(trace, func() (*FilterDecision, error) {
+					return fs.decision(parentStat.Path, pm)
+				}); err != nil {
 					return err
 				}
-				parentStat, ok := parentFi.Sys().(*types.Stat)
-				if !ok {
-					return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+				if pm.mapResult == MapResultExclude {
+					continue
 				}
+				parentDirs[i].skipFn = true
+				return filepath.SkipDir
+			}
 
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
-				}
-				if fs.mapFn != nil {
-					switch result := fs.mapFn(parentStat.Path, parentStat); result {
-					case MapResultExclude:
-						continue
-					case MapResultSkipDir:
-						parentDirs[i].skipFn = true
-						return filepath.SkipDir
-					}
-				}
+			parentDirs[i].calledFn = true
+			if trace != nil {
+				trace(&FilterDecision{Path: parentStat.Path, Result: FilterIncluded, Reason: FilterReasonChild})
+			}
+			if err := fn(parentStat.Path, &DirEntryInfo{Stat: parentStat}, nil); err == filepath.SkipDir {
+				parentDirs[i].skipFn = true
+				return filepath.SkipDir
+			} else if err != nil {
+				return err
+			}
+		}
+		if err := traceDecision(trace, func() (*FilterDecision, error) {
+			return fs.decision(stat.Path, m)
+		}); err != nil {
+			return err
+		}
+		return fn(stat.Path, &DirEntryInfo{Stat: stat}, nil)
+	})
+}
 
-				parentDirs[i].calledFn = true
-				if err := fn(parentStat.Path, &DirEntryInfo{Stat: parentStat}, nil); err == filepath.SkipDir {
-					parentDirs[i].skipFn = true
-					return filepath.SkipDir
-				} else if err != nil {
-					return err
+// dirMayInclude reports whether anything inside the directory p, which does
+// not match the include patterns itself, could match them.
+func (fs *filterFS) dirMayInclude(p string) bool {
+	return fs.includeMatcher.mayMatchInside(p, false)
+}
+
+// dirMayReinclude reports whether anything inside the directory p, which
+// matches the exclude patterns, could match an exception to them.
+func (fs *filterFS) dirMayReinclude(p string) bool {
+	return fs.excludeMatcher.mayMatchInside(p, true)
+}
+
+// filterMatch is the result of decide. It is turned into a FilterDecision
+// only for Explain and Trace, as finding the pattern that made a decision
+// needs to match the patterns one by one.
+type filterMatch struct {
+	result FilterResult
+	// source is the source of the patterns that did not include the path,
+	// if ignore is nil and mapResult is MapResultKeep
+	source FilterPatternSource
+	// ignore is the pattern of an ignore file that ignores the path
+	ignore *ignorePattern
+	// mapResult is the result of Map if it did not keep the path
+	mapResult MapResult
+}
+
+// decide returns the decision for p, using the results of its parent
+// directory, and the state to use as a parent for the entries of p. It is the
+// single place for the order of the filters: the include patterns, the
+// exclude patterns, the ignore files and Map.
+//
+// Map is only applied if stat is set. Otherwise the result for a path that Map
+// could still exclude is FilterIncluded or FilterParent, and the caller
+// applies Map with mapDecision once it has the stat info.
+func (fs *filterFS) decide(p string, isDir bool, parent filterVisitedDir, stat *types.Stat) (filterVisitedDir, filterMatch, error) {
+	dir := filterVisitedDir{pathWithSep: p + string(filepath.Separator), calledFn: true}
+	pruned := FilterExcluded
+	if isDir {
+		pruned = FilterPruned
+	}
+	res := filterMatch{result: FilterIncluded}
+
+	if fs.includeMatcher != nil {
+		m, matchInfo, err := fs.includeMatcher.MatchesUsingParentResults(p, parent.includeMatchInfo)
+		if err != nil {
+			return dir, res, errors.Wrap(err, "failed to match includepatterns")
+		}
+		dir.includeMatchInfo = matchInfo
+		if !m {
+			// Optimization: we can skip walking this dir if no include
+			// patterns could match anything inside it.
+			if !isDir || !fs.dirMayInclude(p) {
+				return dir, filterMatch{result: pruned, source: FilterIncludePatterns}, nil
+			}
+			res = filterMatch{result: FilterParent, source: FilterIncludePatterns}
+		}
+	}
+
+	if fs.excludeMatcher != nil {
+		m, matchInfo, err := fs.excludeMatcher.MatchesUsingParentResults(p, parent.excludeMatchInfo)
+		if err != nil {
+			return dir, res, errors.Wrap(err, "failed to match excludepatterns")
+		}
+		dir.excludeMatchInfo = matchInfo
+		if m {
+			// Optimization: we can skip walking this dir if no exceptions
+			// to exclude patterns could match anything inside it.
+			if !isDir || !fs.dirMayReinclude(p) {
+				return dir, filterMatch{result: pruned, source: FilterExcludePatterns}, nil
+			}
+			if res.result == FilterIncluded {
+				res = filterMatch{result: FilterParent, source: FilterExcludePatterns}
+			}
+		}
+	}
+
+	pattern, err := fs.ignoredBy(p, isDir)
+	if err != nil {
+		return dir, res, err
+	}
+	if pattern != nil {
+		return dir, filterMatch{result: pruned, ignore: pattern}, nil
+	}
+	if stat != nil {
+		res = fs.mapDecision(stat, res)
+	}
+	return dir, res, nil
+}
+
+// mapDecision applies Map to the path of stat that the patterns and the
+// ignore files decided m for.
+func (fs *filterFS) mapDecision(stat *types.Stat, m filterMatch) filterMatch {
+	if fs.mapFn == nil {
+		return m
+	}
+	switch res := fs.mapFn(stat.Path, stat); res {
+	case MapResultExclude:
+		return filterMatch{result: FilterExcluded, mapResult: res}
+	case MapResultSkipDir:
+		if stat.IsDir() {
+			return filterMatch{result: FilterPruned, mapResult: res}
+		}
+		return filterMatch{result: FilterExcluded, mapResult: res}
+	}
+	return m
+}
+
+// matchParents returns the visited state of all parent directories of p, as
+// a walk of the whole FS would have it when reaching p.
+func (fs *filterFS) matchParents(ctx context.Context, p string) ([]filterVisitedDir, error) {
+	var (
+		parents []filterVisitedDir
+		parent  filterVisitedDir
+	)
+	parts := strings.Split(p, string(filepath.Separator))
+	for i := range len(parts) - 1 {
+		dirPath := filepath.Join(parts[:i+1]...)
+		var stat *types.Stat
+		if fs.mapFn != nil {
+			var err error
+			if stat, err = statPath(ctx, fs.fs, dirPath); err != nil {
+				return nil, err
+			}
+		}
+		dir, m, err := fs.decide(dirPath, true, parent, stat)
+		if err != nil {
+			return nil, err
+		}
+		if m.result == FilterPruned {
+			return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.ENOENT})
+		}
+		parents = append(parents, dir)
+		parent = dir
+	}
+	return parents, nil
+}
+
+func (fs *filterFS) Stat(ctx context.Context, p string) (*types.Stat, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.EINVAL})
+	}
+	parents, err := fs.matchParents(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fs.fs.(StatFS); !ok {
+		return fs.walkStat(ctx, p, parents)
+	}
+
+	stat, err := statPath(ctx, fs.fs, p)
+	if err != nil {
+		return nil, err
+	}
+	var parent filterVisitedDir
+	if len(parents) > 0 {
+		parent = parents[len(parents)-1]
+	}
+	_, m, err := fs.decide(p, stat.IsDir(), parent, stat)
+	if err != nil {
+		return nil, err
+	}
+	switch m.result {
+	case FilterIncluded:
+		return stat, nil
+	case FilterParent:
+		return fs.walkStat(ctx, p, parents)
+	}
+	return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.ENOENT})
+}
+
+func (fs *filterFS) ReadDir(ctx context.Context, p string) ([]*types.Stat, error) {
+	p = cleanFSPath(p)
+
+	var (
+		parents []filterVisitedDir
+		parent  filterVisitedDir
+	)
+	if p != "" {
+		stat, err := fs.Stat(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			return nil, errors.WithStack(&os.PathError{Op: "readdir", Path: p, Err: syscall.ENOTDIR})
+		}
+		if parents, err = fs.matchParents(ctx, p); err != nil {
+			return nil, err
+		}
+		if len(parents) > 0 {
+			parent = parents[len(parents)-1]
+		}
+		if parent, _, err = fs.decide(p, true, parent, nil); err != nil {
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+
+	stats, err := readDirPath(ctx, fs.fs, p)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*types.Stat, 0, len(stats))
+	for _, stat := range stats {
+		_, m, err := fs.decide(stat.Path, stat.IsDir(), parent, stat)
+		if err != nil {
+			return nil, err
+		}
+		switch m.result {
+		case FilterIncluded:
+			out = append(out, stat)
+		case FilterParent:
+			stat, err := fs.walkStat(ctx, stat.Path, parents)
+			if err != nil {
+				if isNotExist(err) {
+					continue
 				}
+				return nil, err
+			}
+			out = append(out, stat)
+		default:
+			// like fs.SkipDir, skipping a file skips the rest of the
+			// directory
+			if m.mapResult == MapResultSkipDir && !stat.IsDir() {
+				return out, nil
 			}
-			if err := fn(stat.Path, &DirEntryInfo{Stat: stat}, nil); err != nil {
+		}
+	}
+	return out, nil
+}
+
+// walkStat returns the stat of p by walking it, for directories that are
+// only included if something inside them is.
+func (fs *filterFS) walkStat(ctx context.Context, p string, parents []filterVisitedDir) (*types.Stat, error) {
+	var out *types.Stat
+	err := fs.walk(ctx, p, parents, nil, nil, func(path string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == p {
+			fi, err := entry.Info()
+			if err != nil {
 				return err
 			}
+			stat, ok := fi.Sys().(*types.Stat)
+			if !ok {
+				return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+			}
+			out = stat
 		}
-		return nil
+		return filepath.SkipAll
 	})
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.ENOENT})
+	}
+	return out, nil
 }
 
 func Walk(ctx context.Context, p string, opt *FilterOpt, fn filepath.WalkFunc) error {
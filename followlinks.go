@@ -2,7 +2,6 @@ package fsutil
 
 import (
 	"context"
-	gofs "io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -135,21 +134,60 @@ func (r *symlinkResolver) readSymlink(p string, allowWildcard bool) ([]string, e
 }
 
 func statFile(fs FS, root string) (os.DirEntry, error) {
-	var out os.DirEntry
-
 	root = filepath.FromSlash(filepath.Clean(root))
 	if root == string(filepath.Separator) || root == "." {
 		return nil, nil
 	}
+	stat, err := statPath(context.TODO(), fs, root)
+	if err != nil {
+		return nil, err
+	}
+	return &DirEntryInfo{Stat: stat}, nil
+}
+
+func readDir(fs FS, root string) ([]os.DirEntry, error) {
+	stats, err := readDirPath(context.TODO(), fs, root)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]os.DirEntry, 0, len(stats))
+	for _, stat := range stats {
+		out = append(out, &DirEntryInfo{Stat: stat})
+	}
+	return out, nil
+}
+
+// statPath returns the stat of a single non-root path, using StatFS if fs
+// implements it and walking otherwise.
+func statPath(ctx context.Context, fs FS, root string) (*types.Stat, error) {
+	if sfs, ok := fs.(StatFS); ok {
+		stat, err := sfs.Stat(ctx, root)
+		if err != nil && errors.Is(err, syscall.ENOTDIR) {
+			// a parent is not a directory, report it like walking does
+			return nil, errors.Wrapf(os.ErrNotExist, "readFile %s", root)
+		}
+		return stat, err
+	}
+
+	var out *types.Stat
 
-	err := fs.Walk(context.TODO(), root, func(p string, entry os.DirEntry, err error) error {
+	root = filepath.FromSlash(filepath.Clean(root))
+	err := fs.Walk(ctx, root, func(p string, entry os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if p != root {
 			return errors.Errorf("expected single entry %q but got %q", root, p)
 		}
-		out = entry
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+		out = stat
 		if entry.IsDir() {
 			return filepath.SkipDir
 		}
@@ -165,16 +203,26 @@ func statFile(fs FS, root string) (os.DirEntry, error) {
 	return out, nil
 }
 
-func readDir(fs FS, root string) ([]os.DirEntry, error) {
-	var out []os.DirEntry
+// readDirPath returns the entries of a directory, using ReadDirFS if fs
+// implements it and walking otherwise.
+func readDirPath(ctx context.Context, fs FS, root string) ([]*types.Stat, error) {
+	if rfs, ok := fs.(ReadDirFS); ok {
+		stats, err := rfs.ReadDir(ctx, root)
+		if err != nil && errors.Is(err, syscall.ENOTDIR) {
+			return nil, errors.Wrapf(os.ErrNotExist, "readDir %s", root)
+		}
+		return stats, err
+	}
+
+	var out []*types.Stat
 
 	root = filepath.FromSlash(filepath.Clean(root))
 	if root == string(filepath.Separator) || root == "." {
 		root = "."
-		out = make([]gofs.DirEntry, 0)
+		out = make([]*types.Stat, 0)
 	}
 
-	err := fs.Walk(context.TODO(), root, func(p string, entry os.DirEntry, err error) error {
+	err := fs.Walk(ctx, root, func(p string, entry os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -182,13 +230,21 @@ func readDir(fs FS, root string) ([]os.DirEntry, error) {
 			if !entry.IsDir() {
 				return errors.WithStack(&os.PathError{Op: "walk", Path: root, Err: syscall.ENOTDIR})
 			}
-			out = make([]gofs.DirEntry, 0)
+			out = make([]*types.Stat, 0)
 			return nil
 		}
 		if out == nil {
 			return errors.Errorf("expected to read parent entry %q before child %q", root, p)
 		}
-		out = append(out, entry)
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+		out = append(out, stat)
 		if entry.IsDir() {
 			return filepath.SkipDir
 		}
@@ -1,12 +1,14 @@
 package fsutil
 
 import (
+	"bytes"
 	"context"
 	"io"
 	gofs "io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"syscall"
@@ -21,8 +23,126 @@ type FS interface {
 	Open(string) (io.ReadCloser, error)
 }
 
+// StatFS is an optional interface for FS implementations that can look up a
+// single path without walking. The path is relative to the root of the FS and
+// can not be the root itself. The returned stat has the same contents as when
+// the path is the first entry of a walk.
+type StatFS interface {
+	FS
+	Stat(ctx context.Context, p string) (*types.Stat, error)
+}
+
+// ReadDirFS is an optional interface for FS implementations that can list a
+// single directory without walking. The entries are returned in walk order
+// and with the same contents as when walking the directory.
+type ReadDirFS interface {
+	FS
+	ReadDir(ctx context.Context, p string) ([]*types.Stat, error)
+}
+
+// ReaderAtFS is an optional interface for FS implementations that can open a
+// file for random access reads.
+type ReaderAtFS interface {
+	FS
+	OpenReaderAt(p string) (ReadAtCloser, error)
+}
+
+// ReadAtCloser is a file opened for random access reads. Size returns the size
+// of the file when it was opened.
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// OpenReaderAt opens p in fs for random access reads. If fs does not implement
+// ReaderAtFS, the contents of the file are read into memory.
+func OpenReaderAt(fs FS, p string) (ReadAtCloser, error) {
+	if rfs, ok := fs.(ReaderAtFS); ok {
+		return rfs.OpenReaderAt(p)
+	}
+	rc, err := fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	dt, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &bytesReadAtCloser{bytes.NewReader(dt)}, nil
+}
+
+type bytesReadAtCloser struct {
+	*bytes.Reader
+}
+
+func (*bytesReadAtCloser) Close() error {
+	return nil
+}
+
+// fileReadAtCloser is a regular file opened on the host filesystem.
+type fileReadAtCloser struct {
+	*os.File
+	size int64
+}
+
+func newFileReadAtCloser(f *os.File) (ReadAtCloser, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: f.Name(), Err: syscall.EISDIR})
+	}
+	return &fileReadAtCloser{File: f, size: fi.Size()}, nil
+}
+
+func (f *fileReadAtCloser) Size() int64 {
+	return f.size
+}
+
+// FSOpt controls how an FS created with NewFSWithOpt or NewRootFSWithOpt
+// walks the filesystem.
+type FSOpt struct {
+	// Parallelism is the number of workers reading directories and stating
+	// entries concurrently while walking. The WalkDirFunc is still called
+	// from a single goroutine and in the same order as a sequential walk.
+	// Values lower than 2 walk sequentially.
+	Parallelism int
+
+	// WalkErrorPolicy controls how the walk handles entries that can not be
+	// read. Defaults to WalkErrorFail.
+	WalkErrorPolicy WalkErrorPolicy
+
+	// WalkErrorHandler, if set, is called for every entry that can not be
+	// read and decides the policy for it instead of WalkErrorPolicy.
+	WalkErrorHandler WalkErrorHandler
+
+	// OneFileSystem does not walk into directories that are on a different
+	// device than the root of the FS, like cp -x. Such mount points are
+	// walked as empty directories. It has no effect on platforms where the
+	// device of a file is not known.
+	OneFileSystem bool
+
+	// NotifySkippedMount, if set, is called with the path of every mount
+	// point that is not walked into because of OneFileSystem.
+	NotifySkippedMount func(p string)
+}
+
 // NewFS creates a new FS from a root directory on the host filesystem.
 func NewFS(root string) (FS, error) {
+	return NewFSWithOpt(root, nil)
+}
+
+// NewFSWithOpt creates a new FS from a root directory on the host filesystem
+// with the given options.
+func NewFSWithOpt(root string, opt *FSOpt) (FS, error) {
+	if opt == nil {
+		opt = &FSOpt{}
+	}
 	root, err := filepath.EvalSymlinks(root)
 	if err != nil {
 		return nil, errors.WithStack(&os.PathError{Op: "resolve", Path: root, Err: err})
@@ -37,19 +157,59 @@ func NewFS(root string) (FS, error) {
 
 	return &fs{
 		root: root,
+		opt:  *opt,
 	}, nil
 }
 
 // NewRootFS creates a new FS from a filesystem root.
 func NewRootFS(root Root) FS {
-	return &rootFS{root: root}
+	return NewRootFSWithOpt(root, nil)
+}
+
+// NewRootFSWithOpt creates a new FS from a filesystem root with the given
+// options.
+func NewRootFSWithOpt(root Root, opt *FSOpt) FS {
+	if opt == nil {
+		opt = &FSOpt{}
+	}
+	return &rootFS{root: root, opt: *opt}
 }
 
 type fs struct {
 	root string
+	opt  FSOpt
 }
 
 func (fs *fs) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	h := newWalkErrorHandler(fs.opt.WalkErrorPolicy, fs.opt.WalkErrorHandler)
+	return h.result(fs.walk(ctx, target, h.wrap(fn)))
+}
+
+func (fs *fs) walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	mounts, err := newMountFilter(fs.opt, func() (os.FileInfo, error) {
+		return os.Lstat(fs.root)
+	})
+	if err != nil {
+		return err
+	}
+
+	if fs.opt.Parallelism > 1 {
+		readDir := mounts.parallelReadDir(func(dir string) ([]gofs.DirEntry, error) {
+			return os.ReadDir(filepath.Join(fs.root, dir))
+		}, func(p string) (os.FileInfo, error) {
+			return os.Lstat(filepath.Join(fs.root, p))
+		})
+		return parallelWalk(ctx, fs.opt.Parallelism, readDir, func(p string) (os.FileInfo, *types.Stat, error) {
+			origpath := filepath.Join(fs.root, p)
+			fi, err := os.Lstat(origpath)
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			stat, err := mkstat(origpath, p, fi, nil)
+			return fi, stat, err
+		}, target, mounts.parallelWalkFunc(fn))
+	}
+
 	seenFiles := make(map[uint64]string)
 	return filepath.WalkDir(filepath.Join(fs.root, target), func(path string, dirEntry gofs.DirEntry, walkErr error) (retErr error) {
 		defer func() {
@@ -86,20 +246,104 @@ func (fs *fs) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) erro
 				return err
 			}
 		}
+		if walkErr == nil && mounts != nil && dirEntry != nil && dirEntry.IsDir() {
+			if fi, err := dirEntry.Info(); err == nil && mounts.skipDir(path, fi) {
+				return filepath.SkipDir
+			}
+		}
 		return nil
 	})
 }
 
+func (fs *fs) Stat(ctx context.Context, p string) (*types.Stat, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.EINVAL})
+	}
+	origpath := filepath.Join(fs.root, p)
+	fi, err := os.Lstat(origpath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return mkstat(origpath, p, fi, nil)
+}
+
+func (fs *fs) ReadDir(ctx context.Context, p string) ([]*types.Stat, error) {
+	p = cleanFSPath(p)
+	dir := filepath.Join(fs.root, p)
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	seenFiles := make(map[uint64]string)
+	out := make([]*types.Stat, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		fi, err := dirEntry.Info()
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		stat, err := mkstat(filepath.Join(dir, dirEntry.Name()), filepath.Join(p, dirEntry.Name()), fi, seenFiles)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, stat)
+	}
+	return out, nil
+}
+
 func (fs *fs) Open(p string) (io.ReadCloser, error) {
 	rc, err := os.Open(filepath.Join(fs.root, p))
 	return rc, errors.WithStack(err)
 }
 
+func (fs *fs) OpenReaderAt(p string) (ReadAtCloser, error) {
+	f, err := os.Open(filepath.Join(fs.root, p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newFileReadAtCloser(f)
+}
+
 type rootFS struct {
 	root Root
+	opt  FSOpt
 }
 
 func (fs *rootFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	h := newWalkErrorHandler(fs.opt.WalkErrorPolicy, fs.opt.WalkErrorHandler)
+	return h.result(fs.walk(ctx, target, h, h.wrap(fn)))
+}
+
+func (fs *rootFS) walk(ctx context.Context, target string, h *walkErrorHandler, fn gofs.WalkDirFunc) error {
+	mounts, err := newMountFilter(fs.opt, func() (os.FileInfo, error) {
+		return fs.root.Lstat(".")
+	})
+	if err != nil {
+		return err
+	}
+
+	if fs.opt.Parallelism > 1 {
+		readDir := mounts.parallelReadDir(func(dir string) ([]gofs.DirEntry, error) {
+			return gofs.ReadDir(fs.root.FS(), cleanRootFSTarget(dir))
+		}, fs.root.Lstat)
+		return parallelWalk(ctx, fs.opt.Parallelism, readDir, func(p string) (os.FileInfo, *types.Stat, error) {
+			fi, err := fs.root.Lstat(p)
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			stat, err := mkrootstat(fs.root, p, fi, nil)
+			return fi, stat, err
+		}, target, mounts.parallelWalkFunc(fn))
+	}
+
 	seenFiles := make(map[uint64]string)
 	target = cleanRootFSTarget(target)
 
@@ -115,15 +359,19 @@ func (fs *rootFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc)
 			return nil
 		}
 
-		var entry gofs.DirEntry
+		var (
+			entry gofs.DirEntry
+			fi    os.FileInfo
+		)
 		if dirEntry != nil {
-			fi, err := fs.root.Lstat(path)
+			var err error
+			fi, err = fs.root.Lstat(path)
 			if err != nil {
-				return errors.WithStack(err)
+				return h.skipEntry(path, dirEntry, errors.WithStack(err))
 			}
 			stat, err := mkrootstat(fs.root, path, fi, seenFiles)
 			if err != nil {
-				return err
+				return h.skipEntry(path, dirEntry, err)
 			}
 			entry = &DirEntryInfo{Stat: stat}
 		}
@@ -136,15 +384,69 @@ func (fs *rootFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc)
 				return err
 			}
 		}
+		if walkErr == nil && fi != nil && mounts.skipDir(path, fi) {
+			return filepath.SkipDir
+		}
 		return nil
 	})
 }
 
+func (fs *rootFS) Stat(ctx context.Context, p string) (*types.Stat, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.EINVAL})
+	}
+	fi, err := fs.root.Lstat(p)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return mkrootstat(fs.root, p, fi, nil)
+}
+
+func (fs *rootFS) ReadDir(ctx context.Context, p string) ([]*types.Stat, error) {
+	p = cleanFSPath(p)
+	dirEntries, err := gofs.ReadDir(fs.root.FS(), cleanRootFSTarget(p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	seenFiles := make(map[uint64]string)
+	out := make([]*types.Stat, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		rel := filepath.Join(p, dirEntry.Name())
+		fi, err := fs.root.Lstat(rel)
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		stat, err := mkrootstat(fs.root, rel, fi, seenFiles)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, stat)
+	}
+	return out, nil
+}
+
 func (fs *rootFS) Open(p string) (io.ReadCloser, error) {
 	rc, err := fs.root.OpenFile(cleanRootPath(p), os.O_RDONLY, 0)
 	return rc, errors.WithStack(err)
 }
 
+func (fs *rootFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	f, err := fs.root.OpenFile(cleanRootPath(p), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newFileReadAtCloser(f)
+}
+
 func cleanRootFSTarget(target string) string {
 	target = cleanRootPath(target)
 	for strings.HasPrefix(target, string(filepath.Separator)) {
@@ -156,11 +458,94 @@ func cleanRootFSTarget(target string) string {
 	return filepath.ToSlash(target)
 }
 
+// walkSorted calls fn for target and every path under it in paths, which need
+// to be native paths sorted with ComparePath. stat is called for every path
+// right before it is passed to fn, so it sees paths in walk order and does not
+// see paths that were skipped.
+func walkSorted(ctx context.Context, paths []string, target string, stat func(string) *types.Stat, fn gofs.WalkDirFunc) error {
+	target = filepath.FromSlash(cleanRootFSTarget(target))
+	if target == "." {
+		target = ""
+	}
+	if target != "" {
+		i, ok := slices.BinarySearchFunc(paths, target, ComparePath)
+		if !ok {
+			err := fn(target, nil, errors.WithStack(&os.PathError{Op: "lstat", Path: target, Err: syscall.ENOENT}))
+			if err == nil || err == filepath.SkipDir || err == filepath.SkipAll || isNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		paths = paths[i:]
+	}
+
+	var skip string
+	for _, p := range paths {
+		if target != "" && p != target && !strings.HasPrefix(p, target+string(filepath.Separator)) {
+			break
+		}
+		if skip != "" && strings.HasPrefix(p, skip) {
+			continue
+		}
+		skip = ""
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		st := stat(p)
+		if err := fn(p, &DirEntryInfo{Stat: st}, nil); err != nil {
+			if err == filepath.SkipDir {
+				if p == target {
+					return nil
+				}
+				if st.IsDir() {
+					skip = p + string(filepath.Separator)
+				} else if dir := filepath.Dir(p); dir == "." {
+					return nil
+				} else {
+					skip = dir + string(filepath.Separator)
+				}
+				continue
+			}
+			if err == filepath.SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanFSPath returns p as a clean native path relative to the root of an FS.
+// The root itself is returned as an empty string.
+func cleanFSPath(p string) string {
+	p = filepath.Clean(string(filepath.Separator) + filepath.FromSlash(p))
+	return strings.TrimPrefix(p, string(filepath.Separator))
+}
+
 type Dir struct {
 	Stat *types.Stat
 	FS   FS
 }
 
+// rebase updates a stat from the FS of the directory to be relative to the
+// root of the SubDirFS.
+func (d Dir) rebase(stat *types.Stat) {
+	stat.Path = path.Join(d.Stat.Path, stat.Path)
+	if stat.Linkname != "" {
+		if os.FileMode(stat.Mode)&os.ModeSymlink != 0 {
+			if strings.HasPrefix(stat.Linkname, "/") {
+				stat.Linkname = path.Join("/"+d.Stat.Path, stat.Linkname)
+			}
+		} else {
+			stat.Linkname = path.Join(d.Stat.Path, stat.Linkname)
+		}
+	}
+}
+
 func SubDirFS(dirs []Dir) (FS, error) {
 	sort.Slice(dirs, func(i, j int) bool {
 		return dirs[i].Stat.Path < dirs[j].Stat.Path
@@ -175,7 +560,13 @@ func SubDirFS(dirs []Dir) (FS, error) {
 		}
 		m[d.Stat.Path] = d
 	}
-	return &subDirFS{m: m, dirs: dirs}, nil
+	fs := &subDirFS{m: m, dirs: dirs}
+	for _, d := range dirs {
+		if _, ok := d.FS.(ReaderAtFS); !ok {
+			return fs, nil
+		}
+	}
+	return &subDirReaderAtFS{fs}, nil
 }
 
 type subDirFS struct {
@@ -197,6 +588,9 @@ func (fs *subDirFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc
 		}
 		dStat := d.Stat.Clone()
 		if err := fn(d.Stat.Path, &DirEntryInfo{Stat: dStat}, nil); err != nil {
+			if err == filepath.SkipDir {
+				continue
+			}
 			return err
 		}
 		if err := d.FS.Walk(ctx, rest, func(p string, entry gofs.DirEntry, err error) error {
@@ -212,16 +606,7 @@ func (fs *subDirFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc
 			if !ok {
 				return errors.WithStack(&os.PathError{Path: d.Stat.Path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
 			}
-			stat.Path = path.Join(d.Stat.Path, stat.Path)
-			if stat.Linkname != "" {
-				if fi.Mode()&os.ModeSymlink != 0 {
-					if strings.HasPrefix(stat.Linkname, "/") {
-						stat.Linkname = path.Join("/"+d.Stat.Path, stat.Linkname)
-					}
-				} else {
-					stat.Linkname = path.Join(d.Stat.Path, stat.Linkname)
-				}
-			}
+			d.rebase(stat)
 			return fn(filepath.Join(d.Stat.Path, p), &DirEntryInfo{Stat: stat}, nil)
 		}); err != nil {
 			return err
@@ -230,6 +615,51 @@ func (fs *subDirFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc
 	return nil
 }
 
+func (fs *subDirFS) Stat(ctx context.Context, p string) (*types.Stat, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.EINVAL})
+	}
+	first, rest, _ := strings.Cut(p, string(filepath.Separator))
+	d, ok := fs.m[first]
+	if !ok {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: p, Err: syscall.ENOENT})
+	}
+	if rest == "" {
+		return d.Stat.Clone(), nil
+	}
+	stat, err := statPath(ctx, d.FS, rest)
+	if err != nil {
+		return nil, err
+	}
+	d.rebase(stat)
+	return stat, nil
+}
+
+func (fs *subDirFS) ReadDir(ctx context.Context, p string) ([]*types.Stat, error) {
+	p = cleanFSPath(p)
+	if p == "" {
+		out := make([]*types.Stat, 0, len(fs.dirs))
+		for _, d := range fs.dirs {
+			out = append(out, d.Stat.Clone())
+		}
+		return out, nil
+	}
+	first, rest, _ := strings.Cut(p, string(filepath.Separator))
+	d, ok := fs.m[first]
+	if !ok {
+		return nil, errors.WithStack(&os.PathError{Op: "readdir", Path: p, Err: syscall.ENOENT})
+	}
+	stats, err := readDirPath(ctx, d.FS, rest)
+	if err != nil {
+		return nil, err
+	}
+	for _, stat := range stats {
+		d.rebase(stat)
+	}
+	return stats, nil
+}
+
 func (fs *subDirFS) Open(p string) (io.ReadCloser, error) {
 	parts := strings.SplitN(filepath.Clean(p), string(filepath.Separator), 2)
 	if len(parts) == 0 {
@@ -242,6 +672,24 @@ func (fs *subDirFS) Open(p string) (io.ReadCloser, error) {
 	return d.FS.Open(parts[1])
 }
 
+// subDirReaderAtFS is a subDirFS where the FS of every directory implements
+// ReaderAtFS.
+type subDirReaderAtFS struct {
+	*subDirFS
+}
+
+func (fs *subDirReaderAtFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	parts := strings.SplitN(filepath.Clean(p), string(filepath.Separator), 2)
+	d, ok := fs.m[parts[0]]
+	if !ok {
+		return nil, errors.WithStack(&os.PathError{Path: parts[0], Err: syscall.ENOENT, Op: "open"})
+	}
+	if len(parts) < 2 {
+		return nil, errors.WithStack(&os.PathError{Path: parts[0], Err: syscall.EISDIR, Op: "open"})
+	}
+	return d.FS.(ReaderAtFS).OpenReaderAt(parts[1])
+}
+
 type emptyReader struct{}
 
 func (*emptyReader) Read([]byte) (int, error) {
@@ -301,7 +749,7 @@ func (s *DirEntryInfo) IsDir() bool {
 
 func (s *DirEntryInfo) Type() gofs.FileMode {
 	if s.Stat != nil {
-		return gofs.FileMode(s.Mode)
+		return gofs.FileMode(s.Mode).Type()
 	}
 	return s.entry.Type()
 }
@@ -2,12 +2,17 @@ package fsutil
 
 import (
 	"context"
+	"io"
 	gofs "io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/containerd/continuity/fs/fstest"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tonistiigi/fsutil/types"
 )
@@ -103,4 +108,317 @@ func TestWalkDir(t *testing.T) {
 	require.Equal(t, "1", files[0].Name())
 	require.Equal(t, "dir", files[1].Name())
 	require.Equal(t, "foo", files[2].Name())
+
+	// skipping a directory continues with the next one
+	paths = paths[:0]
+	err = f.Walk(context.TODO(), "", func(path string, entry gofs.DirEntry, err error) error {
+		require.NoError(t, err)
+		paths = append(paths, path)
+		if path == "1" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", filepath.FromSlash("2/dir"), filepath.FromSlash("2/dir/bar")}, paths)
+}
+
+// walkOnlyFS hides the optional interfaces of an FS.
+type walkOnlyFS struct {
+	fs FS
+}
+
+func (fs *walkOnlyFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	return fs.fs.Walk(ctx, target, fn)
+}
+
+func (fs *walkOnlyFS) Open(p string) (io.ReadCloser, error) {
+	return fs.fs.Open(p)
+}
+
+func TestStatReadDirFS(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b dir",
+		"ADD a/b/c file data1",
+		"ADD a/b/d symlink ../../e",
+		"ADD a/f file data2",
+		"ADD e file data3",
+		"ADD g dir",
+		"ADD g/h file data4",
+		"ADD g/i dir",
+		"ADD g/i/j file data5",
+		"ADD g/k file >a/f",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+
+	osroot, err := os.OpenRoot(d)
+	require.NoError(t, err)
+	defer osroot.Close()
+	root := NewRoot(osroot)
+	defer root.Close()
+
+	var allPaths []string
+	err = base.Walk(context.TODO(), "", func(p string, entry gofs.DirEntry, err error) error {
+		require.NoError(t, err)
+		allPaths = append(allPaths, p)
+		return nil
+	})
+	require.NoError(t, err)
+	allPaths = append(allPaths, "missing", filepath.FromSlash("e/missing"))
+
+	subdir, err := SubDirFS([]Dir{
+		{Stat: &types.Stat{Path: "x", Mode: uint32(os.ModeDir | 0755)}, FS: base},
+		{Stat: &types.Stat{Path: "y", Mode: uint32(os.ModeDir | 0755)}, FS: NewRootFS(root)},
+	})
+	require.NoError(t, err)
+
+	filtered := func(opt *FilterOpt) FS {
+		fs, err := NewFilterFS(base, opt)
+		require.NoError(t, err)
+		return fs
+	}
+
+	for _, tc := range []struct {
+		name  string
+		fs    FS
+		paths []string
+		// notExist are paths that a targeted walk can not filter correctly
+		notExist []string
+	}{
+		{name: "fs", fs: base},
+		{name: "rootfs", fs: NewRootFS(root)},
+		{name: "subdir", fs: subdir, paths: []string{"x", "y", "missing"}, notExist: []string{filepath.FromSlash("x/missing")}},
+		{name: "include", fs: filtered(&FilterOpt{IncludePatterns: []string{"a/b", "g/i/j"}})},
+		{name: "includeglob", fs: filtered(&FilterOpt{IncludePatterns: []string{"**/j", "a/f"}})},
+		{name: "exclude", fs: filtered(&FilterOpt{ExcludePatterns: []string{"a", "g/*", "!g/i/j"}})},
+		{name: "excludeprefix", fs: filtered(&FilterOpt{ExcludePatterns: []string{"g", "!g/i"}})},
+		{name: "map", fs: filtered(&FilterOpt{
+			ExcludePatterns: []string{"e"},
+			Map: func(p string, st *types.Stat) MapResult {
+				switch p {
+				case "a":
+					return MapResultExclude
+				case "g":
+					st.Uid = 1234
+				case filepath.FromSlash("g/i"):
+					return MapResultSkipDir
+				}
+				return MapResultKeep
+			},
+		}), notExist: []string{filepath.FromSlash("g/i/j")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Implements(t, (*StatFS)(nil), tc.fs)
+			require.Implements(t, (*ReadDirFS)(nil), tc.fs)
+			walkFS := &walkOnlyFS{fs: tc.fs}
+
+			paths := tc.paths
+			if paths == nil {
+				paths = allPaths
+			}
+			for _, p := range tc.notExist {
+				_, err := statPath(context.TODO(), tc.fs, p)
+				require.ErrorIs(t, err, os.ErrNotExist, p)
+			}
+			for _, p := range paths {
+				if slices.Contains(tc.notExist, p) {
+					continue
+				}
+				expected, expectedErr := statPath(context.TODO(), walkFS, p)
+				actual, err := statPath(context.TODO(), tc.fs, p)
+				if expectedErr != nil {
+					// walking a directory excluded by Map still returns its
+					// children, the walk fallback reports that as an error
+					require.ErrorIs(t, err, os.ErrNotExist, p)
+					continue
+				}
+				require.NoError(t, err, p)
+				require.Equal(t, expected, actual, p)
+
+				if !expected.IsDir() {
+					continue
+				}
+				expectedEntries, err := readDirPath(context.TODO(), walkFS, p)
+				require.NoError(t, err, p)
+				entries, err := readDirPath(context.TODO(), tc.fs, p)
+				require.NoError(t, err, p)
+				require.Equal(t, expectedEntries, entries, p)
+			}
+
+			// the walk fallback can not list the root of all implementations,
+			// compare against the top level entries of a full walk instead
+			expectedEntries := []*types.Stat{}
+			err := tc.fs.Walk(context.TODO(), "", func(p string, entry gofs.DirEntry, err error) error {
+				require.NoError(t, err)
+				fi, err := entry.Info()
+				require.NoError(t, err)
+				if !strings.Contains(p, string(filepath.Separator)) {
+					expectedEntries = append(expectedEntries, fi.Sys().(*types.Stat))
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			entries, err := readDirPath(context.TODO(), tc.fs, "")
+			require.NoError(t, err)
+			require.Equal(t, expectedEntries, entries)
+		})
+	}
+
+	stat, err := statPath(context.TODO(), subdir, filepath.FromSlash("y/g/k"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash("y/g/k"), stat.Path)
+	assert.Equal(t, "", stat.Linkname)
+	assert.Equal(t, int64(len("data2")), stat.Size)
+
+	entries, err := readDirPath(context.TODO(), subdir, filepath.FromSlash("x/g"))
+	require.NoError(t, err)
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, filepath.ToSlash(e.Path))
+	}
+	assert.Equal(t, []string{"x/g/h", "x/g/i", "x/g/k"}, paths)
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file 0123456789",
+		"ADD c file data",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+
+	osroot, err := os.OpenRoot(d)
+	require.NoError(t, err)
+	defer osroot.Close()
+	root := NewRoot(osroot)
+	defer root.Close()
+
+	filtered, err := NewFilterFS(base, &FilterOpt{ExcludePatterns: []string{"c"}})
+	require.NoError(t, err)
+
+	subdir, err := SubDirFS([]Dir{
+		{Stat: &types.Stat{Path: "x", Mode: uint32(os.ModeDir | 0755)}, FS: filtered},
+	})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		fs     FS
+		prefix string
+	}{
+		{name: "fs", fs: base},
+		{name: "rootfs", fs: NewRootFS(root)},
+		{name: "filter", fs: filtered},
+		{name: "subdir", fs: subdir, prefix: "x"},
+		{name: "fallback", fs: &walkOnlyFS{fs: base}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, ok := tc.fs.(*walkOnlyFS); !ok {
+				require.Implements(t, (*ReaderAtFS)(nil), tc.fs)
+			}
+
+			ra, err := OpenReaderAt(tc.fs, filepath.Join(tc.prefix, "a", "b"))
+			require.NoError(t, err)
+			assert.Equal(t, int64(10), ra.Size())
+
+			buf := make([]byte, 4)
+			n, err := ra.ReadAt(buf, 3)
+			require.NoError(t, err)
+			assert.Equal(t, "3456", string(buf[:n]))
+
+			n, err = ra.ReadAt(buf, 8)
+			require.ErrorIs(t, err, io.EOF)
+			assert.Equal(t, "89", string(buf[:n]))
+			require.NoError(t, ra.Close())
+
+			_, err = OpenReaderAt(tc.fs, filepath.Join(tc.prefix, "missing"))
+			require.ErrorIs(t, err, os.ErrNotExist)
+
+			if tc.name != "fallback" {
+				_, err = OpenReaderAt(tc.fs, filepath.Join(tc.prefix, "a"))
+				require.ErrorIs(t, err, syscall.EISDIR)
+			}
+		})
+	}
+
+	_, err = OpenReaderAt(filtered, "c")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOpenReaderAtWrappers(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file 0123456789",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		wrap   func(FS) (FS, error)
+		prefix string
+	}{
+		{name: "filter", wrap: func(fs FS) (FS, error) {
+			return NewFilterFS(fs, &FilterOpt{ExcludePatterns: []string{"c"}})
+		}},
+		{name: "hardlinks", wrap: func(fs FS) (FS, error) {
+			return WithHardlinkReset(fs), nil
+		}},
+		{name: "subdir", prefix: "x", wrap: func(fs FS) (FS, error) {
+			return SubDirFS([]Dir{
+				{Stat: &types.Stat{Path: "x", Mode: uint32(os.ModeDir | 0755)}, FS: fs},
+				{Stat: &types.Stat{Path: "y", Mode: uint32(os.ModeDir | 0755)}, FS: base},
+			})
+		}},
+		{name: "normalized", wrap: func(fs FS) (FS, error) {
+			return NewNormalizedFS(fs, nil), nil
+		}},
+		{name: "mapped", prefix: "x", wrap: func(fs FS) (FS, error) {
+			return NewMappedFS(fs, []MapRule{{From: "a", To: "x/a"}})
+		}},
+		{name: "rewrite", wrap: func(fs FS) (FS, error) {
+			return NewRewriteFS(fs, func(p string, _ *types.Stat) string { return p }), nil
+		}},
+		{name: "overlay", wrap: func(fs FS) (FS, error) {
+			return NewOverlayFS(base, fs), nil
+		}},
+		{name: "dereference", wrap: func(fs FS) (FS, error) {
+			return NewDereferenceFS(fs, nil)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := tc.wrap(base)
+			require.NoError(t, err)
+			require.Implements(t, (*ReaderAtFS)(nil), fs)
+
+			// the wrappers only implement ReaderAtFS if the inner FS does, so
+			// that callers fall back to streaming reads
+			streamFS, err := tc.wrap(&walkOnlyFS{fs: base})
+			require.NoError(t, err)
+			_, ok := streamFS.(ReaderAtFS)
+			require.False(t, ok)
+
+			for _, fs := range []FS{fs, streamFS} {
+				ra, err := OpenReaderAt(fs, filepath.Join(tc.prefix, "a", "b"))
+				require.NoError(t, err)
+				buf := make([]byte, 4)
+				n, err := ra.ReadAt(buf, 3)
+				require.NoError(t, err)
+				assert.Equal(t, "3456", string(buf[:n]))
+				require.NoError(t, ra.Close())
+			}
+		})
+	}
 }
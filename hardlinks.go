@@ -53,6 +53,9 @@ func (v *Hardlinks) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err
 // WithHardlinkReset returns a FS that fixes hardlinks for FS that has been filtered
 // so that original hardlink sources might be missing
 func WithHardlinkReset(fs FS) FS {
+	if _, ok := fs.(ReaderAtFS); ok {
+		return &hardlinkReaderAtFilter{&hardlinkFilter{fs: fs}}
+	}
 	return &hardlinkFilter{fs: fs}
 }
 
@@ -106,6 +109,16 @@ func (r *hardlinkFilter) Open(p string) (io.ReadCloser, error) {
 	return r.fs.Open(p)
 }
 
+// hardlinkReaderAtFilter is a hardlinkFilter over an FS that implements
+// ReaderAtFS.
+type hardlinkReaderAtFilter struct {
+	*hardlinkFilter
+}
+
+func (r *hardlinkReaderAtFilter) OpenReaderAt(p string) (ReadAtCloser, error) {
+	return r.fs.(ReaderAtFS).OpenReaderAt(p)
+}
+
 type dirEntryWithStat struct {
 	gofs.DirEntry
 	stat *types.Stat
@@ -0,0 +1,187 @@
+// Package hashers provides ready-made fsutil.ContentHasher implementations
+// that produce the same digests on the sender and the receiver side of a
+// transfer.
+package hashers
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// SHA256 hashes only the contents of a file. Symlinks hash their target and
+// all other file types hash to the digest of empty content.
+func SHA256(stat *types.Stat) (hash.Hash, error) {
+	h := sha256.New()
+	if os.FileMode(stat.Mode)&os.ModeSymlink != 0 {
+		h.Write([]byte(stat.Linkname))
+	}
+	return h, nil
+}
+
+// Tar hashes the tarsum v1 header of a file followed by its contents. The
+// digests are compatible with the per-file digests used by BuildKit's
+// contenthash package: the name and modification time are not part of the
+// header, and only security.capability and non-system xattrs are included.
+func Tar(stat *types.Stat) (hash.Hash, error) {
+	stat = stat.Clone()
+	// Clear the socket bit since archive/tar.FileInfoHeader does not handle it
+	stat.Mode &^= uint32(os.ModeSocket)
+
+	hdr, err := tar.FileInfoHeader(&fsutil.StatInfo{Stat: stat}, stat.Linkname)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	hdr.Name = ""
+	hdr.Devmajor = stat.Devmajor
+	hdr.Devminor = stat.Devminor
+	if len(stat.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(stat.Xattrs))
+		for k, v := range stat.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+		}
+	}
+
+	th := &tarsumHash{Hash: sha256.New(), hdr: hdr}
+	th.Reset()
+	return th, nil
+}
+
+type tarsumHash struct {
+	hash.Hash
+	hdr *tar.Header
+}
+
+// Reset resets the hash to the state before any content was written.
+func (th *tarsumHash) Reset() {
+	th.Hash.Reset()
+	for _, elem := range tarsumV1Headers(th.hdr) {
+		th.Hash.Write([]byte(elem[0] + elem[1]))
+	}
+}
+
+func tarsumV1Headers(h *tar.Header) [][2]string {
+	var xattrKeys []string
+	for k := range h.PAXRecords {
+		if k, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if k == "security.capability" || !strings.HasPrefix(k, "security.") && !strings.HasPrefix(k, "system.") {
+				xattrKeys = append(xattrKeys, k)
+			}
+		}
+	}
+	sort.Strings(xattrKeys)
+
+	// tarsum v0 headers without mtime
+	headers := [][2]string{
+		{"name", h.Name},
+		{"mode", strconv.FormatInt(h.Mode, 10)},
+		{"uid", strconv.Itoa(h.Uid)},
+		{"gid", strconv.Itoa(h.Gid)},
+		{"size", strconv.FormatInt(h.Size, 10)},
+		{"typeflag", string([]byte{h.Typeflag})},
+		{"linkname", h.Linkname},
+		{"uname", h.Uname},
+		{"gname", h.Gname},
+		{"devmajor", strconv.FormatInt(h.Devmajor, 10)},
+		{"devminor", strconv.FormatInt(h.Devminor, 10)},
+	}
+	for _, k := range xattrKeys {
+		headers = append(headers, [2]string{k, h.PAXRecords["SCHILY.xattr."+k]})
+	}
+	return headers
+}
+
+// Field selects a stat field included by a Metadata hasher.
+type Field uint
+
+const (
+	FieldMode Field = 1 << iota
+	FieldUID
+	FieldGID
+	FieldSize
+	FieldModTime
+	FieldLinkname
+	FieldDevice
+	FieldXattrs
+
+	// DefaultFields contains the fields that are preserved by a transfer
+	// regardless of the receiving filesystem.
+	DefaultFields = FieldMode | FieldUID | FieldGID | FieldLinkname | FieldDevice | FieldXattrs
+)
+
+// Metadata returns a ContentHasher that hashes the selected stat fields
+// followed by the contents of the file. Fields are written in a fixed order
+// as NUL-separated name and value pairs.
+func Metadata(fields Field) fsutil.ContentHasher {
+	return func(stat *types.Stat) (hash.Hash, error) {
+		h := sha256.New()
+		write := func(k, v string) {
+			h.Write([]byte(k + "\x00" + v + "\x00"))
+		}
+		if fields&FieldMode != 0 {
+			write("mode", strconv.FormatUint(uint64(stat.Mode), 10))
+		}
+		if fields&FieldUID != 0 {
+			write("uid", strconv.FormatUint(uint64(stat.Uid), 10))
+		}
+		if fields&FieldGID != 0 {
+			write("gid", strconv.FormatUint(uint64(stat.Gid), 10))
+		}
+		if fields&FieldSize != 0 {
+			write("size", strconv.FormatInt(stat.Size, 10))
+		}
+		if fields&FieldModTime != 0 {
+			write("mtime", strconv.FormatInt(stat.ModTime, 10))
+		}
+		if fields&FieldLinkname != 0 {
+			write("linkname", stat.Linkname)
+		}
+		if fields&FieldDevice != 0 {
+			write("devmajor", strconv.FormatInt(stat.Devmajor, 10))
+			write("devminor", strconv.FormatInt(stat.Devminor, 10))
+		}
+		if fields&FieldXattrs != 0 {
+			keys := make([]string, 0, len(stat.Xattrs))
+			for k := range stat.Xattrs {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				write("xattr."+k, string(stat.Xattrs[k]))
+			}
+		}
+		return h, nil
+	}
+}
+
+// Digest computes the digest of a file in fs with the given hasher. The result
+// matches the digest reported through ReceiveOpt.NotifyHashed when the same
+// file is received with the same hasher: only the contents of regular files
+// that are not hardlinks are written to the hash.
+func Digest(fs fsutil.FS, stat *types.Stat, ch fsutil.ContentHasher) (digest.Digest, error) {
+	h, err := ch(stat)
+	if err != nil {
+		return "", err
+	}
+	if os.FileMode(stat.Mode).IsRegular() && stat.Linkname == "" {
+		rc, err := fs.Open(stat.Path)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		if _, err := io.Copy(h, rc); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
@@ -0,0 +1,168 @@
+package hashers
+
+import (
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+var (
+	testFile = &types.Stat{
+		Path:    "foo",
+		Mode:    0644,
+		Uid:     1000,
+		Gid:     1000,
+		Size:    5,
+		ModTime: 1700000000000000000,
+		Xattrs: map[string][]byte{
+			"user.foo":         []byte("bar"),
+			"security.selinux": []byte("label"),
+		},
+	}
+	testDir = &types.Stat{
+		Path:    "dir",
+		Mode:    uint32(os.ModeDir | 0755),
+		ModTime: 1700000000000000000,
+	}
+	testSymlink = &types.Stat{
+		Path:     "link",
+		Mode:     uint32(os.ModeSymlink | 0777),
+		Linkname: "../foo",
+	}
+)
+
+func TestHashers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		hasher   fsutil.ContentHasher
+		expected [3]digest.Digest
+	}{
+		{
+			name:   "SHA256",
+			hasher: SHA256,
+			expected: [3]digest.Digest{
+				"sha256:5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+				"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				"sha256:0b21ed83a0f07b5665458960268c60455786d15bb84f8138abca0490238f2819",
+			},
+		},
+		{
+			name:   "Tar",
+			hasher: Tar,
+			expected: [3]digest.Digest{
+				"sha256:65ce62bceb6e37d88df10cc56c26dff3e9636bc45f816581c65894832ebef5fc",
+				"sha256:1a2805521573cb10d73bcd51d16bfa84c8f461d68599740e35484b90b2ab1bab",
+				"sha256:1b5cdffaad24a3144242becd0e5b0db5137ee7a17b77a703f16ff97a030e3ffa",
+			},
+		},
+		{
+			name:   "MetadataDefault",
+			hasher: Metadata(DefaultFields),
+			expected: [3]digest.Digest{
+				"sha256:e8af0e5e4c016f337a9ef1144c8a7f2bd5113e7dcb6d75ae574d2bf7ea3f7ab0",
+				"sha256:4886ee83dc0d143bb0e4228db2126a110e30c523c6a60697a57ddfa0e2066977",
+				"sha256:6b5975d06bc6782a12979b469df50a75ce038670ad11eed7189d59ac43170002",
+			},
+		},
+		{
+			name:   "MetadataModTime",
+			hasher: Metadata(FieldMode | FieldModTime),
+			expected: [3]digest.Digest{
+				"sha256:3802b395808c8a5b546331b51c88d93adc15bd00453e02a0f75f8a87b33f810f",
+				"sha256:90ac98f6556c9b6be5db446826d84519b79655274f00b0eb3e68eb824f361476",
+				"sha256:47ce75e05f5e00fc730f4e21fcfdfa7d3ba853200cf4c31bb410ba6d137e77d8",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i, st := range []*types.Stat{testFile, testDir, testSymlink} {
+				h, err := tc.hasher(st)
+				require.NoError(t, err)
+				if st.Mode&uint32(os.ModeType) == 0 {
+					_, err := io.WriteString(h, "data1")
+					require.NoError(t, err)
+				}
+				require.Equal(t, tc.expected[i], digest.NewDigest(digest.SHA256, h), st.Path)
+			}
+		})
+	}
+}
+
+func TestDigestMatchesReceiver(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "foo"), []byte("data1"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir/bar"), []byte("data2"), 0600))
+	require.NoError(t, os.Link(filepath.Join(src, "foo"), filepath.Join(src, "dir/baz")))
+	require.NoError(t, os.Symlink("../foo", filepath.Join(src, "dir/link")))
+
+	fs, err := fsutil.NewFS(src)
+	require.NoError(t, err)
+
+	for _, ch := range []fsutil.ContentHasher{SHA256, Tar, Metadata(DefaultFields)} {
+		sent := map[string]digest.Digest{}
+		err := fs.Walk(context.TODO(), "/", func(p string, entry gofs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			dgst, err := Digest(fs, fi.Sys().(*types.Stat), ch)
+			if err != nil {
+				return err
+			}
+			sent[p] = dgst
+			return nil
+		})
+		require.NoError(t, err)
+
+		received := map[string]digest.Digest{}
+		dw, err := fsutil.NewDiskWriter(context.TODO(), t.TempDir(), fsutil.DiskWriterOpt{
+			AsyncDataCb: func(_ context.Context, p string, wc io.WriteCloser) error {
+				rc, err := fs.Open(p)
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				if _, err := io.Copy(wc, rc); err != nil {
+					return err
+				}
+				return wc.Close()
+			},
+			NotifyCb: func(_ fsutil.ChangeKind, p string, fi os.FileInfo, _ error) error {
+				received[p] = fi.(interface{ Digest() digest.Digest }).Digest()
+				return nil
+			},
+			ContentHasher: ch,
+		})
+		require.NoError(t, err)
+		err = fs.Walk(context.TODO(), "/", func(p string, entry gofs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			return dw.HandleChange(fsutil.ChangeKindAdd, p, fi, nil)
+		})
+		require.NoError(t, err)
+		require.NoError(t, dw.Wait(context.TODO()))
+
+		require.Len(t, sent, 5)
+		require.Equal(t, sent, received)
+		require.NotEqual(t, sent["foo"], sent[filepath.FromSlash("dir/bar")])
+		require.True(t, strings.HasPrefix(string(sent["foo"]), "sha256:"))
+	}
+}
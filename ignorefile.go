@@ -0,0 +1,232 @@
+package fsutil
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignorePattern is a single line of an ignore file in gitignore syntax.
+type ignorePattern struct {
+	negate  bool
+	dirOnly bool
+	// segments are the slash separated parts of the pattern, relative to the
+	// directory of the ignore file
+	segments []string
+
+	// file, line and text locate the pattern for Explain
+	file string
+	line int
+	text string
+}
+
+// parseIgnoreFile parses the patterns of the ignore file at path file in
+// gitignore syntax.
+func parseIgnoreFile(r io.Reader, file string) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		if p, ok := parseIgnorePattern(s.Text()); ok {
+			p.file, p.line, p.text = file, line, s.Text()
+			patterns = append(patterns, p)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return patterns, nil
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	var p ignorePattern
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+	// a pattern without a slash matches at any depth, otherwise it is
+	// relative to the directory of the ignore file
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	line = strings.TrimPrefix(line, "/")
+	p.segments = strings.Split(line, "/")
+	for i, seg := range p.segments {
+		p.segments[i] = translateIgnoreClass(seg)
+	}
+	return p, true
+}
+
+// translateIgnoreClass rewrites the negated character classes of gitignore,
+// [!...], to the [^...] syntax of path.Match.
+func translateIgnoreClass(seg string) string {
+	if !strings.Contains(seg, "[!") {
+		return seg
+	}
+	var b strings.Builder
+	for i := 0; i < len(seg); i++ {
+		c := seg[i]
+		b.WriteByte(c)
+		switch c {
+		case '\\':
+			if i+1 < len(seg) {
+				i++
+				b.WriteByte(seg[i])
+			}
+		case '[':
+			if i+1 < len(seg) && seg[i+1] == '!' {
+				b.WriteByte('^')
+				i++
+			}
+		}
+	}
+	return b.String()
+}
+
+// match reports whether the slash separated path rel, relative to the
+// directory of the ignore file, matches the pattern.
+func (p *ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchIgnoreSegments(p.segments, strings.Split(rel, "/"))
+}
+
+func matchIgnoreSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// a trailing ** matches everything inside, but not the
+				// directory itself
+				return len(parts) > 0
+			}
+			for i := range parts {
+				if matchIgnoreSegments(pattern, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], parts[0]); err != nil || !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// ignoreFiles returns the patterns of the ignore files in the directory dir
+// of fs, which is an empty string for the root. The patterns are cached until
+// the next Walk.
+func (fs *filterFS) ignoreFiles(dir string) ([]ignorePattern, error) {
+	fs.ignoreMu.Lock()
+	patterns, ok := fs.ignoreCache[dir]
+	fs.ignoreMu.Unlock()
+	if ok {
+		return patterns, nil
+	}
+
+	for _, name := range fs.ignoreFileNames {
+		p := filepath.Join(dir, name)
+		rc, err := fs.fs.Open(p)
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		pp, err := parseIgnoreFile(rc, p)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", p)
+		}
+		patterns = append(patterns, pp...)
+	}
+
+	fs.ignoreMu.Lock()
+	fs.ignoreCache[dir] = patterns
+	fs.ignoreMu.Unlock()
+	return patterns, nil
+}
+
+// ignored reports whether the ignore files of the parent directories of p
+// ignore it. The parent directories themselves are not checked.
+func (fs *filterFS) ignored(p string, isDir bool) (bool, error) {
+	pattern, err := fs.ignoredBy(p, isDir)
+	return pattern != nil, err
+}
+
+// ignoredBy returns the pattern that ignores p, or nil if p is not ignored.
+func (fs *filterFS) ignoredBy(p string, isDir bool) (*ignorePattern, error) {
+	if len(fs.ignoreFileNames) == 0 {
+		return nil, nil
+	}
+	p = filepath.ToSlash(p)
+	// the deepest ignore file and the last matching line take precedence
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+		patterns, err := fs.ignoreFiles(filepath.FromSlash(dir))
+		if err != nil {
+			return nil, err
+		}
+		rel := p
+		if dir != "" {
+			rel = strings.TrimPrefix(p, dir+"/")
+		}
+		for i := len(patterns) - 1; i >= 0; i-- {
+			if patterns[i].match(rel, isDir) {
+				if patterns[i].negate {
+					return nil, nil
+				}
+				return &patterns[i], nil
+			}
+		}
+		if dir == "" {
+			return nil, nil
+		}
+	}
+}
+
+// ignoredOrParent reports whether p or any of its parent directories is
+// ignored. Like git, a path can not be re-included if its parent directory is
+// ignored.
+func (fs *filterFS) ignoredOrParent(p string, isDir bool) (bool, error) {
+	if len(fs.ignoreFileNames) == 0 {
+		return false, nil
+	}
+	parts := strings.Split(p, string(filepath.Separator))
+	for i := range parts {
+		dirPath := filepath.Join(parts[:i+1]...)
+		ignored, err := fs.ignored(dirPath, isDir || i < len(parts)-1)
+		if err != nil || ignored {
+			return ignored, err
+		}
+	}
+	return false, nil
+}
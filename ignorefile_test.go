@@ -0,0 +1,176 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnorePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{pattern: "foo", path: "foo", match: true},
+		{pattern: "foo", path: "a/b/foo", match: true},
+		{pattern: "foo", path: "foo/bar", match: false},
+		{pattern: "*.log", path: "a/x.log", match: true},
+		{pattern: "*.log", path: "a.log/x", match: false},
+		{pattern: "/foo", path: "foo", match: true},
+		{pattern: "/foo", path: "a/foo", match: false},
+		{pattern: "a/foo", path: "a/foo", match: true},
+		{pattern: "a/foo", path: "b/a/foo", match: false},
+		{pattern: "a/*/c", path: "a/b/c", match: true},
+		{pattern: "a/*/c", path: "a/b/b/c", match: false},
+		{pattern: "a/**/c", path: "a/c", match: true},
+		{pattern: "a/**/c", path: "a/b/b/c", match: true},
+		{pattern: "**/c", path: "a/b/c", match: true},
+		{pattern: "a/**", path: "a", isDir: true, match: false},
+		{pattern: "a/**", path: "a/b/c", match: true},
+		{pattern: "build/", path: "build", isDir: true, match: true},
+		{pattern: "build/", path: "build", match: false},
+		{pattern: "build/", path: "a/build", isDir: true, match: true},
+		{pattern: `\#foo`, path: "#foo", match: true},
+		{pattern: `\!foo`, path: "!foo", match: true},
+		{pattern: `foo\ `, path: "foo ", match: true},
+		{pattern: "foo   ", path: "foo", match: true},
+		{pattern: "f[a-c]o", path: "fbo", match: true},
+		{pattern: "f[!a-c]o", path: "fbo", match: false},
+		{pattern: "f[!a-c]o", path: "fdo", match: true},
+		{pattern: "f[!a-c]o", path: "f!o", match: true},
+		{pattern: "a/[!b]*/c", path: "a/d/c", match: true},
+		{pattern: "a/[!b]*/c", path: "a/bd/c", match: false},
+		{pattern: `f\[!a]o`, path: "f[!a]o", match: true},
+		{pattern: `f\[!a]o`, path: "fbo", match: false},
+		{pattern: "f?o", path: "f/o", match: false},
+	} {
+		p, ok := parseIgnorePattern(tc.pattern)
+		require.True(t, ok, tc.pattern)
+		assert.Equal(t, tc.match, p.match(tc.path, tc.isDir), "%q %q", tc.pattern, tc.path)
+	}
+
+	for _, line := range []string{"", "   ", "# comment", "!", "/"} {
+		_, ok := parseIgnorePattern(line)
+		assert.False(t, ok, line)
+	}
+	p, ok := parseIgnorePattern("!foo/")
+	require.True(t, ok)
+	assert.True(t, p.negate)
+	assert.True(t, p.dirOnly)
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/local file data1",
+		"ADD a/sub dir",
+		"ADD a/sub/local file data2",
+		"ADD a/sub/x file data3",
+		"ADD a/sub/y file data4",
+		"ADD a/x.log file data5",
+		"ADD b dir",
+		"ADD b/build dir",
+		"ADD b/build/z file data6",
+		"ADD b/keep.log file data7",
+		"ADD b/x.log file data8",
+		"ADD build dir",
+		"ADD build/out file data9",
+		"ADD d dir",
+		"ADD d/e file data10",
+		"ADD f file data11",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	for p, dt := range map[string]string{
+		".gitignore":   "# root\n*.log\n!keep.log\nbuild/\n/d\n",
+		"a/.gitignore": "/local\n!*.log\nsub/x\n",
+		"d/.gitignore": "!*\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(d, p), []byte(dt), 0600))
+	}
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+	fs, err := NewFilterFS(base, &FilterOpt{
+		IgnoreFiles:     []string{".gitignore"},
+		ExcludePatterns: []string{"f"},
+	})
+	require.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`file .gitignore
+dir a
+file a/.gitignore
+dir a/sub
+file a/sub/local
+file a/sub/y
+file a/x.log
+dir b
+file b/keep.log
+`), b.String())
+
+	b.Reset()
+	err = fs.Walk(context.TODO(), "a/sub", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir a/sub
+file a/sub/local
+file a/sub/y
+`), b.String())
+
+	for _, target := range []string{"build", "build/out", "d/e", "b/x.log"} {
+		b.Reset()
+		err = fs.Walk(context.TODO(), filepath.FromSlash(target), bufWalkDir(b))
+		require.NoError(t, err)
+		assert.Empty(t, b.String(), target)
+
+		_, err = statPath(context.TODO(), fs, filepath.FromSlash(target))
+		require.ErrorIs(t, err, os.ErrNotExist, target)
+
+		if target != "build" {
+			_, err = fs.Open(filepath.FromSlash(target))
+			require.ErrorIs(t, err, os.ErrNotExist, target)
+		}
+	}
+
+	stats, err := readDirPath(context.TODO(), fs, "a")
+	require.NoError(t, err)
+	var names []string
+	for _, stat := range stats {
+		names = append(names, filepath.ToSlash(stat.Path))
+	}
+	assert.Equal(t, []string{"a/.gitignore", "a/sub", "a/x.log"}, names)
+
+	rc, err := fs.Open(filepath.FromSlash("a/x.log"))
+	require.NoError(t, err)
+	rc.Close()
+
+	// the ignore files are read again by the next walk
+	require.NoError(t, os.WriteFile(filepath.Join(d, "a/.gitignore"), []byte("/local\n"), 0600))
+	b.Reset()
+	err = fs.Walk(context.TODO(), filepath.FromSlash("a/sub"), bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir a/sub
+file a/sub/local
+file a/sub/x
+file a/sub/y
+`), b.String())
+	_, err = fs.Open(filepath.FromSlash("a/x.log"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// without the ignore files everything is walked
+	b.Reset()
+	err = base.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, 20, strings.Count(b.String(), "\n"))
+}
@@ -0,0 +1,500 @@
+package fsutil
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+const indexVersion = 1
+
+// indexRacyWindow is how long after an entry was changed its cached stat is
+// not trusted, as a later change could keep the same timestamps.
+var indexRacyWindow = time.Second
+
+// IndexedFS is an FS for a directory on the host filesystem that keeps the
+// stats and content digests of its entries in an index, which can be saved
+// and loaded by a later process.
+//
+// Every walk still calls lstat on each entry, but directories are only read
+// again when they have changed and the extended attributes and symlink
+// targets of unchanged entries are reused from the index. An entry is
+// unchanged if its device, inode, change time, modification time, size and
+// mode are the same as when it was indexed.
+type IndexedFS struct {
+	root      string
+	indexPath string
+
+	mu      sync.Mutex
+	entries map[string]*indexEntry
+}
+
+type indexEntry struct {
+	// stat is the stat of the entry without hardlink information. It is nil
+	// for the root.
+	stat *types.Stat
+
+	dev, ino uint64
+	ctime    int64
+	mtime    int64
+	size     int64
+	mode     uint32
+	recorded int64
+
+	// names are the sorted names of the entries of a directory when it was
+	// last read, they are current if listed is set
+	names   []string
+	listed  bool
+	digests map[string]digest.Digest
+}
+
+type indexHeader struct {
+	Version int
+	Root    string
+	Entries int
+}
+
+type indexRecord struct {
+	Path     string
+	Stat     []byte
+	Dev, Ino uint64
+	Ctime    int64
+	Mtime    int64
+	Size     int64
+	Mode     uint32
+	Recorded int64
+	Names    []string
+	Listed   bool
+	Digests  map[string]string
+}
+
+// NewIndexedFS creates a new IndexedFS from a root directory on the host
+// filesystem. If indexPath exists the index is loaded from it. An index that
+// can not be read, or was saved for a different root, is discarded.
+func NewIndexedFS(root, indexPath string) (*IndexedFS, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, errors.WithStack(&os.PathError{Op: "resolve", Path: root, Err: err})
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.WithStack(&os.PathError{Op: "stat", Path: root, Err: syscall.ENOTDIR})
+	}
+
+	fs := &IndexedFS{
+		root:      root,
+		indexPath: indexPath,
+	}
+	// the index is only a cache, start over if it can not be used
+	entries, err := loadIndex(root, indexPath)
+	if err != nil || entries == nil {
+		entries = map[string]*indexEntry{}
+	}
+	fs.entries = entries
+	return fs, nil
+}
+
+func loadIndex(root, indexPath string) (map[string]*indexEntry, error) {
+	f, err := os.Open(indexPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var hdr indexHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if hdr.Version != indexVersion || hdr.Root != root {
+		return nil, nil
+	}
+	entries := make(map[string]*indexEntry, hdr.Entries)
+	for range hdr.Entries {
+		var rec indexRecord
+		if err := dec.Decode(&rec); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		e := &indexEntry{
+			dev:      rec.Dev,
+			ino:      rec.Ino,
+			ctime:    rec.Ctime,
+			mtime:    rec.Mtime,
+			size:     rec.Size,
+			mode:     rec.Mode,
+			recorded: rec.Recorded,
+			names:    rec.Names,
+			listed:   rec.Listed,
+		}
+		if rec.Stat != nil {
+			e.stat = &types.Stat{}
+			if err := e.stat.UnmarshalVT(rec.Stat); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		if len(rec.Digests) > 0 {
+			e.digests = make(map[string]digest.Digest, len(rec.Digests))
+			for k, v := range rec.Digests {
+				e.digests[k] = digest.Digest(v)
+			}
+		}
+		entries[rec.Path] = e
+	}
+	return entries, nil
+}
+
+// Save writes the index to the path it was loaded from. The file is replaced
+// atomically.
+func (fs *IndexedFS) Save() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(fs.indexPath), ".fsutil-index-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(&indexHeader{Version: indexVersion, Root: fs.root, Entries: len(fs.entries)}); err != nil {
+		return errors.WithStack(err)
+	}
+	for p, e := range fs.entries {
+		rec := &indexRecord{
+			Path:     p,
+			Dev:      e.dev,
+			Ino:      e.ino,
+			Ctime:    e.ctime,
+			Mtime:    e.mtime,
+			Size:     e.size,
+			Mode:     e.mode,
+			Recorded: e.recorded,
+			Names:    e.names,
+			Listed:   e.listed,
+		}
+		if e.stat != nil {
+			dt, err := e.stat.MarshalVT()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			rec.Stat = dt
+		}
+		if len(e.digests) > 0 {
+			rec.Digests = make(map[string]string, len(e.digests))
+			for k, v := range e.digests {
+				rec.Digests[k] = v.String()
+			}
+		}
+		if err := enc.Encode(rec); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(f.Name(), fs.indexPath); err != nil {
+		return errors.WithStack(err)
+	}
+	f = nil
+	return nil
+}
+
+func (fs *IndexedFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	w := &indexWalker{
+		fs:        fs,
+		seenFiles: make(map[uint64]string),
+	}
+	w.fn = func(p string, entry gofs.DirEntry, err error) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := fn(p, entry, err); err != nil {
+			if isNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		return nil
+	}
+
+	var err error
+	if target = cleanFSPath(target); target == "" {
+		var fi os.FileInfo
+		if fi, err = os.Lstat(fs.root); err == nil {
+			err = w.walkDir("", nil, fs.entry("", fi, nil))
+		}
+	} else {
+		_, err = w.walk(target)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (fs *IndexedFS) Open(p string) (io.ReadCloser, error) {
+	rc, err := os.Open(filepath.Join(fs.root, p))
+	return rc, errors.WithStack(err)
+}
+
+func (fs *IndexedFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	f, err := os.Open(filepath.Join(fs.root, p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newFileReadAtCloser(f)
+}
+
+// Digest returns the digest of the file at p computed with ch, in the same way
+// as hashers.Digest does for an entry that is not a hardlink. Digests of
+// indexed entries are kept in the index under key and reused until the file
+// changes. Different hashers need to use different keys.
+func (fs *IndexedFS) Digest(p, key string, ch ContentHasher) (digest.Digest, error) {
+	p = cleanFSPath(p)
+	origpath := filepath.Join(fs.root, p)
+	fi, err := os.Lstat(origpath)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	fs.mu.Lock()
+	e, ok := fs.entries[p]
+	var stat *types.Stat
+	if ok && e.stat != nil && e.valid(fi) {
+		if dgst, ok := e.digests[key]; ok {
+			fs.mu.Unlock()
+			return dgst, nil
+		}
+		stat = e.stat.Clone()
+	}
+	fs.mu.Unlock()
+
+	if stat == nil {
+		if stat, err = mkstat(origpath, p, fi, nil); err != nil {
+			return "", err
+		}
+	}
+	h, err := ch(stat)
+	if err != nil {
+		return "", err
+	}
+	if os.FileMode(stat.Mode).IsRegular() {
+		f, err := os.Open(origpath)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	dgst := digest.NewDigest(digest.SHA256, h)
+
+	// only keep the digest if the file did not change while it was read
+	if fi2, err := os.Lstat(origpath); err == nil && e != nil {
+		fs.mu.Lock()
+		if fs.entries[p] == e && e.stat != nil && e.valid(fi) && e.valid(fi2) {
+			if e.digests == nil {
+				e.digests = map[string]digest.Digest{}
+			}
+			e.digests[key] = dgst
+		}
+		fs.mu.Unlock()
+	}
+	return dgst, nil
+}
+
+// entry returns the index entry of p for fi, replacing the cached entry if it
+// is no longer valid. stat is the stat of a non-root path without hardlink
+// information.
+func (fs *IndexedFS) entry(p string, fi os.FileInfo, stat *types.Stat) *indexEntry {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	old, ok := fs.entries[p]
+	if ok && old.valid(fi) && (p == "" || old.stat != nil) {
+		return old
+	}
+	e := &indexEntry{
+		stat:     stat,
+		mtime:    fi.ModTime().UnixNano(),
+		size:     fi.Size(),
+		mode:     uint32(fi.Mode()),
+		recorded: time.Now().UnixNano(),
+	}
+	e.dev, e.ino, e.ctime, _ = statChange(fi)
+	if ok {
+		if fi.IsDir() {
+			// the directory is read again, keep the names to remove the
+			// entries that are gone
+			e.names = old.names
+		} else {
+			fs.removeChildren(p, old.names)
+		}
+	}
+	fs.entries[p] = e
+	return e
+}
+
+// setNames sets the names of the directory p after it was read, removing the
+// cached entries that are no longer in it.
+func (fs *IndexedFS) setNames(p string, e *indexEntry, names []string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.entries[p] != e {
+		return
+	}
+	var removed []string
+	for _, name := range e.names {
+		if _, found := slices.BinarySearch(names, name); !found {
+			removed = append(removed, name)
+		}
+	}
+	fs.removeChildren(p, removed)
+	e.names = names
+	e.listed = true
+}
+
+// removeChildren removes the cached entries for names in the directory p and
+// everything under them.
+func (fs *IndexedFS) removeChildren(p string, names []string) {
+	for _, name := range names {
+		cp := filepath.Join(p, name)
+		if c, ok := fs.entries[cp]; ok {
+			fs.removeChildren(cp, c.names)
+			delete(fs.entries, cp)
+		}
+	}
+}
+
+// valid reports whether the cached entry is still valid for fi.
+func (e *indexEntry) valid(fi os.FileInfo) bool {
+	return e.validListing(fi) && e.size == fi.Size() && e.mode == uint32(fi.Mode())
+}
+
+// validListing reports whether the cached names of a directory are still
+// valid for fi. Adding, removing or renaming an entry changes the
+// modification and change time of its directory.
+func (e *indexEntry) validListing(fi os.FileInfo) bool {
+	dev, ino, ctime, ok := statChange(fi)
+	if !ok || e.recorded == 0 {
+		return false
+	}
+	if ctime >= e.recorded-indexRacyWindow.Nanoseconds() {
+		return false
+	}
+	return dev == e.dev && ino == e.ino && ctime == e.ctime && e.mtime == fi.ModTime().UnixNano()
+}
+
+type indexWalker struct {
+	fs        *IndexedFS
+	fn        gofs.WalkDirFunc
+	seenFiles map[uint64]string
+}
+
+// walk calls fn for p and, if it is a directory, for everything under it. It
+// also reports whether p is a directory.
+func (w *indexWalker) walk(p string) (bool, error) {
+	origpath := filepath.Join(w.fs.root, p)
+	fi, err := os.Lstat(origpath)
+	if err != nil {
+		return false, w.fn(p, nil, errors.WithStack(err))
+	}
+
+	w.fs.mu.Lock()
+	old, ok := w.fs.entries[p]
+	w.fs.mu.Unlock()
+
+	var stat *types.Stat
+	if ok && old.stat != nil && old.valid(fi) {
+		stat = old.stat
+	} else if stat, err = mkstat(origpath, p, fi, nil); err != nil {
+		return false, w.fn(p, nil, err)
+	}
+	e := w.fs.entry(p, fi, stat)
+
+	stat = e.stat.Clone()
+	if !fi.IsDir() {
+		if oldpath, ok := markHardlink(fi, filepath.ToSlash(p), w.seenFiles); ok {
+			stat.Linkname = oldpath
+		}
+	}
+	entry := &DirEntryInfo{Stat: stat}
+	if err := w.fn(p, entry, nil); err != nil || !fi.IsDir() {
+		return fi.IsDir(), err
+	}
+	if err := w.walkDir(p, entry, e); err != nil && err != filepath.SkipDir {
+		return true, err
+	}
+	return true, nil
+}
+
+// walkDir calls fn for everything under the directory p, which was already
+// passed to fn as entry and has the index entry e.
+func (w *indexWalker) walkDir(p string, entry gofs.DirEntry, e *indexEntry) error {
+	w.fs.mu.Lock()
+	names, listed := e.names, e.listed
+	w.fs.mu.Unlock()
+
+	if !listed {
+		dirEntries, err := os.ReadDir(filepath.Join(w.fs.root, p))
+		if err != nil {
+			err = errors.WithStack(err)
+			if p == "" {
+				return err
+			}
+			return w.fn(p, entry, err)
+		}
+		names = make([]string, 0, len(dirEntries))
+		for _, de := range dirEntries {
+			names = append(names, de.Name())
+		}
+		w.fs.setNames(p, e, names)
+	}
+
+	for _, name := range names {
+		isDir, err := w.walk(filepath.Join(p, name))
+		if err != nil {
+			if err == filepath.SkipDir {
+				if isDir {
+					continue
+				}
+				// skip the rest of the directory
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package fsutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	gofs "io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestIndexedFSWalk(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b dir",
+		"ADD a/b/c file data1",
+		"ADD a/d symlink ../e",
+		"ADD e dir",
+		"ADD e/f file >a/b/c",
+		"ADD g file data2",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+	fs, err := NewIndexedFS(d, filepath.Join(t.TempDir(), "index"))
+	require.NoError(t, err)
+
+	// the second walks use the index
+	for range 2 {
+		for _, target := range []string{"", "a", "/e", "g", "missing", filepath.FromSlash("a/d")} {
+			for _, skip := range []string{"", "a", filepath.FromSlash("a/b/c")} {
+				expected := recordWalk(t, base, target, skip)
+				actual := recordWalk(t, fs, target, skip)
+				require.Equal(t, expected, actual, "target %q skip %q", target, skip)
+			}
+		}
+	}
+}
+
+func TestIndexedFSUpdates(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("change times are not supported on Windows")
+	}
+	setIndexRacyWindow(t, 10*time.Millisecond)
+
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file data1",
+		"ADD a/c file data2",
+		"ADD d dir",
+		"ADD d/e file data3",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	time.Sleep(20 * time.Millisecond)
+
+	fs, err := NewIndexedFS(d, filepath.Join(t.TempDir(), "index"))
+	require.NoError(t, err)
+
+	stats := indexedWalkStats(t, fs)
+	require.Equal(t, []string{"a", "a/b", "a/c", "d", "d/e"}, slices.Sorted(maps.Keys(stats)))
+
+	// unchanged entries reuse the cached stat
+	fs.entries[filepath.FromSlash("a/b")].stat.Uid = 1234
+	stats = indexedWalkStats(t, fs)
+	assert.Equal(t, uint32(1234), stats["a/b"].Uid)
+
+	err = os.WriteFile(filepath.Join(d, "a/b"), []byte("data11"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(d, "a/f"), []byte("data4"), 0644)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(d, "d")))
+
+	stats = indexedWalkStats(t, fs)
+	require.Equal(t, []string{"a", "a/b", "a/c", "a/f"}, slices.Sorted(maps.Keys(stats)))
+	assert.NotEqual(t, uint32(1234), stats["a/b"].Uid)
+	assert.Equal(t, int64(6), stats["a/b"].Size)
+
+	_, ok := fs.entries[filepath.FromSlash("d/e")]
+	assert.False(t, ok)
+	_, ok = fs.entries["d"]
+	assert.False(t, ok)
+}
+
+func TestIndexedFSDigest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("change times are not supported on Windows")
+	}
+	setIndexRacyWindow(t, 10*time.Millisecond)
+
+	d, err := tmpDir(changeStream([]string{
+		"ADD a file data1",
+		"ADD b file data2",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	time.Sleep(20 * time.Millisecond)
+
+	indexPath := filepath.Join(t.TempDir(), "index")
+	fs, err := NewIndexedFS(d, indexPath)
+	require.NoError(t, err)
+	indexedWalkStats(t, fs)
+
+	var hashed int
+	ch := func(*types.Stat) (hash.Hash, error) {
+		hashed++
+		return sha256.New(), nil
+	}
+
+	dgst, err := fs.Digest("a", "sha256", ch)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString("data1"), dgst)
+	assert.Equal(t, 1, hashed)
+
+	dgst, err = fs.Digest("a", "sha256", ch)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString("data1"), dgst)
+	assert.Equal(t, 1, hashed)
+
+	require.NoError(t, fs.Save())
+
+	// the index is loaded by a new instance
+	fs, err = NewIndexedFS(d, indexPath)
+	require.NoError(t, err)
+	dgst, err = fs.Digest("a", "sha256", ch)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString("data1"), dgst)
+	assert.Equal(t, 1, hashed)
+
+	_, err = fs.Digest("a", "other", ch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, hashed)
+
+	err = os.WriteFile(filepath.Join(d, "a"), []byte("data11"), 0644)
+	require.NoError(t, err)
+	dgst, err = fs.Digest("a", "sha256", ch)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString("data11"), dgst)
+	assert.Equal(t, 3, hashed)
+
+	// an unreadable index is discarded
+	require.NoError(t, os.WriteFile(indexPath, []byte("invalid"), 0600))
+	fs, err = NewIndexedFS(d, indexPath)
+	require.NoError(t, err)
+	assert.Empty(t, fs.entries)
+	_, err = fs.Digest("missing", "sha256", ch)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func setIndexRacyWindow(t *testing.T, d time.Duration) {
+	old := indexRacyWindow
+	indexRacyWindow = d
+	t.Cleanup(func() {
+		indexRacyWindow = old
+	})
+}
+
+// indexedWalkStats walks fs and returns the stats by slash separated path.
+func indexedWalkStats(t *testing.T, fs FS) map[string]*types.Stat {
+	stats := map[string]*types.Stat{}
+	err := fs.Walk(context.TODO(), "", func(p string, entry gofs.DirEntry, err error) error {
+		require.NoError(t, err)
+		fi, err := entry.Info()
+		require.NoError(t, err)
+		stats[filepath.ToSlash(p)] = fi.Sys().(*types.Stat)
+		return nil
+	})
+	require.NoError(t, err)
+	return stats
+}
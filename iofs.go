@@ -0,0 +1,457 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// IOFSOpt controls the metadata that FromIOFS reports for information an
+// io/fs.FS does not carry.
+type IOFSOpt struct {
+	// Uid and Gid are reported as the owner of every entry.
+	Uid uint32
+	Gid uint32
+	// FileMode replaces the permission bits of non-directory entries when
+	// non-zero. Symlinks always report 0777.
+	FileMode os.FileMode
+	// DirMode replaces the permission bits of directories when non-zero.
+	DirMode os.FileMode
+}
+
+// FromIOFS returns an FS backed by a standard library io/fs.FS, for example an
+// embed.FS, fstest.MapFS or zip.Reader. Symlinks are resolved with ReadLink if
+// fsys implements io/fs.ReadLinkFS, otherwise the contents of the link entry
+// are used as its target, matching how zip archives store symlinks. Hardlinks,
+// devices and xattrs are not reported.
+func FromIOFS(fsys gofs.FS, opt *IOFSOpt) FS {
+	if opt == nil {
+		opt = &IOFSOpt{}
+	}
+	return &ioFS{fsys: fsys, opt: *opt}
+}
+
+type ioFS struct {
+	fsys gofs.FS
+	opt  IOFSOpt
+}
+
+func (fs *ioFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	target = cleanRootFSTarget(target)
+
+	return gofs.WalkDir(fs.fsys, target, func(path string, dirEntry gofs.DirEntry, walkErr error) (retErr error) {
+		defer func() {
+			if retErr != nil && isNotExist(retErr) {
+				retErr = filepath.SkipDir
+			}
+		}()
+
+		if path == "." {
+			return nil
+		}
+
+		var entry gofs.DirEntry
+		if dirEntry != nil {
+			fi, err := dirEntry.Info()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			stat, err := fs.stat(path, fi)
+			if err != nil {
+				return err
+			}
+			entry = &DirEntryInfo{Stat: stat}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			if err := fn(filepath.FromSlash(path), entry, walkErr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (fs *ioFS) Open(p string) (io.ReadCloser, error) {
+	f, err := fs.fsys.Open(cleanRootFSTarget(p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
+
+func (fs *ioFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	f, err := fs.fsys.Open(cleanRootFSTarget(p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.EISDIR})
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		return &ioReadAtCloser{ReaderAt: ra, Closer: f, size: fi.Size()}, nil
+	}
+	defer f.Close()
+	dt, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &bytesReadAtCloser{bytes.NewReader(dt)}, nil
+}
+
+type ioReadAtCloser struct {
+	io.ReaderAt
+	io.Closer
+	size int64
+}
+
+func (f *ioReadAtCloser) Size() int64 {
+	return f.size
+}
+
+func (fs *ioFS) stat(p string, fi gofs.FileInfo) (*types.Stat, error) {
+	mode := fi.Mode()
+	stat := &types.Stat{
+		Path: filepath.FromSlash(p),
+		Uid:  fs.opt.Uid,
+		Gid:  fs.opt.Gid,
+	}
+	if t := fi.ModTime(); !t.IsZero() {
+		stat.ModTime = t.UnixNano()
+	}
+
+	switch {
+	case mode.IsDir():
+		if fs.opt.DirMode != 0 {
+			mode = mode&^os.ModePerm | fs.opt.DirMode&os.ModePerm
+		}
+	case mode&os.ModeSymlink != 0:
+		link, err := fs.readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		mode = mode&^os.ModePerm | 0777
+		stat.Linkname = link
+		stat.Size = int64(len(link))
+	default:
+		if fs.opt.FileMode != 0 {
+			mode = mode&^os.ModePerm | fs.opt.FileMode&os.ModePerm
+		}
+		stat.Size = fi.Size()
+	}
+	stat.Mode = uint32(mode)
+	return stat, nil
+}
+
+func (fs *ioFS) readlink(p string) (string, error) {
+	if rfs, ok := fs.fsys.(gofs.ReadLinkFS); ok {
+		link, err := rfs.ReadLink(p)
+		return link, errors.WithStack(err)
+	}
+	dt, err := gofs.ReadFile(fs.fsys, p)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read link %s", p)
+	}
+	return string(dt), nil
+}
+
+// ToIOFS returns a standard library io/fs.FS view of fs. The returned value
+// implements io/fs.ReadDirFS, io/fs.StatFS and io/fs.ReadLinkFS. Directory
+// listings are read from fs the first time they are needed and
+// cached afterwards, so the view does not pick up later changes to fs.
+// Hardlinks are reported as regular files with the size of their target.
+func ToIOFS(fs FS) gofs.FS {
+	return &toIOFS{fs: fs, dirs: map[string]*ioDirListing{}}
+}
+
+type toIOFS struct {
+	fs FS
+
+	mu   sync.Mutex
+	dirs map[string]*ioDirListing
+}
+
+type ioDirListing struct {
+	entries []*types.Stat
+	byName  map[string]*types.Stat
+}
+
+var (
+	_ gofs.ReadDirFS  = &toIOFS{}
+	_ gofs.StatFS     = &toIOFS{}
+	_ gofs.ReadLinkFS = &toIOFS{}
+)
+
+func (fsys *toIOFS) Open(name string) (gofs.File, error) {
+	stat, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return &ioDirFile{fsys: fsys, stat: stat}, nil
+	}
+	if rfs, ok := fsys.fs.(ReaderAtFS); ok {
+		ra, err := rfs.OpenReaderAt(stat.Path)
+		if err != nil {
+			return nil, &gofs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &ioReaderAtFile{SectionReader: io.NewSectionReader(ra, 0, ra.Size()), ra: ra, stat: stat}, nil
+	}
+	rc, err := fsys.fs.Open(stat.Path)
+	if err != nil {
+		return nil, &gofs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &ioFile{ReadCloser: rc, stat: stat}, nil
+}
+
+func (fsys *toIOFS) ReadDir(name string) ([]gofs.DirEntry, error) {
+	stat, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, &gofs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	l, err := fsys.list(stat.Path)
+	if err != nil {
+		return nil, &gofs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]gofs.DirEntry, 0, len(l.entries))
+	for _, st := range l.entries {
+		entries = append(entries, &DirEntryInfo{Stat: st.Clone()})
+	}
+	return entries, nil
+}
+
+func (fsys *toIOFS) Stat(name string) (gofs.FileInfo, error) {
+	stat, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &StatInfo{stat.Clone()}, nil
+}
+
+func (fsys *toIOFS) Lstat(name string) (gofs.FileInfo, error) {
+	stat, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &StatInfo{stat.Clone()}, nil
+}
+
+func (fsys *toIOFS) ReadLink(name string) (string, error) {
+	stat, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if os.FileMode(stat.Mode)&os.ModeSymlink == 0 {
+		return "", &gofs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return stat.Linkname, nil
+}
+
+// resolve returns the stat of name, following symlinks in all parent
+// components and, if follow is set, in the last component as well. Symlinks
+// can not point outside of the root of the view.
+func (fsys *toIOFS) resolve(op, name string, follow bool) (*types.Stat, error) {
+	if !gofs.ValidPath(name) {
+		return nil, &gofs.PathError{Op: op, Path: name, Err: gofs.ErrInvalid}
+	}
+	stat := &types.Stat{Mode: uint32(os.ModeDir | 0755)}
+	if name == "." {
+		return stat, nil
+	}
+	parts := strings.Split(name, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if stat.Path == "" {
+				return nil, &gofs.PathError{Op: op, Path: name, Err: gofs.ErrNotExist}
+			}
+			parent, err := fsys.resolveParent(stat.Path)
+			if err != nil {
+				return nil, &gofs.PathError{Op: op, Path: name, Err: err}
+			}
+			stat = parent
+			continue
+		}
+		if !stat.IsDir() {
+			return nil, &gofs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		l, err := fsys.list(stat.Path)
+		if err != nil {
+			return nil, &gofs.PathError{Op: op, Path: name, Err: err}
+		}
+		child, ok := l.byName[part]
+		if !ok {
+			return nil, &gofs.PathError{Op: op, Path: name, Err: gofs.ErrNotExist}
+		}
+		if os.FileMode(child.Mode)&os.ModeSymlink == 0 || (len(parts) == 0 && !follow) {
+			stat = child
+			continue
+		}
+		links++
+		if links > memFSMaxSymlinks {
+			return nil, &gofs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+		}
+		link := filepath.ToSlash(child.Linkname)
+		if strings.HasPrefix(link, "/") {
+			stat = &types.Stat{Mode: uint32(os.ModeDir | 0755)}
+		}
+		parts = append(strings.Split(link, "/"), parts...)
+	}
+	return stat, nil
+}
+
+func (fsys *toIOFS) resolveParent(p string) (*types.Stat, error) {
+	dir := filepath.Dir(p)
+	if dir == "." {
+		return &types.Stat{Mode: uint32(os.ModeDir | 0755)}, nil
+	}
+	l, err := fsys.list(filepath.Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := l.byName[filepath.Base(dir)]
+	if !ok {
+		return nil, gofs.ErrNotExist
+	}
+	return stat, nil
+}
+
+// list returns the cached listing of the directory at native path dir,
+// reading it from the underlying FS on first use.
+func (fsys *toIOFS) list(dir string) (*ioDirListing, error) {
+	if dir == "." {
+		dir = ""
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if l, ok := fsys.dirs[dir]; ok {
+		return l, nil
+	}
+	stats, err := readDirPath(context.TODO(), fsys.fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &ioDirListing{byName: map[string]*types.Stat{}}
+	for _, stat := range stats {
+		if stat.Linkname != "" && os.FileMode(stat.Mode)&os.ModeSymlink == 0 {
+			// hardlinks take the size of their target, which can be in
+			// another directory
+			if target, ok := l.byName[filepath.Base(stat.Linkname)]; ok && target.Path == stat.Linkname {
+				stat.Size = target.Size
+			} else {
+				target, err := statPath(context.TODO(), fsys.fs, stat.Linkname)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return nil, err
+				}
+				if target != nil {
+					stat.Size = target.Size
+				}
+			}
+			stat.Linkname = ""
+		}
+		l.entries = append(l.entries, stat)
+		l.byName[filepath.Base(stat.Path)] = stat
+	}
+	sort.Slice(l.entries, func(i, j int) bool {
+		return filepath.Base(l.entries[i].Path) < filepath.Base(l.entries[j].Path)
+	})
+	fsys.dirs[dir] = l
+	return l, nil
+}
+
+type ioFile struct {
+	io.ReadCloser
+	stat *types.Stat
+}
+
+func (f *ioFile) Stat() (gofs.FileInfo, error) {
+	return &StatInfo{f.stat.Clone()}, nil
+}
+
+// ioReaderAtFile is a file that also implements io.ReaderAt and io.Seeker.
+type ioReaderAtFile struct {
+	*io.SectionReader
+	ra   ReadAtCloser
+	stat *types.Stat
+}
+
+func (f *ioReaderAtFile) Stat() (gofs.FileInfo, error) {
+	return &StatInfo{f.stat.Clone()}, nil
+}
+
+func (f *ioReaderAtFile) Close() error {
+	return f.ra.Close()
+}
+
+type ioDirFile struct {
+	fsys    *toIOFS
+	stat    *types.Stat
+	entries []gofs.DirEntry
+	read    bool
+}
+
+func (f *ioDirFile) Stat() (gofs.FileInfo, error) {
+	return &StatInfo{f.stat.Clone()}, nil
+}
+
+func (f *ioDirFile) Read([]byte) (int, error) {
+	return 0, &gofs.PathError{Op: "read", Path: f.stat.Path, Err: syscall.EISDIR}
+}
+
+func (f *ioDirFile) Close() error {
+	return nil
+}
+
+func (f *ioDirFile) ReadDir(n int) ([]gofs.DirEntry, error) {
+	if !f.read {
+		l, err := f.fsys.list(f.stat.Path)
+		if err != nil {
+			return nil, &gofs.PathError{Op: "readdir", Path: f.stat.Path, Err: err}
+		}
+		for _, st := range l.entries {
+			f.entries = append(f.entries, &DirEntryInfo{Stat: st.Clone()})
+		}
+		f.read = true
+	}
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
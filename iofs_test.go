@@ -0,0 +1,299 @@
+package fsutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestFromIOFS(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	fs := FromIOFS(fstest.MapFS{
+		"foo":     &fstest.MapFile{Mode: os.ModeDir | 0700, ModTime: mtime},
+		"foo/bar": &fstest.MapFile{Data: []byte("data1"), Mode: 0600, ModTime: mtime},
+		"foo/baz": &fstest.MapFile{Data: []byte("bar"), Mode: os.ModeSymlink},
+		"qux":     &fstest.MapFile{Data: []byte("data2")},
+	}, &IOFSOpt{Uid: 1000, Gid: 1001, DirMode: 0755})
+
+	b := &bytes.Buffer{}
+	err := fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir foo
+file foo/bar
+symlink:bar foo/baz
+file qux
+`), b.String())
+
+	b.Reset()
+	err = fs.Walk(context.TODO(), "/foo", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir foo
+file foo/bar
+symlink:bar foo/baz
+`), b.String())
+
+	b.Reset()
+	err = fs.Walk(context.TODO(), "missing", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Empty(t, b.String())
+
+	stats := map[string]*types.Stat{}
+	err = fs.Walk(context.TODO(), "", func(p string, entry os.DirEntry, err error) error {
+		require.NoError(t, err)
+		fi, err := entry.Info()
+		require.NoError(t, err)
+		stats[p] = fi.Sys().(*types.Stat)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, &types.Stat{
+		Path:    "foo",
+		Mode:    uint32(os.ModeDir | 0755),
+		Uid:     1000,
+		Gid:     1001,
+		ModTime: mtime.UnixNano(),
+	}, stats["foo"])
+	assert.Equal(t, &types.Stat{
+		Path:    filepath.FromSlash("foo/bar"),
+		Mode:    0600,
+		Uid:     1000,
+		Gid:     1001,
+		Size:    5,
+		ModTime: mtime.UnixNano(),
+	}, stats[filepath.FromSlash("foo/bar")])
+	assert.Equal(t, &types.Stat{
+		Path:     filepath.FromSlash("foo/baz"),
+		Mode:     uint32(os.ModeSymlink | 0777),
+		Uid:      1000,
+		Gid:      1001,
+		Size:     3,
+		Linkname: "bar",
+	}, stats[filepath.FromSlash("foo/baz")])
+
+	rc, err := fs.Open(filepath.FromSlash("foo/bar"))
+	require.NoError(t, err)
+	dt, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, "data1", string(dt))
+
+	_, err = fs.Open("missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFromIOFSZip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{"foo/", os.ModeDir | 0755, ""},
+		{"foo/bar", 0644, "data1"},
+		{"foo/baz", os.ModeSymlink | 0777, "bar"},
+	} {
+		hdr := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+		hdr.SetMode(f.mode)
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(f.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	fs := FromIOFS(zr, nil)
+
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir foo
+file foo/bar
+symlink:bar foo/baz
+`), b.String())
+
+	forEachReceiveDiskWriter(t, func(t *testing.T, receive receiveTestFunc) {
+		dest := t.TempDir()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		eg, ctx := errgroup.WithContext(ctx)
+		s1, s2 := sockPairProto(ctx)
+
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, fs, nil)
+		})
+		eg.Go(func() error {
+			return receive(ctx, s2, dest, ReceiveOpt{})
+		})
+		require.NoError(t, eg.Wait())
+
+		dt, err := os.ReadFile(filepath.Join(dest, "foo/bar"))
+		require.NoError(t, err)
+		assert.Equal(t, "data1", string(dt))
+
+		link, err := os.Readlink(filepath.Join(dest, "foo/baz"))
+		require.NoError(t, err)
+		assert.Equal(t, "bar", link)
+	})
+}
+
+func TestToIOFS(t *testing.T) {
+	m, err := memTree(changeStream([]string{
+		"ADD foo dir",
+		"ADD foo/a dir",
+		"ADD foo/a/c file data2",
+		"ADD foo/b file data1",
+		"ADD bar symlink foo/b",
+		"ADD baz file >foo/a/c",
+		"ADD foo.txt file data3",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, m.AddDir("foo/d", 0755))
+	require.NoError(t, m.AddSymlink("foo/d/up", "../a"))
+	require.NoError(t, m.AddSymlink("abs", "/foo/b"))
+
+	cfs := &countingFS{FS: m}
+	fsys := ToIOFS(cfs)
+	require.NoError(t, fstest.TestFS(fsys, "bar", "baz", "foo/a/c", "foo/b", "foo.txt", "abs", "foo/d/up"))
+
+	walks := cfs.walks
+	_, err = gofs.ReadDir(fsys, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, walks, cfs.walks)
+
+	dt, err := gofs.ReadFile(fsys, "foo/d/up/c")
+	require.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+
+	// files of an FS supporting random access reads can seek
+	f, err := ToIOFS(m).Open("foo/b")
+	require.NoError(t, err)
+	_, err = f.(io.Seeker).Seek(2, io.SeekStart)
+	require.NoError(t, err)
+	dt, err = io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "ta1", string(dt))
+	require.NoError(t, f.Close())
+
+	// hardlinks are reported with the size of their target
+	fi, err := gofs.Stat(fsys, "foo/a/c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+
+	// also when the listing is walked and the target is in another directory
+	walkFS := ToIOFS(&rootWalkFS{fs: m})
+	fi, err = gofs.Stat(walkFS, "foo/a/c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+	entries, err := gofs.ReadDir(walkFS, "foo/a")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	fi, err = entries[0].Info()
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+
+	link, err := gofs.ReadLink(fsys, "bar")
+	require.NoError(t, err)
+	assert.Equal(t, "foo/b", link)
+
+	fi, err = gofs.Lstat(fsys, "bar")
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSymlink, fi.Mode().Type())
+	fi, err = gofs.Stat(fsys, "bar")
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+
+	_, err = gofs.ReadLink(fsys, "foo/b")
+	require.ErrorIs(t, err, syscall.EINVAL)
+	_, err = fsys.Open("foo/missing")
+	require.ErrorIs(t, err, gofs.ErrNotExist)
+	_, err = fsys.Open("../foo")
+	require.ErrorIs(t, err, gofs.ErrInvalid)
+}
+
+func TestToIOFSFiltered(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/a file data2",
+		"ADD foo/b file data3",
+		"ADD zzz dir",
+		"ADD zzz/x file data4",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	fs, err := NewFS(d)
+	require.NoError(t, err)
+	fs, err = NewFilterFS(fs, &FilterOpt{
+		ExcludePatterns: []string{"foo/b", "zzz"},
+	})
+	require.NoError(t, err)
+
+	fsys := ToIOFS(fs)
+	require.NoError(t, fstest.TestFS(fsys, "bar", "foo/a"))
+
+	var paths []string
+	err = gofs.WalkDir(fsys, ".", func(p string, d gofs.DirEntry, err error) error {
+		require.NoError(t, err)
+		paths = append(paths, p)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".", "bar", "foo", "foo/a"}, paths)
+}
+
+// rootWalkFS walks the whole of fs for every target, so that hardlinks refer
+// to entries outside of the target.
+type rootWalkFS struct {
+	fs FS
+}
+
+func (fs *rootWalkFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	target = cleanFSPath(target)
+	return fs.fs.Walk(ctx, "", func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if target == "" || p == target || strings.HasPrefix(p, target+string(filepath.Separator)) {
+			return fn(p, entry, nil)
+		}
+		if entry.IsDir() && !strings.HasPrefix(target, p+string(filepath.Separator)) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func (fs *rootWalkFS) Open(p string) (io.ReadCloser, error) {
+	return fs.fs.Open(p)
+}
+
+type countingFS struct {
+	FS
+	walks int
+}
+
+func (fs *countingFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	fs.walks++
+	return fs.FS.Walk(ctx, target, fn)
+}
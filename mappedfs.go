@@ -0,0 +1,349 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// MapRule moves the entry at From, and everything under it, to To. An empty
+// From moves the whole tree under To, and an empty To moves the contents of
+// From to the root.
+type MapRule struct {
+	From string
+	To   string
+}
+
+// NewMappedFS returns an FS that presents fs with its paths rewritten by
+// rules. A path is moved by the rule with the longest From that is the path
+// itself or one of its parents, and paths that no rule matches are kept.
+// Missing parent directories of the new paths are synthesized.
+//
+// If two entries end up at the same path, directories are merged with the
+// metadata of the entry moved by the later rule, and for other entries the
+// walk fails. Hardlinks are linked to the path that is first in the new walk
+// order. Symlink targets are not rewritten.
+//
+// The whole of fs is walked, and the entries are kept in memory, on every
+// walk.
+func NewMappedFS(fs FS, rules []MapRule) (FS, error) {
+	m := &mappedFS{fs: fs}
+	from := map[string]struct{}{}
+	for _, r := range rules {
+		r = MapRule{From: cleanFSPath(r.From), To: cleanFSPath(r.To)}
+		if r.From == r.To {
+			continue
+		}
+		if _, ok := from[r.From]; ok {
+			return nil, errors.WithStack(&os.PathError{Op: "map", Path: r.From, Err: syscall.EINVAL})
+		}
+		from[r.From] = struct{}{}
+		m.rules = append(m.rules, r)
+	}
+	return m.withReaderAt(), nil
+}
+
+// RewriteFunc returns the new path, with slash separators, for the entry with
+// the given stat.Path. An empty result drops the entry but not the entries
+// inside a directory. The function can also modify the stat info.
+type RewriteFunc func(string, *types.Stat) string
+
+// StripComponents returns a RewriteFunc that removes the first n components
+// of every path, like tar --strip-components. The entries with n or less
+// components are dropped. A negative n counts as 0.
+func StripComponents(n int) RewriteFunc {
+	n = max(n, 0)
+	return func(p string, _ *types.Stat) string {
+		parts := strings.SplitN(p, "/", n+1)
+		if len(parts) <= n {
+			return ""
+		}
+		return parts[n]
+	}
+}
+
+// NewRewriteFS returns an FS that presents fs with the new paths returned by
+// fn, like NewMappedFS. If two directories end up at the same path, the
+// metadata of the first one is kept. A new path that is absolute or outside
+// of the root fails the walk.
+//
+// Open resolves the paths of the last walk, and walks the whole of fs to find
+// the source paths if there was none.
+func NewRewriteFS(fs FS, fn RewriteFunc) FS {
+	m := &mappedFS{fs: fs, rewrite: fn}
+	return m.withReaderAt()
+}
+
+type mappedFS struct {
+	fs      FS
+	rules   []MapRule
+	rewrite RewriteFunc
+
+	// sources contains the source paths of the new paths of rewrite,
+	// replaced by every walk
+	mu      sync.Mutex
+	sources map[string]string
+}
+
+type mappedEntry struct {
+	stat *types.Stat
+	// rank is the index of the rule that moved the entry plus one, or zero
+	// if it was not moved
+	rank int
+	// group is the source path of the first link of a regular file
+	group string
+}
+
+func (fs *mappedFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	entries := map[string]*mappedEntry{}
+	sizes := map[string]int64{}
+	sources := map[string]string{}
+	err := fs.fs.Walk(ctx, "", func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+
+		dst, rank, err := fs.mapEntry(p, stat)
+		if err != nil {
+			return err
+		}
+		e := &mappedEntry{stat: stat, rank: rank}
+		if os.FileMode(stat.Mode).IsRegular() {
+			if stat.Linkname != "" {
+				e.group = stat.Linkname
+				stat.Linkname = ""
+			} else {
+				e.group = p
+				sizes[p] = stat.Size
+			}
+		}
+		if dst == "" {
+			return nil
+		}
+		stat.Path = dst
+
+		old, ok := entries[dst]
+		if !ok {
+			entries[dst] = e
+			sources[dst] = p
+			return nil
+		}
+		if !old.stat.IsDir() || !stat.IsDir() {
+			return errors.WithStack(&os.PathError{Op: "map", Path: dst, Err: syscall.EEXIST})
+		}
+		if e.rank > old.rank {
+			entries[dst] = e
+			sources[dst] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if fs.rewrite != nil {
+		fs.mu.Lock()
+		fs.sources = sources
+		fs.mu.Unlock()
+	}
+
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	for _, p := range paths {
+		for dir := filepath.Dir(p); dir != "."; dir = filepath.Dir(dir) {
+			if e, ok := entries[dir]; ok {
+				if !e.stat.IsDir() {
+					return errors.WithStack(&os.PathError{Op: "map", Path: dir, Err: syscall.ENOTDIR})
+				}
+				continue
+			}
+			entries[dir] = &mappedEntry{stat: &types.Stat{Path: dir, Mode: uint32(os.ModeDir | 0755)}}
+			paths = append(paths, dir)
+		}
+	}
+	slices.SortFunc(paths, ComparePath)
+
+	seenFiles := map[string]string{}
+	return walkSorted(ctx, paths, target, func(p string) *types.Stat {
+		e := entries[p]
+		if e.group != "" {
+			if oldpath, ok := seenFiles[e.group]; ok {
+				e.stat.Linkname = oldpath
+				e.stat.Size = 0
+			} else {
+				seenFiles[e.group] = p
+				e.stat.Size = sizes[e.group]
+			}
+		}
+		return e.stat
+	}, fn)
+}
+
+func (fs *mappedFS) Open(p string) (io.ReadCloser, error) {
+	src, err := fs.unmapPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fs.Open(src)
+}
+
+// withReaderAt returns fs as a mappedReaderAtFS if the source FS implements
+// ReaderAtFS.
+func (fs *mappedFS) withReaderAt() FS {
+	if _, ok := fs.fs.(ReaderAtFS); ok {
+		return &mappedReaderAtFS{fs}
+	}
+	return fs
+}
+
+// mappedReaderAtFS is a mappedFS over an FS that implements ReaderAtFS.
+type mappedReaderAtFS struct {
+	*mappedFS
+}
+
+func (fs *mappedReaderAtFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	src, err := fs.unmapPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fs.(ReaderAtFS).OpenReaderAt(src)
+}
+
+// mapEntry returns the new path of the entry at the source path p, and the
+// rank of the rule that moved it.
+func (fs *mappedFS) mapEntry(p string, stat *types.Stat) (string, int, error) {
+	if fs.rewrite == nil {
+		dst, rank := fs.mapPath(p)
+		return dst, rank, nil
+	}
+	dst := fs.rewrite(stat.Path, stat)
+	if dst == "" {
+		return "", 0, nil
+	}
+	dst = filepath.Clean(filepath.FromSlash(dst))
+	if dst == "." || filepath.IsAbs(dst) || dst == ".." || strings.HasPrefix(dst, ".."+string(filepath.Separator)) {
+		return "", 0, errors.WithStack(&os.PathError{Op: "map", Path: p, Err: syscall.EINVAL})
+	}
+	return dst, 0, nil
+}
+
+// mapPath returns the new path of the source path p and the rank of the rule
+// that moved it. The new path is empty if p is moved to the root.
+func (fs *mappedFS) mapPath(p string) (string, int) {
+	best := -1
+	for i, r := range fs.rules {
+		if !hasPathPrefix(p, r.From) {
+			continue
+		}
+		if best == -1 || len(r.From) > len(fs.rules[best].From) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return p, 0
+	}
+	r := fs.rules[best]
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, r.From), string(filepath.Separator))
+	return filepath.Join(r.To, rel), best + 1
+}
+
+// unmapPath returns the source path that is moved to p.
+func (fs *mappedFS) unmapPath(p string) (string, error) {
+	p = cleanFSPath(p)
+	if fs.rewrite != nil {
+		fs.mu.Lock()
+		sources := fs.sources
+		fs.mu.Unlock()
+		if sources == nil {
+			var err error
+			if sources, err = fs.rewriteSources(context.TODO()); err != nil {
+				return "", err
+			}
+			fs.mu.Lock()
+			if fs.sources == nil {
+				fs.sources = sources
+			}
+			fs.mu.Unlock()
+		}
+		src, ok := sources[p]
+		if !ok {
+			return "", errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ENOENT})
+		}
+		return src, nil
+	}
+	src, rank := "", -1
+	candidates := []string{p}
+	for _, r := range fs.rules {
+		if hasPathPrefix(p, r.To) {
+			rel := strings.TrimPrefix(strings.TrimPrefix(p, r.To), string(filepath.Separator))
+			candidates = append(candidates, filepath.Join(r.From, rel))
+		}
+	}
+	for _, c := range candidates {
+		if dst, r := fs.mapPath(c); dst == p && r > rank {
+			src, rank = c, r
+		}
+	}
+	if rank == -1 {
+		return "", errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ENOENT})
+	}
+	return src, nil
+}
+
+// rewriteSources returns the source path of every new path of rewrite, the
+// first one for merged directories.
+func (fs *mappedFS) rewriteSources(ctx context.Context) (map[string]string, error) {
+	sources := map[string]string{}
+	err := fs.fs.Walk(ctx, "", func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+		dst, _, err := fs.mapEntry(p, stat)
+		if err != nil {
+			return err
+		}
+		if _, ok := sources[dst]; !ok && dst != "" {
+			sources[dst] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// hasPathPrefix reports whether the native relative path p is prefix or is
+// under it. An empty prefix matches every path.
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, prefix+string(filepath.Separator))
+}
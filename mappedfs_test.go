@@ -0,0 +1,375 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestMappedFS(t *testing.T) {
+	src, err := memTree(changeStream([]string{
+		"ADD build dir",
+		"ADD build/out dir",
+		"ADD build/out/a file data1",
+		"ADD build/out/sub dir",
+		"ADD build/out/sub/b file data2",
+		"ADD build/other file data3",
+		"ADD hl file >build/out/a",
+		"ADD readme symlink build/other",
+	}))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		rules    []MapRule
+		expected string
+	}{
+		{
+			name:  "move",
+			rules: []MapRule{{From: "build/out", To: "dist"}},
+			expected: `dir build
+file build/other
+dir dist
+file dist/a
+dir dist/sub
+file dist/sub/b
+file hl >dist/a
+symlink:build/other readme
+`,
+		},
+		{
+			name:  "reorder",
+			rules: []MapRule{{From: "build/out", To: "z/dist"}},
+			expected: `dir build
+file build/other
+file hl
+symlink:build/other readme
+dir z
+dir z/dist
+file z/dist/a >hl
+dir z/dist/sub
+file z/dist/sub/b
+`,
+		},
+		{
+			name:  "prefix",
+			rules: []MapRule{{From: "", To: "app"}, {From: "build/out/sub", To: "sub"}},
+			expected: `dir app
+dir app/build
+file app/build/other
+dir app/build/out
+file app/build/out/a
+file app/hl >app/build/out/a
+symlink:build/other app/readme
+dir sub
+file sub/b
+`,
+		},
+		{
+			name:  "root",
+			rules: []MapRule{{From: "/build/out/", To: "/"}},
+			expected: `file a
+dir build
+file build/other
+file hl >a
+symlink:build/other readme
+dir sub
+file sub/b
+`,
+		},
+		{
+			name:  "rename",
+			rules: []MapRule{{From: "readme", To: "docs/readme.md"}, {From: "build", To: "build"}},
+			expected: `dir build
+file build/other
+dir build/out
+file build/out/a
+dir build/out/sub
+file build/out/sub/b
+dir docs
+symlink:build/other docs/readme.md
+file hl >build/out/a
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := NewMappedFS(src, tc.rules)
+			require.NoError(t, err)
+
+			b := &bytes.Buffer{}
+			err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.FromSlash(tc.expected), b.String())
+		})
+	}
+
+	fs, err := NewMappedFS(src, []MapRule{{From: "build/out", To: "z/dist"}})
+	require.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "z/dist", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir z/dist
+file z/dist/a
+dir z/dist/sub
+file z/dist/sub/b
+`), b.String())
+
+	for p, expected := range map[string]string{
+		"z/dist/a":     "data1",
+		"z/dist/sub/b": "data2",
+		"hl":           "data1",
+		"build/other":  "data3",
+	} {
+		rc, err := fs.Open(filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		dt, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, expected, string(dt), p)
+	}
+	_, err = fs.Open(filepath.FromSlash("build/out/a"))
+	require.ErrorIs(t, err, syscall.ENOENT)
+}
+
+func TestMappedFSErrors(t *testing.T) {
+	src, err := memTree(changeStream([]string{
+		"ADD build dir",
+		"ADD build/out dir",
+		"ADD build/out/a file data1",
+		"ADD build/out/sub dir",
+		"ADD build/out/sub/b file data2",
+		"ADD build/other file data3",
+		"ADD hl file >build/out/a",
+		"ADD readme symlink build/other",
+	}))
+	require.NoError(t, err)
+
+	_, err = NewMappedFS(NewMemFS(), []MapRule{{From: "a", To: "b"}, {From: "a/", To: "c"}})
+	require.ErrorIs(t, err, syscall.EINVAL)
+
+	fs, err := NewMappedFS(src, []MapRule{{From: "build/other", To: "hl"}})
+	require.NoError(t, err)
+	err = fs.Walk(context.TODO(), "", bufWalkDir(&bytes.Buffer{}))
+	require.ErrorIs(t, err, syscall.EEXIST)
+
+	fs, err = NewMappedFS(src, []MapRule{{From: "build/out", To: "hl/out"}})
+	require.NoError(t, err)
+	err = fs.Walk(context.TODO(), "", bufWalkDir(&bytes.Buffer{}))
+	require.ErrorIs(t, err, syscall.ENOTDIR)
+}
+
+func TestRewriteFS(t *testing.T) {
+	src, err := memTree(changeStream([]string{
+		"ADD build dir",
+		"ADD build/out dir",
+		"ADD build/out/a file data1",
+		"ADD build/out/sub dir",
+		"ADD build/out/sub/b file data2",
+		"ADD build/other file data3",
+		"ADD hl file >build/out/a",
+		"ADD readme symlink build/other",
+	}))
+	require.NoError(t, err)
+
+	flatten := func(p string, stat *types.Stat) string {
+		if stat.IsDir() {
+			return ""
+		}
+		return path.Base(p)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		fs       func() (FS, error)
+		expected string
+	}{
+		{
+			name: "strip",
+			fs: func() (FS, error) {
+				return NewFilterFS(src, &FilterOpt{
+					ExcludePatterns: []string{"readme"},
+					Rewrite:         StripComponents(1),
+				})
+			},
+			expected: `file other
+dir out
+file out/a
+dir out/sub
+file out/sub/b
+`,
+		},
+		{
+			name: "flatten",
+			fs: func() (FS, error) {
+				return NewRewriteFS(src, flatten), nil
+			},
+			expected: `file a
+file b
+file hl >a
+file other
+symlink:build/other readme
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := tc.fs()
+			require.NoError(t, err)
+
+			b := &bytes.Buffer{}
+			err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.FromSlash(tc.expected), b.String())
+
+			v := &Validator{}
+			err = fs.Walk(context.TODO(), "", func(p string, entry gofs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				fi, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				return v.HandleChange(ChangeKindAdd, p, fi, nil)
+			})
+			require.NoError(t, err)
+		})
+	}
+
+	fs := NewRewriteFS(src, flatten)
+	for p, expected := range map[string]string{
+		"a":     "data1",
+		"b":     "data2",
+		"hl":    "data1",
+		"other": "data3",
+	} {
+		rc, err := fs.Open(p)
+		require.NoError(t, err, p)
+		dt, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, expected, string(dt), p)
+	}
+	_, err = fs.Open(filepath.FromSlash("build/out/a"))
+	require.ErrorIs(t, err, syscall.ENOENT)
+
+	fs = NewRewriteFS(src, func(p string, _ *types.Stat) string {
+		return "../" + p
+	})
+	err = fs.Walk(context.TODO(), "", bufWalkDir(&bytes.Buffer{}))
+	require.ErrorIs(t, err, syscall.EINVAL)
+
+	fs = NewRewriteFS(src, func(p string, stat *types.Stat) string {
+		if stat.IsDir() {
+			return p
+		}
+		return "same"
+	})
+	err = fs.Walk(context.TODO(), "", bufWalkDir(&bytes.Buffer{}))
+	require.ErrorIs(t, err, syscall.EEXIST)
+
+	assert.Equal(t, "a/b", StripComponents(-1)("a/b", nil))
+}
+
+func TestMappedFSSend(t *testing.T) {
+	forEachReceiveDiskWriter(t, func(t *testing.T, receive receiveTestFunc) {
+		src, err := memTree(changeStream([]string{
+			"ADD build dir",
+			"ADD build/out dir",
+			"ADD build/out/a file data1",
+			"ADD build/out/sub dir",
+			"ADD build/out/sub/b file data2",
+			"ADD build/other file data3",
+			"ADD hl file >build/out/a",
+			"ADD readme symlink build/other",
+		}))
+		require.NoError(t, err)
+
+		fs, err := NewMappedFS(src, []MapRule{{From: "build/out", To: "z/dist"}})
+		require.NoError(t, err)
+
+		dest := t.TempDir()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		eg, ctx := errgroup.WithContext(ctx)
+		s1, s2 := sockPairProto(ctx)
+
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, fs, nil)
+		})
+		eg.Go(func() error {
+			return receive(ctx, s2, dest, ReceiveOpt{})
+		})
+		require.NoError(t, eg.Wait())
+
+		dt, err := os.ReadFile(filepath.Join(dest, "z/dist/a"))
+		require.NoError(t, err)
+		assert.Equal(t, "data1", string(dt))
+
+		fi1, err := os.Stat(filepath.Join(dest, "hl"))
+		require.NoError(t, err)
+		fi2, err := os.Stat(filepath.Join(dest, "z/dist/a"))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(fi1, fi2))
+	})
+}
+
+func TestRewriteFSChanges(t *testing.T) {
+	d := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(d, "v1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "v1/a"), []byte("data1"), 0644))
+
+	var fail bool
+	src, err := NewFS(d)
+	require.NoError(t, err)
+	fs := NewRewriteFS(src, func(p string, stat *types.Stat) string {
+		if fail {
+			return "../" + p
+		}
+		return StripComponents(1)(p, stat)
+	})
+
+	readFile := func(p string) (string, error) {
+		rc, err := fs.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		dt, err := io.ReadAll(rc)
+		return string(dt), err
+	}
+
+	// a failed lookup is not kept
+	fail = true
+	_, err = readFile("a")
+	require.ErrorIs(t, err, syscall.EINVAL)
+	fail = false
+	dt, err := readFile("a")
+	require.NoError(t, err)
+	assert.Equal(t, "data1", dt)
+
+	// a new walk sees the changed tree, and Open follows it
+	require.NoError(t, os.RemoveAll(filepath.Join(d, "v1")))
+	require.NoError(t, os.MkdirAll(filepath.Join(d, "v2"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "v2/a"), []byte("data2"), 0644))
+
+	b := &bytes.Buffer{}
+	require.NoError(t, fs.Walk(context.TODO(), "", bufWalkDir(b)))
+	assert.Equal(t, "file a\n", b.String())
+	dt, err = readFile("a")
+	require.NoError(t, err)
+	assert.Equal(t, "data2", dt)
+}
@@ -0,0 +1,419 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	gofs "io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+const memFSMaxSymlinks = 255
+
+// MemFS is an FS that keeps a tree in memory. Entries are added with the
+// builder methods and walked in the same order and with the same stat
+// information as an equivalent tree on disk, including hardlinks.
+//
+// Paths passed to the builder methods are relative to the root of the
+// MemFS. Parent directories need to be added before their children.
+type MemFS struct {
+	mu   sync.RWMutex
+	root *memNode
+}
+
+type memNode struct {
+	inode    *memInode
+	children map[string]*memNode
+}
+
+type memInode struct {
+	mode     uint32
+	uid      uint32
+	gid      uint32
+	modTime  int64
+	linkname string
+	devmajor int64
+	devminor int64
+	xattrs   map[string][]byte
+	data     []byte
+}
+
+var _ FS = &MemFS{}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		root: &memNode{
+			inode:    &memInode{mode: uint32(os.ModeDir | 0755)},
+			children: map[string]*memNode{},
+		},
+	}
+}
+
+// AddFile adds a regular file with the given contents.
+func (m *MemFS) AddFile(p string, data []byte, mode os.FileMode) error {
+	return m.add(p, &memNode{inode: &memInode{
+		mode: uint32(mode & memFSModeBits),
+		data: bytes.Clone(data),
+	}})
+}
+
+// AddDir adds an empty directory.
+func (m *MemFS) AddDir(p string, mode os.FileMode) error {
+	return m.add(p, &memNode{
+		inode:    &memInode{mode: uint32(os.ModeDir | mode&memFSModeBits)},
+		children: map[string]*memNode{},
+	})
+}
+
+// AddSymlink adds a symlink pointing to target.
+func (m *MemFS) AddSymlink(p, target string) error {
+	return m.add(p, &memNode{inode: &memInode{
+		mode:     uint32(os.ModeSymlink | 0777),
+		linkname: target,
+	}})
+}
+
+// AddHardlink adds a hardlink to the existing non-directory entry at target.
+func (m *MemFS) AddHardlink(p, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.lookup(target)
+	if err != nil {
+		return err
+	}
+	if n.children != nil {
+		return errors.WithStack(&os.PathError{Op: "link", Path: target, Err: syscall.EPERM})
+	}
+	return m.addLocked(p, &memNode{inode: n.inode})
+}
+
+// AddDevice adds a device or named pipe. mode needs to contain
+// os.ModeDevice or os.ModeNamedPipe.
+func (m *MemFS) AddDevice(p string, mode os.FileMode, major, minor int64) error {
+	if mode&(os.ModeDevice|os.ModeNamedPipe) == 0 {
+		return errors.WithStack(&os.PathError{Op: "mknod", Path: p, Err: syscall.EINVAL})
+	}
+	return m.add(p, &memNode{inode: &memInode{
+		mode:     uint32(mode & (memFSModeBits | os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe)),
+		devmajor: major,
+		devminor: minor,
+	}})
+}
+
+// SetXattr sets an extended attribute on an existing entry.
+func (m *MemFS) SetXattr(p, key string, value []byte) error {
+	return m.update(p, func(ino *memInode) {
+		if ino.xattrs == nil {
+			ino.xattrs = map[string][]byte{}
+		}
+		ino.xattrs[key] = bytes.Clone(value)
+	})
+}
+
+// SetOwner sets the owner of an existing entry.
+func (m *MemFS) SetOwner(p string, uid, gid uint32) error {
+	return m.update(p, func(ino *memInode) {
+		ino.uid = uid
+		ino.gid = gid
+	})
+}
+
+// SetModTime sets the modification time of an existing entry.
+func (m *MemFS) SetModTime(p string, t time.Time) error {
+	return m.update(p, func(ino *memInode) {
+		ino.modTime = t.UnixNano()
+	})
+}
+
+func (m *MemFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	parts, err := memFSComponents(target)
+	if err != nil {
+		return err
+	}
+	w := &memFSWalker{ctx: ctx, fn: fn, seenFiles: map[*memInode]string{}}
+
+	if len(parts) == 0 {
+		err = w.walkDir(m, "", m.root)
+	} else {
+		p := filepath.Join(parts...)
+		m.mu.RLock()
+		n, lerr := m.lookup(p)
+		var stat *types.Stat
+		if lerr == nil {
+			stat = w.stat(p, n)
+		}
+		m.mu.RUnlock()
+
+		if lerr != nil {
+			err = fn(p, nil, lerr)
+		} else {
+			err = fn(p, &DirEntryInfo{Stat: stat}, nil)
+			if err == nil && n.children != nil {
+				err = w.walkDir(m, p, n)
+			}
+		}
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll || (err != nil && isNotExist(err)) {
+		return nil
+	}
+	return err
+}
+
+func (m *MemFS) Open(p string) (io.ReadCloser, error) {
+	ra, err := m.OpenReaderAt(p)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.NewSectionReader(ra, 0, ra.Size())), nil
+}
+
+// OpenReaderAt opens the file at p for random access reads, following
+// symlinks.
+func (m *MemFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n, err := m.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.children != nil {
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.EISDIR})
+	}
+	if !os.FileMode(n.inode.mode).IsRegular() {
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.EINVAL})
+	}
+	return &bytesReadAtCloser{bytes.NewReader(n.inode.data)}, nil
+}
+
+const memFSModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+type memFSWalker struct {
+	ctx       context.Context
+	fn        gofs.WalkDirFunc
+	seenFiles map[*memInode]string
+}
+
+func (w *memFSWalker) walkDir(m *MemFS, dir string, n *memNode) error {
+	type entry struct {
+		path  string
+		node  *memNode
+		isDir bool
+	}
+
+	m.mu.RLock()
+	names := slices.Sorted(maps.Keys(n.children))
+	entries := make([]entry, 0, len(names))
+	for _, name := range names {
+		child := n.children[name]
+		entries = append(entries, entry{
+			path:  filepath.Join(dir, name),
+			node:  child,
+			isDir: child.children != nil,
+		})
+	}
+	m.mu.RUnlock()
+
+	for _, e := range entries {
+		select {
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		default:
+		}
+		m.mu.RLock()
+		stat := w.stat(e.path, e.node)
+		m.mu.RUnlock()
+
+		if err := w.fn(e.path, &DirEntryInfo{Stat: stat}, nil); err != nil {
+			if err == filepath.SkipDir {
+				if e.isDir {
+					continue
+				}
+				return nil
+			}
+			return err
+		}
+		if e.isDir {
+			if err := w.walkDir(m, e.path, e.node); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *memFSWalker) stat(p string, n *memNode) *types.Stat {
+	ino := n.inode
+	stat := &types.Stat{
+		Path:     p,
+		Mode:     ino.mode,
+		Uid:      ino.uid,
+		Gid:      ino.gid,
+		ModTime:  ino.modTime,
+		Linkname: ino.linkname,
+		Devmajor: ino.devmajor,
+		Devminor: ino.devminor,
+	}
+	if len(ino.xattrs) > 0 {
+		stat.Xattrs = maps.Clone(ino.xattrs)
+		for k, v := range stat.Xattrs {
+			stat.Xattrs[k] = bytes.Clone(v)
+		}
+	}
+	if n.children != nil {
+		return stat
+	}
+	switch {
+	case os.FileMode(ino.mode)&os.ModeSymlink != 0:
+		stat.Size = int64(len(ino.linkname))
+	case os.FileMode(ino.mode).IsRegular():
+		stat.Size = int64(len(ino.data))
+	}
+	if oldpath, ok := w.seenFiles[ino]; ok {
+		stat.Linkname = oldpath
+		stat.Size = 0
+	} else {
+		w.seenFiles[ino] = p
+	}
+	return stat
+}
+
+func (m *MemFS) add(p string, n *memNode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addLocked(p, n)
+}
+
+func (m *MemFS) addLocked(p string, n *memNode) error {
+	parts, err := memFSComponents(p)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return errors.WithStack(&os.PathError{Op: "create", Path: p, Err: syscall.EEXIST})
+	}
+	parent, err := m.lookup(filepath.Join(parts[:len(parts)-1]...))
+	if err != nil {
+		return err
+	}
+	if parent.children == nil {
+		return errors.WithStack(&os.PathError{Op: "create", Path: p, Err: syscall.ENOTDIR})
+	}
+	name := parts[len(parts)-1]
+	if _, ok := parent.children[name]; ok {
+		return errors.WithStack(&os.PathError{Op: "create", Path: p, Err: syscall.EEXIST})
+	}
+	parent.children[name] = n
+	return nil
+}
+
+func (m *MemFS) update(p string, fn func(*memInode)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.lookup(p)
+	if err != nil {
+		return err
+	}
+	fn(n.inode)
+	return nil
+}
+
+// lookup returns the node at p without following symlinks.
+func (m *MemFS) lookup(p string) (*memNode, error) {
+	parts, err := memFSComponents(p)
+	if err != nil {
+		return nil, err
+	}
+	n := m.root
+	for i, part := range parts {
+		if n.children == nil {
+			return nil, errors.WithStack(&os.PathError{Op: "lstat", Path: filepath.Join(parts[:i+1]...), Err: syscall.ENOTDIR})
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return nil, errors.WithStack(&os.PathError{Op: "lstat", Path: filepath.Join(parts[:i+1]...), Err: syscall.ENOENT})
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// resolve returns the node at p following symlinks. Absolute symlink targets
+// are resolved from the root of the MemFS.
+func (m *MemFS) resolve(p string) (*memNode, error) {
+	parts, err := memFSComponents(p)
+	if err != nil {
+		return nil, err
+	}
+	n := m.root
+	var current []string
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "." {
+			continue
+		}
+		if part == ".." {
+			if len(current) > 0 {
+				current = current[:len(current)-1]
+			}
+			n, _ = m.lookup(filepath.Join(current...))
+			continue
+		}
+		if n.children == nil {
+			return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ENOTDIR})
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ENOENT})
+		}
+		if os.FileMode(child.inode.mode)&os.ModeSymlink == 0 {
+			n = child
+			current = append(current, part)
+			continue
+		}
+		links++
+		if links > memFSMaxSymlinks {
+			return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ELOOP})
+		}
+		target := filepath.FromSlash(child.inode.linkname)
+		if filepath.IsAbs(target) || strings.HasPrefix(child.inode.linkname, "/") {
+			current = nil
+			n = m.root
+		}
+		parts = append(strings.FieldsFunc(target, isMemFSSeparator), parts...)
+	}
+	return n, nil
+}
+
+func memFSComponents(p string) ([]string, error) {
+	var parts []string
+	for _, part := range strings.FieldsFunc(p, isMemFSSeparator) {
+		switch part {
+		case ".":
+			continue
+		case "..":
+			return nil, errors.WithStack(&os.PathError{Op: "lookup", Path: p, Err: syscall.EINVAL})
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func isMemFSSeparator(r rune) bool {
+	return r == '/' || r == filepath.Separator
+}
@@ -0,0 +1,310 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// memTree is like tmpDir for a MemFS. Directories have mode 0700 and files
+// mode 0644, like the ones that tmpDir creates.
+func memTree(inp []*change) (*MemFS, error) {
+	m := NewMemFS()
+	for _, c := range inp {
+		if c.kind != ChangeKindAdd {
+			continue
+		}
+		p := filepath.ToSlash(c.path)
+		stat, ok := c.fi.Sys().(*types.Stat)
+		if !ok {
+			return nil, errors.Errorf("invalid change %s", p)
+		}
+		var err error
+		switch {
+		case c.fi.IsDir():
+			err = m.AddDir(p, 0700)
+		case c.fi.Mode()&os.ModeSymlink != 0:
+			err = m.AddSymlink(p, stat.Linkname)
+		case stat.Linkname != "":
+			err = m.AddHardlink(p, stat.Linkname)
+		case c.fi.Mode().IsRegular():
+			err = m.AddFile(p, []byte(c.data), 0644)
+		default:
+			err = errors.Errorf("unsupported change %s", p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func TestMemFSWalk(t *testing.T) {
+	m, err := memTree(changeStream([]string{
+		"ADD foo dir",
+		"ADD foo/a dir",
+		"ADD foo/a/c file data2",
+		"ADD foo/b file data1",
+		"ADD bar symlink foo/b",
+		"ADD baz file >foo/a/c",
+		"ADD foo.txt file data3",
+	}))
+	require.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = m.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`symlink:foo/b bar
+file baz
+dir foo
+dir foo/a
+file foo/a/c >baz
+file foo/b
+file foo.txt
+`), b.String())
+
+	b.Reset()
+	err = m.Walk(context.TODO(), "foo/a", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir foo/a
+file foo/a/c
+`), b.String())
+
+	b.Reset()
+	err = m.Walk(context.TODO(), "missing", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Empty(t, b.String())
+
+	var paths []string
+	err = m.Walk(context.TODO(), "", func(p string, entry os.DirEntry, err error) error {
+		require.NoError(t, err)
+		paths = append(paths, p)
+		if p == filepath.FromSlash("foo/a") {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "baz", "foo", filepath.FromSlash("foo/a"), filepath.FromSlash("foo/b"), "foo.txt"}, paths)
+}
+
+func TestMemFSStat(t *testing.T) {
+	m, err := memTree(changeStream([]string{
+		"ADD foo dir",
+		"ADD foo/a dir",
+		"ADD foo/a/c file data2",
+		"ADD foo/b file data1",
+		"ADD bar symlink foo/b",
+		"ADD baz file >foo/a/c",
+		"ADD foo.txt file data3",
+	}))
+	require.NoError(t, err)
+	mtime := time.Unix(1700000000, 123)
+	require.NoError(t, m.SetOwner("foo/b", 1000, 1001))
+	require.NoError(t, m.SetModTime("foo/b", mtime))
+	require.NoError(t, m.SetXattr("foo/b", "user.foo", []byte("bar")))
+	require.NoError(t, m.AddDevice("dev", os.ModeDevice|os.ModeCharDevice|0666, 1, 3))
+
+	stats := map[string]*types.Stat{}
+	err = m.Walk(context.TODO(), "", func(p string, entry os.DirEntry, err error) error {
+		require.NoError(t, err)
+		fi, err := entry.Info()
+		require.NoError(t, err)
+		stats[p] = fi.Sys().(*types.Stat)
+		return nil
+	})
+	require.NoError(t, err)
+
+	st := stats[filepath.FromSlash("foo/b")]
+	assert.Equal(t, uint32(0644), st.Mode)
+	assert.Equal(t, int64(5), st.Size)
+	assert.Equal(t, uint32(1000), st.Uid)
+	assert.Equal(t, uint32(1001), st.Gid)
+	assert.Equal(t, mtime.UnixNano(), st.ModTime)
+	assert.Equal(t, map[string][]byte{"user.foo": []byte("bar")}, st.Xattrs)
+
+	st = stats["bar"]
+	assert.Equal(t, uint32(os.ModeSymlink|0777), st.Mode)
+	assert.Equal(t, "foo/b", st.Linkname)
+	assert.Equal(t, int64(len("foo/b")), st.Size)
+
+	st = stats["baz"]
+	assert.Equal(t, "", st.Linkname)
+	assert.Equal(t, int64(5), st.Size)
+	st = stats[filepath.FromSlash("foo/a/c")]
+	assert.Equal(t, "baz", st.Linkname)
+	assert.Equal(t, int64(0), st.Size)
+
+	st = stats["dev"]
+	assert.Equal(t, uint32(os.ModeDevice|os.ModeCharDevice|0666), st.Mode)
+	assert.Equal(t, int64(1), st.Devmajor)
+	assert.Equal(t, int64(3), st.Devminor)
+
+	assert.True(t, os.FileMode(stats["foo"].Mode).IsDir())
+	assert.Equal(t, uint32(os.ModeDir|0700), stats[filepath.FromSlash("foo/a")].Mode)
+}
+
+func TestMemFSOpen(t *testing.T) {
+	m, err := memTree(changeStream([]string{
+		"ADD foo dir",
+		"ADD foo/a dir",
+		"ADD foo/a/c file data2",
+		"ADD foo/b file data1",
+		"ADD bar symlink foo/b",
+		"ADD baz file >foo/a/c",
+		"ADD foo.txt file data3",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, m.AddSymlink("abs", "/foo/a/../b"))
+	require.NoError(t, m.AddSymlink("loop", "loop"))
+	require.NoError(t, m.AddSymlink("dot", "./foo/b"))
+	require.NoError(t, m.AddSymlink("foo/dot", "a/./c"))
+
+	for p, expected := range map[string]string{
+		"foo/b":   "data1",
+		"bar":     "data1",
+		"baz":     "data2",
+		"abs":     "data1",
+		"dot":     "data1",
+		"foo/dot": "data2",
+		"foo.txt": "data3",
+	} {
+		rc, err := m.Open(p)
+		require.NoError(t, err, p)
+		dt, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, expected, string(dt), p)
+	}
+
+	_, err = m.Open("foo")
+	require.ErrorIs(t, err, syscall.EISDIR)
+	_, err = m.Open("missing")
+	require.ErrorIs(t, err, syscall.ENOENT)
+	_, err = m.Open("loop")
+	require.ErrorIs(t, err, syscall.ELOOP)
+}
+
+func TestMemFSBuilderErrors(t *testing.T) {
+	m, err := memTree(changeStream([]string{
+		"ADD foo dir",
+		"ADD foo/a dir",
+		"ADD foo/a/c file data2",
+		"ADD foo/b file data1",
+		"ADD bar symlink foo/b",
+		"ADD baz file >foo/a/c",
+		"ADD foo.txt file data3",
+	}))
+	require.NoError(t, err)
+
+	err = m.AddFile("missing/foo", nil, 0644)
+	require.ErrorIs(t, err, syscall.ENOENT)
+	err = m.AddFile("foo.txt/foo", nil, 0644)
+	require.ErrorIs(t, err, syscall.ENOTDIR)
+	err = m.AddDir("foo", 0755)
+	require.ErrorIs(t, err, syscall.EEXIST)
+	err = m.AddFile("../foo", nil, 0644)
+	require.ErrorIs(t, err, syscall.EINVAL)
+	err = m.AddHardlink("link", "foo")
+	require.ErrorIs(t, err, syscall.EPERM)
+	err = m.AddDevice("dev", 0644, 1, 3)
+	require.ErrorIs(t, err, syscall.EINVAL)
+	err = m.SetOwner("missing", 0, 0)
+	require.ErrorIs(t, err, syscall.ENOENT)
+}
+
+func TestMemFSChanges(t *testing.T) {
+	changes := changeStream([]string{
+		"ADD foo dir",
+		"ADD foo/a dir",
+		"ADD foo/a/c file data2",
+		"ADD foo/b file data1",
+		"ADD bar symlink foo/b",
+		"ADD baz file >foo/a/c",
+		"ADD foo.txt file data3",
+	})
+	a, err := memTree(changes)
+	require.NoError(t, err)
+	b, err := memTree(changes)
+	require.NoError(t, err)
+
+	require.NoError(t, b.SetModTime("foo/b", time.Unix(1, 0)))
+	require.NoError(t, b.AddFile("foo/a/d", []byte("data4"), 0644))
+	require.NoError(t, b.AddFile("foo/c", []byte("data5"), 0644))
+
+	var out bytes.Buffer
+	handle := func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		out.WriteString(kind.String() + " " + p + "\n")
+		return nil
+	}
+
+	require.NoError(t, Changes(context.TODO(), a, a, handle))
+	assert.Empty(t, out.String())
+
+	require.NoError(t, Changes(context.TODO(), a, b, handle))
+	assert.Equal(t, filepath.FromSlash(`add foo/a/d
+modify foo/b
+add foo/c
+`), out.String())
+}
+
+func TestMemFSSend(t *testing.T) {
+	forEachReceiveDiskWriter(t, func(t *testing.T, receive receiveTestFunc) {
+		m, err := memTree(changeStream([]string{
+			"ADD foo dir",
+			"ADD foo/a dir",
+			"ADD foo/a/c file data2",
+			"ADD foo/b file data1",
+			"ADD bar symlink foo/b",
+			"ADD baz file >foo/a/c",
+			"ADD foo.txt file data3",
+		}))
+		require.NoError(t, err)
+
+		dest := t.TempDir()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		eg, ctx := errgroup.WithContext(ctx)
+		s1, s2 := sockPairProto(ctx)
+
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, m, nil)
+		})
+		eg.Go(func() error {
+			return receive(ctx, s2, dest, ReceiveOpt{})
+		})
+		require.NoError(t, eg.Wait())
+
+		b := &bytes.Buffer{}
+		require.NoError(t, Walk(context.Background(), dest, nil, bufWalk(b)))
+		assert.Equal(t, filepath.FromSlash(`symlink:foo/b bar
+file baz
+dir foo
+dir foo/a
+file foo/a/c >baz
+file foo/b
+file foo.txt
+`), b.String())
+
+		dt, err := os.ReadFile(filepath.Join(dest, "foo/a/c"))
+		require.NoError(t, err)
+		assert.Equal(t, "data2", string(dt))
+		dt, err = os.ReadFile(filepath.Join(dest, "foo.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "data3", string(dt))
+	})
+}
@@ -0,0 +1,133 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// NormalizeOpt controls the metadata that NewNormalizedFS rewrites.
+type NormalizeOpt struct {
+	// ModTime replaces the modification time of every entry when set.
+	ModTime *time.Time
+	// ClampModTime only replaces the modification times later than ModTime,
+	// as done for SOURCE_DATE_EPOCH.
+	ClampModTime bool
+	// Uid and Gid replace the owner of every entry when set.
+	Uid *uint32
+	Gid *uint32
+	// NormalizeMode sets the permission bits of directories and of entries
+	// with any executable bit to 0755, and of other entries to 0644. The
+	// setuid, setgid and sticky bits are cleared. Symlinks are not changed.
+	NormalizeMode bool
+	// StripXattrs removes the xattrs of every entry, except the ones listed
+	// in KeepXattrs.
+	StripXattrs bool
+	KeepXattrs  []string
+	// ExpandHardlinks reports hardlinks as regular files with their own copy
+	// of the contents.
+	ExpandHardlinks bool
+}
+
+// NewNormalizedFS returns an FS that reports the entries of fs with their
+// metadata normalized by opt, so that the same tree produces the same output
+// on different machines regardless of checkout times, users and umask.
+func NewNormalizedFS(fs FS, opt *NormalizeOpt) FS {
+	if opt == nil {
+		opt = &NormalizeOpt{}
+	}
+	if _, ok := fs.(ReaderAtFS); ok {
+		return &normalizedReaderAtFS{&normalizedFS{fs: fs, opt: *opt}}
+	}
+	return &normalizedFS{fs: fs, opt: *opt}
+}
+
+type normalizedFS struct {
+	fs  FS
+	opt NormalizeOpt
+}
+
+func (fs *normalizedFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	sizes := map[string]int64{}
+	return fs.fs.Walk(ctx, target, func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return fn(p, entry, err)
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+		stat = stat.Clone()
+
+		if fs.opt.ExpandHardlinks && os.FileMode(stat.Mode).IsRegular() {
+			if stat.Linkname != "" {
+				stat.Size = sizes[stat.Linkname]
+				stat.Linkname = ""
+			} else {
+				sizes[p] = stat.Size
+			}
+		}
+		fs.normalize(stat)
+		return fn(p, &DirEntryInfo{Stat: stat}, nil)
+	})
+}
+
+func (fs *normalizedFS) normalize(stat *types.Stat) {
+	if t := fs.opt.ModTime; t != nil {
+		if !fs.opt.ClampModTime || stat.ModTime > t.UnixNano() {
+			stat.ModTime = t.UnixNano()
+		}
+	}
+	if fs.opt.Uid != nil {
+		stat.Uid = *fs.opt.Uid
+	}
+	if fs.opt.Gid != nil {
+		stat.Gid = *fs.opt.Gid
+	}
+
+	mode := os.FileMode(stat.Mode)
+	if fs.opt.NormalizeMode && mode&os.ModeSymlink == 0 {
+		perm := os.FileMode(0644)
+		if mode.IsDir() || mode&0111 != 0 {
+			perm = 0755
+		}
+		mode &^= os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+		stat.Mode = uint32(mode | perm)
+	}
+
+	if fs.opt.StripXattrs {
+		for k := range stat.Xattrs {
+			if !slices.Contains(fs.opt.KeepXattrs, k) {
+				delete(stat.Xattrs, k)
+			}
+		}
+		if len(stat.Xattrs) == 0 {
+			stat.Xattrs = nil
+		}
+	}
+}
+
+func (fs *normalizedFS) Open(p string) (io.ReadCloser, error) {
+	return fs.fs.Open(p)
+}
+
+// normalizedReaderAtFS is a normalizedFS over an FS that implements
+// ReaderAtFS.
+type normalizedReaderAtFS struct {
+	*normalizedFS
+}
+
+func (fs *normalizedReaderAtFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	return fs.fs.(ReaderAtFS).OpenReaderAt(p)
+}
@@ -0,0 +1,113 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestNormalizedFS(t *testing.T) {
+	epoch := time.Unix(1700000000, 0)
+	m := NewMemFS()
+	require.NoError(t, m.AddDir("a", 0700))
+	require.NoError(t, m.AddFile("a/exec", []byte("data1"), 0700|os.ModeSetuid))
+	require.NoError(t, m.AddFile("a/file", []byte("data2"), 0600))
+	require.NoError(t, m.AddSymlink("a/link", "file"))
+	require.NoError(t, m.AddHardlink("b", "a/file"))
+	require.NoError(t, m.SetXattr("a/file", "user.keep", []byte("1")))
+	require.NoError(t, m.SetXattr("a/file", "user.drop", []byte("2")))
+	require.NoError(t, m.SetXattr("a/exec", "user.drop", []byte("2")))
+	require.NoError(t, m.SetOwner("a/file", 1000, 1000))
+	require.NoError(t, m.SetModTime("a/file", epoch.Add(-time.Hour)))
+	require.NoError(t, m.SetModTime("a/exec", epoch.Add(time.Hour)))
+
+	uid, gid := uint32(0), uint32(0)
+	fs := NewNormalizedFS(m, &NormalizeOpt{
+		ModTime:         &epoch,
+		ClampModTime:    true,
+		Uid:             &uid,
+		Gid:             &gid,
+		NormalizeMode:   true,
+		StripXattrs:     true,
+		KeepXattrs:      []string{"user.keep"},
+		ExpandHardlinks: true,
+	})
+
+	stats := indexedWalkStats(t, fs)
+	assert.Equal(t, uint32(os.ModeDir|0755), stats["a"].Mode)
+	assert.Equal(t, uint32(0755), stats["a/exec"].Mode)
+	assert.Equal(t, epoch.UnixNano(), stats["a/exec"].ModTime)
+	assert.Nil(t, stats["a/exec"].Xattrs)
+
+	assert.Equal(t, &types.Stat{
+		Path:    filepath.FromSlash("a/file"),
+		Mode:    0644,
+		Size:    5,
+		ModTime: epoch.Add(-time.Hour).UnixNano(),
+		Xattrs:  map[string][]byte{"user.keep": []byte("1")},
+	}, stats["a/file"])
+	assert.Equal(t, uint32(os.ModeSymlink|0777), stats["a/link"].Mode)
+
+	assert.Equal(t, "", stats["b"].Linkname)
+	assert.Equal(t, int64(5), stats["b"].Size)
+}
+
+func TestNormalizedFSWriteTar(t *testing.T) {
+	epoch := time.Unix(1700000000, 0)
+	uid, gid := uint32(0), uint32(0)
+	opt := &NormalizeOpt{
+		ModTime:         &epoch,
+		Uid:             &uid,
+		Gid:             &gid,
+		NormalizeMode:   true,
+		StripXattrs:     true,
+		ExpandHardlinks: true,
+	}
+
+	d1, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file data1",
+		"ADD a/c file >a/b",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d1)
+	require.NoError(t, os.Chmod(filepath.Join(d1, "a/b"), 0600))
+
+	d2, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file data1",
+		"ADD a/c file data1",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d2)
+	require.NoError(t, os.Chmod(filepath.Join(d2, "a"), 0755))
+	require.NoError(t, os.Chtimes(filepath.Join(d2, "a/b"), time.Now(), epoch.Add(time.Hour)))
+
+	var tars [][]byte
+	for _, d := range []string{d1, d2} {
+		fs, err := NewFS(d)
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		require.NoError(t, WriteTar(context.TODO(), NewNormalizedFS(fs, opt), buf))
+		tars = append(tars, buf.Bytes())
+	}
+	require.Equal(t, tars[0], tars[1])
+
+	// the sources themselves differ
+	var raw [][]byte
+	for _, d := range []string{d1, d2} {
+		fs, err := NewFS(d)
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		require.NoError(t, WriteTar(context.TODO(), fs, buf))
+		raw = append(raw, buf.Bytes())
+	}
+	require.NotEqual(t, raw[0], raw[1])
+}
@@ -0,0 +1,95 @@
+package fsutil
+
+import (
+	gofs "io/fs"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// errMountPoint is returned by the readDir function of a parallel walk for a
+// directory that is not walked because of FSOpt.OneFileSystem.
+var errMountPoint = errors.New("mount point")
+
+// mountFilter finds the mount points that are not walked because of
+// FSOpt.OneFileSystem. A nil filter walks into all directories.
+type mountFilter struct {
+	dev    uint64
+	notify func(string)
+}
+
+// newMountFilter returns the filter for a walk of an FS whose root has the
+// info returned by lstatRoot, or nil if mount points are walked into.
+func newMountFilter(opt FSOpt, lstatRoot func() (os.FileInfo, error)) (*mountFilter, error) {
+	if !opt.OneFileSystem {
+		return nil, nil
+	}
+	fi, err := lstatRoot()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dev, _, _, ok := statChange(fi)
+	if !ok {
+		return nil, nil
+	}
+	return &mountFilter{dev: dev, notify: opt.NotifySkippedMount}, nil
+}
+
+// isMount reports whether the directory with info fi is on another device
+// than the root of the FS.
+func (m *mountFilter) isMount(fi os.FileInfo) bool {
+	if m == nil || !fi.IsDir() {
+		return false
+	}
+	dev, _, _, ok := statChange(fi)
+	return ok && dev != m.dev
+}
+
+// skip reports the mount point at p as skipped.
+func (m *mountFilter) skip(p string) {
+	if m.notify != nil {
+		m.notify(p)
+	}
+}
+
+// skipDir reports whether the walk should not walk into the directory at p
+// with info fi, and reports the mount point if so.
+func (m *mountFilter) skipDir(p string, fi os.FileInfo) bool {
+	if !m.isMount(fi) {
+		return false
+	}
+	m.skip(p)
+	return true
+}
+
+// parallelReadDir wraps the readDir function of a parallel walk to return
+// errMountPoint for mount points. lstat returns the info of a native
+// relative path.
+func (m *mountFilter) parallelReadDir(readDir func(string) ([]gofs.DirEntry, error), lstat func(string) (os.FileInfo, error)) func(string) ([]gofs.DirEntry, error) {
+	if m == nil {
+		return readDir
+	}
+	return func(dir string) ([]gofs.DirEntry, error) {
+		if dir != "" {
+			if fi, err := lstat(dir); err == nil && m.isMount(fi) {
+				return nil, errMountPoint
+			}
+		}
+		return readDir(dir)
+	}
+}
+
+// parallelWalkFunc wraps the WalkDirFunc of a parallel walk to report the
+// mount points returned by parallelReadDir and walk them as empty directories.
+func (m *mountFilter) parallelWalkFunc(fn gofs.WalkDirFunc) gofs.WalkDirFunc {
+	if m == nil {
+		return fn
+	}
+	return func(p string, entry gofs.DirEntry, err error) error {
+		if err == errMountPoint {
+			m.skip(p)
+			return nil
+		}
+		return fn(p, entry, err)
+	}
+}
@@ -0,0 +1,97 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// mountTmpfs mounts a tmpfs at dir for the duration of the test.
+func mountTmpfs(t *testing.T, dir string) {
+	if err := unix.Mount("tmpfs", dir, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mounting tmpfs is not permitted: %v", err)
+	}
+	t.Cleanup(func() {
+		unix.Unmount(dir, unix.MNT_DETACH)
+	})
+}
+
+func TestOneFileSystem(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file data1",
+		"ADD m dir",
+		"ADD z file data2",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	mountTmpfs(t, filepath.Join(d, "m"))
+	require.NoError(t, os.Mkdir(filepath.Join(d, "m/c"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "m/c/d"), []byte("data3"), 0644))
+
+	osroot, err := os.OpenRoot(d)
+	require.NoError(t, err)
+	root := NewRoot(osroot)
+	defer root.Close()
+
+	for name, newFS := range map[string]func(*FSOpt) FS{
+		"fs": func(opt *FSOpt) FS {
+			fs, err := NewFSWithOpt(d, opt)
+			require.NoError(t, err)
+			return fs
+		},
+		"parallel": func(opt *FSOpt) FS {
+			opt.Parallelism = 4
+			fs, err := NewFSWithOpt(d, opt)
+			require.NoError(t, err)
+			return fs
+		},
+		"rootfs": func(opt *FSOpt) FS {
+			return NewRootFSWithOpt(root, opt)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			err := newFS(&FSOpt{}).Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, `dir a
+file a/b
+dir m
+dir m/c
+file m/c/d
+file z
+`, b.String())
+
+			var skipped []string
+			opt := &FSOpt{
+				OneFileSystem: true,
+				NotifySkippedMount: func(p string) {
+					skipped = append(skipped, p)
+				},
+			}
+			b.Reset()
+			err = newFS(opt).Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, `dir a
+file a/b
+dir m
+file z
+`, b.String())
+			assert.Equal(t, []string{"m"}, skipped)
+
+			skipped = nil
+			b.Reset()
+			err = newFS(opt).Walk(context.TODO(), "m", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, "dir m\n", b.String())
+			assert.Equal(t, []string{"m"}, skipped)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+	whiteoutOpaqueDir  = whiteoutMetaPrefix + ".opq"
+)
+
+var overlayOpaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// NewOverlayFS returns an FS presenting the merged view of layers. Layers are
+// ordered from the lowest to the uppermost, as in an OCI image manifest, and
+// entries of upper layers shadow the same paths in lower ones.
+//
+// Whiteouts are applied to lower layers and not shown in the merged view.
+// Both the OCI form, a ".wh.<name>" file or a ".wh..wh..opq" file marking its
+// directory opaque, and the overlayfs form, a 0/0 character device or an
+// opaque xattr on a directory, are supported.
+//
+// The layers are indexed on first use and later changes to them are not
+// reflected in the merged view.
+func NewOverlayFS(layers ...FS) FS {
+	fs := &overlayFS{layers: layers}
+	for _, l := range layers {
+		if _, ok := l.(ReaderAtFS); !ok {
+			return fs
+		}
+	}
+	return &overlayReaderAtFS{fs}
+}
+
+type overlayFS struct {
+	layers []FS
+
+	mu      sync.Mutex
+	indexed bool
+	entries map[string]*overlayEntry
+	paths   []string
+}
+
+type overlayEntry struct {
+	stat  *types.Stat
+	layer int
+	// inode identifies the hardlink group of the entry
+	inode overlayInode
+}
+
+type overlayInode struct {
+	layer int
+	path  string
+}
+
+// overlayLayer is the indexed contents of a single layer.
+type overlayLayer struct {
+	entries   map[string]*types.Stat
+	order     []string
+	whiteouts map[string]struct{}
+	opaque    map[string]struct{}
+}
+
+func (fs *overlayFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	if err := fs.index(ctx); err != nil {
+		return err
+	}
+
+	seenFiles := map[overlayInode]string{}
+	return walkSorted(ctx, fs.paths, target, func(p string) *types.Stat {
+		e := fs.entries[p]
+		stat := e.stat.Clone()
+		if !stat.IsDir() && e.inode.path != "" {
+			if oldpath, ok := seenFiles[e.inode]; ok {
+				stat.Linkname = oldpath
+				stat.Size = 0
+			} else {
+				seenFiles[e.inode] = p
+			}
+		}
+		return stat
+	}, fn)
+}
+
+func (fs *overlayFS) Open(p string) (io.ReadCloser, error) {
+	if err := fs.index(context.TODO()); err != nil {
+		return nil, err
+	}
+	p = filepath.FromSlash(cleanRootFSTarget(p))
+	e, ok := fs.entries[p]
+	if !ok {
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ENOENT})
+	}
+	return fs.layers[e.layer].Open(p)
+}
+
+// overlayReaderAtFS is an overlayFS where every layer implements ReaderAtFS.
+type overlayReaderAtFS struct {
+	*overlayFS
+}
+
+func (fs *overlayReaderAtFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	if err := fs.index(context.TODO()); err != nil {
+		return nil, err
+	}
+	p = filepath.FromSlash(cleanRootFSTarget(p))
+	e, ok := fs.entries[p]
+	if !ok {
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ENOENT})
+	}
+	return fs.layers[e.layer].(ReaderAtFS).OpenReaderAt(p)
+}
+
+func (fs *overlayFS) index(ctx context.Context) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.indexed {
+		return nil
+	}
+
+	layers := make([]*overlayLayer, len(fs.layers))
+	for i, l := range fs.layers {
+		layer, err := indexOverlayLayer(ctx, l)
+		if err != nil {
+			return errors.Wrapf(err, "failed to index layer %d", i)
+		}
+		layers[i] = layer
+	}
+
+	entries := map[string]*overlayEntry{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		for _, p := range layers[i].order {
+			if _, ok := entries[p]; ok {
+				continue
+			}
+			if overlayHidden(layers[i+1:], p) {
+				continue
+			}
+			stat := layers[i].entries[p]
+			e := &overlayEntry{stat: stat, layer: i}
+			if !stat.IsDir() && os.FileMode(stat.Mode)&os.ModeSymlink == 0 {
+				e.inode = overlayInode{layer: i, path: p}
+				if stat.Linkname != "" {
+					// hardlink to an entry seen earlier in the same layer
+					e.inode.path = stat.Linkname
+					if target, ok := layers[i].entries[stat.Linkname]; ok {
+						stat.Size = target.Size
+					}
+					stat.Linkname = ""
+				}
+			}
+			entries[p] = e
+		}
+	}
+
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	slices.SortFunc(paths, ComparePath)
+
+	fs.entries = entries
+	fs.paths = paths
+	fs.indexed = true
+	return nil
+}
+
+// overlayHidden reports whether p from a lower layer is hidden by a whiteout,
+// an opaque directory or a non-directory parent in any of the upper layers.
+// Entries of upper layers at p itself are handled by the caller.
+func overlayHidden(upper []*overlayLayer, p string) bool {
+	for _, l := range upper {
+		for dir := filepath.Dir(p); dir != "."; dir = filepath.Dir(dir) {
+			if _, ok := l.opaque[dir]; ok {
+				return true
+			}
+			if _, ok := l.whiteouts[dir]; ok {
+				return true
+			}
+			if st, ok := l.entries[dir]; ok && !st.IsDir() {
+				return true
+			}
+		}
+		if _, ok := l.opaque[""]; ok {
+			return true
+		}
+		if _, ok := l.whiteouts[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func indexOverlayLayer(ctx context.Context, fs FS) (*overlayLayer, error) {
+	l := &overlayLayer{
+		entries:   map[string]*types.Stat{},
+		whiteouts: map[string]struct{}{},
+		opaque:    map[string]struct{}{},
+	}
+	err := fs.Walk(ctx, "", func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+
+		dir, base := filepath.Dir(p), filepath.Base(p)
+		if dir == "." {
+			dir = ""
+		}
+		switch {
+		case base == whiteoutOpaqueDir:
+			l.opaque[dir] = struct{}{}
+			return nil
+		case strings.HasPrefix(base, whiteoutMetaPrefix):
+			// other metadata files, e.g. AUFS hardlink directories
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(base, whiteoutPrefix):
+			l.whiteouts[filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = struct{}{}
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case isOverlayWhiteout(stat):
+			l.whiteouts[p] = struct{}{}
+			return nil
+		}
+
+		if stat.IsDir() {
+			for _, k := range overlayOpaqueXattrs {
+				if string(stat.Xattrs[k]) == "y" {
+					l.opaque[p] = struct{}{}
+				}
+				delete(stat.Xattrs, k)
+			}
+		}
+		l.entries[p] = stat
+		l.order = append(l.order, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func isOverlayWhiteout(stat *types.Stat) bool {
+	mode := os.FileMode(stat.Mode)
+	return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice != 0 && stat.Devmajor == 0 && stat.Devminor == 0
+}
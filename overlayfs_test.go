@@ -0,0 +1,127 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestOverlayFS(t *testing.T) {
+	l0 := NewMemFS()
+	require.NoError(t, l0.AddDir("a", 0755))
+	require.NoError(t, l0.AddFile("a/x", []byte("x0"), 0644))
+	require.NoError(t, l0.AddFile("a/y", []byte("y0"), 0644))
+	require.NoError(t, l0.AddDir("b", 0755))
+	require.NoError(t, l0.AddFile("b/old", []byte("old"), 0644))
+	require.NoError(t, l0.AddFile("c", []byte("c0"), 0644))
+	require.NoError(t, l0.AddDir("d", 0755))
+	require.NoError(t, l0.AddFile("d/z", []byte("z0"), 0644))
+	require.NoError(t, l0.AddDir("f", 0755))
+	require.NoError(t, l0.AddFile("f/g", []byte("g0"), 0644))
+	require.NoError(t, l0.AddFile("h1", []byte("h0"), 0644))
+	require.NoError(t, l0.AddHardlink("h2", "h1"))
+
+	l1 := NewMemFS()
+	require.NoError(t, l1.AddDir("a", 0700))
+	require.NoError(t, l1.AddFile("a/.wh.x", nil, 0644))
+	require.NoError(t, l1.AddDir("b", 0755))
+	require.NoError(t, l1.AddFile("b/.wh..wh..opq", nil, 0644))
+	require.NoError(t, l1.AddFile("b/new", []byte("new"), 0644))
+	require.NoError(t, l1.AddDir("c", 0755))
+	require.NoError(t, l1.AddFile("c/f", []byte("f1"), 0644))
+	require.NoError(t, l1.AddDevice("d", os.ModeDevice|os.ModeCharDevice, 0, 0))
+	require.NoError(t, l1.AddSymlink("e", "c/f"))
+
+	l2 := NewMemFS()
+	require.NoError(t, l2.AddDir("a", 0755))
+	require.NoError(t, l2.AddFile("a/y", []byte("y2"), 0600))
+	require.NoError(t, l2.AddDir("f", 0755))
+	require.NoError(t, l2.SetXattr("f", "trusted.overlay.opaque", []byte("y")))
+	require.NoError(t, l2.AddFile("f/new", nil, 0644))
+	require.NoError(t, l2.AddFile(".wh.h1", nil, 0644))
+
+	fs := NewOverlayFS(l0, l1, l2)
+
+	b := &bytes.Buffer{}
+	err := fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir a
+file a/y
+dir b
+file b/new
+dir c
+file c/f
+symlink:c/f e
+dir f
+file f/new
+file h2
+`), b.String())
+
+	b.Reset()
+	err = fs.Walk(context.TODO(), "c", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir c
+file c/f
+`), b.String())
+
+	stats := map[string]*types.Stat{}
+	err = fs.Walk(context.TODO(), "", func(p string, entry os.DirEntry, err error) error {
+		require.NoError(t, err)
+		fi, err := entry.Info()
+		require.NoError(t, err)
+		stats[p] = fi.Sys().(*types.Stat)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(os.ModeDir|0755), stats["a"].Mode)
+	assert.Equal(t, uint32(0600), stats[filepath.FromSlash("a/y")].Mode)
+	assert.Empty(t, stats["f"].Xattrs)
+	// the hardlink source was removed, the link keeps the contents
+	assert.Equal(t, "", stats["h2"].Linkname)
+	assert.Equal(t, int64(2), stats["h2"].Size)
+
+	for p, expected := range map[string]string{
+		"a/y":   "y2",
+		"b/new": "new",
+		"c/f":   "f1",
+		"h2":    "h0",
+	} {
+		rc, err := fs.Open(filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		dt, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, expected, string(dt), p)
+	}
+
+	for _, p := range []string{"a/x", "b/old", "d/z", "f/g", "h1"} {
+		_, err := fs.Open(filepath.FromSlash(p))
+		require.ErrorIs(t, err, syscall.ENOENT, p)
+	}
+}
+
+func TestOverlayFSHardlinks(t *testing.T) {
+	l0 := NewMemFS()
+	require.NoError(t, l0.AddFile("a", []byte("data1"), 0644))
+	require.NoError(t, l0.AddHardlink("b", "a"))
+	require.NoError(t, l0.AddHardlink("c", "a"))
+
+	l1 := NewMemFS()
+	require.NoError(t, l1.AddFile("a", []byte("data22"), 0644))
+
+	b := &bytes.Buffer{}
+	err := NewOverlayFS(l0, l1).Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, `file a
+file b
+file c >b
+`, b.String())
+}
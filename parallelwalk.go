@@ -0,0 +1,235 @@
+package fsutil
+
+import (
+	"context"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// parallelWalkBatch is the number of entries of a directory that are stated
+// by a single worker.
+const parallelWalkBatch = 64
+
+// parallelWalk walks target reading directories and stating entries on a
+// pool of workers. fn is still called from the calling goroutine, in the same
+// order as a sequential walk.
+//
+// While the entries of a directory are passed to fn, the listings of its
+// subdirectories are read ahead, so the memory use is bounded by the entries
+// of the directories on the current path and their siblings.
+//
+// readDir returns the entries of the directory at the native relative path
+// dir, sorted by name, with the root as an empty string. lstat returns the
+// stat of a native relative path without hardlink information.
+func parallelWalk(ctx context.Context, workers int, readDir func(dir string) ([]gofs.DirEntry, error), lstat func(p string) (os.FileInfo, *types.Stat, error), target string, fn gofs.WalkDirFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &parallelWalker{
+		readDir:   readDir,
+		lstat:     lstat,
+		sem:       make(chan struct{}, workers),
+		seenFiles: make(map[uint64]string),
+	}
+	w.fn = func(p string, entry gofs.DirEntry, err error) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := fn(p, entry, err); err != nil {
+			if isNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		return nil
+	}
+	defer func() {
+		cancel()
+		w.wg.Wait()
+	}()
+
+	var err error
+	if target = cleanFSPath(target); target == "" {
+		err = w.walkDir(ctx, "", nil, w.start(ctx, ""))
+	} else {
+		fi, stat, lstatErr := lstat(target)
+		switch {
+		case lstatErr != nil:
+			err = w.fn(target, nil, lstatErr)
+		case fi.IsDir():
+			err = w.walk(ctx, &parallelWalkEntry{path: target, fi: fi, stat: stat}, w.start(ctx, target))
+		default:
+			err = w.walk(ctx, &parallelWalkEntry{path: target, fi: fi, stat: stat}, nil)
+		}
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+type parallelWalker struct {
+	readDir func(string) ([]gofs.DirEntry, error)
+	lstat   func(string) (os.FileInfo, *types.Stat, error)
+	fn      gofs.WalkDirFunc
+
+	sem       chan struct{}
+	wg        sync.WaitGroup
+	seenFiles map[uint64]string
+}
+
+type parallelWalkDir struct {
+	done    chan struct{}
+	entries []*parallelWalkEntry
+	err     error
+}
+
+type parallelWalkEntry struct {
+	path  string
+	entry gofs.DirEntry
+	fi    os.FileInfo
+	stat  *types.Stat
+	err   error
+}
+
+// walk calls fn for e and, if it is a directory, for everything under it.
+func (w *parallelWalker) walk(ctx context.Context, e *parallelWalkEntry, dir *parallelWalkDir) error {
+	if e.err != nil {
+		return w.fn(e.path, e.entry, e.err)
+	}
+	if !e.fi.IsDir() {
+		if oldpath, ok := markHardlink(e.fi, filepath.ToSlash(e.path), w.seenFiles); ok {
+			e.stat.Linkname = oldpath
+		}
+	}
+	entry := &DirEntryInfo{Stat: e.stat}
+	if err := w.fn(e.path, entry, nil); err != nil || dir == nil {
+		return err
+	}
+	if err := w.walkDir(ctx, e.path, entry, dir); err != nil && err != filepath.SkipDir {
+		return err
+	}
+	return nil
+}
+
+// walkDir calls fn for everything under the directory p, which was already
+// passed to fn as entry.
+func (w *parallelWalker) walkDir(ctx context.Context, p string, entry gofs.DirEntry, dir *parallelWalkDir) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-dir.done:
+	}
+	if dir.err != nil {
+		if p == "" {
+			return dir.err
+		}
+		return w.fn(p, entry, dir.err)
+	}
+
+	// read the subdirectories ahead, the reads are cancelled if they are
+	// skipped or the walk leaves this directory early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	subdirs := make([]*parallelWalkDir, len(dir.entries))
+	for i, e := range dir.entries {
+		if e.err == nil && e.fi.IsDir() {
+			subdirs[i] = w.start(ctx, e.path)
+		}
+	}
+
+	for i, e := range dir.entries {
+		if err := w.walk(ctx, e, subdirs[i]); err != nil {
+			if err == filepath.SkipDir && (e.fi == nil || !e.fi.IsDir()) {
+				// skip the rest of the directory
+				return nil
+			}
+			if err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// start reads the directory p and stats its entries in the background.
+func (w *parallelWalker) start(ctx context.Context, p string) *parallelWalkDir {
+	dir := &parallelWalkDir{done: make(chan struct{})}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer close(dir.done)
+
+		var entries []gofs.DirEntry
+		err := w.do(ctx, func() (err error) {
+			entries, err = w.readDir(p)
+			return err
+		})
+		if err != nil {
+			dir.err = err
+			return
+		}
+
+		dir.entries = make([]*parallelWalkEntry, 0, len(entries))
+		for _, entry := range entries {
+			dir.entries = append(dir.entries, &parallelWalkEntry{
+				path:  filepath.Join(p, entry.Name()),
+				entry: entry,
+			})
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < len(dir.entries); i += parallelWalkBatch {
+			batch := dir.entries[i:min(i+parallelWalkBatch, len(dir.entries))]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := w.do(ctx, func() error {
+					for _, e := range batch {
+						e.fi, e.stat, e.err = w.lstat(e.path)
+					}
+					return nil
+				})
+				if err != nil {
+					for _, e := range batch {
+						e.err = err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		// entries removed after the directory was read are skipped, like
+		// the sequential walk does
+		dir.entries = filterParallelWalkEntries(dir.entries)
+	}()
+	return dir
+}
+
+// do runs f on one of the workers.
+func (w *parallelWalker) do(ctx context.Context, f func() error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case w.sem <- struct{}{}:
+	}
+	defer func() {
+		<-w.sem
+	}()
+	return f()
+}
+
+func filterParallelWalkEntries(entries []*parallelWalkEntry) []*parallelWalkEntry {
+	out := entries[:0]
+	for _, e := range entries {
+		if e.err != nil && isNotExist(e.err) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package fsutil
+
+import (
+	"context"
+	"fmt"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestParallelWalk(t *testing.T) {
+	changes := []string{
+		"ADD a dir",
+		"ADD a/b dir",
+		"ADD a/b/c file data1",
+		"ADD a/d symlink ../e",
+		"ADD a.txt file data2",
+		"ADD e dir",
+		"ADD e/f file >a/b/c",
+		"ADD g file data3",
+	}
+	for i := range parallelWalkBatch*2 + 5 {
+		changes = append(changes, fmt.Sprintf("ADD e/f%03d file data", i))
+	}
+	for i := range 20 {
+		changes = append(changes, fmt.Sprintf("ADD h%02d dir", i), fmt.Sprintf("ADD h%02d/x file data", i))
+	}
+	d, err := tmpDir(changeStream(changes))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	osroot, err := os.OpenRoot(d)
+	require.NoError(t, err)
+	defer osroot.Close()
+	root := NewRoot(osroot)
+	defer root.Close()
+
+	newFS := func(opt *FSOpt) FS {
+		fs, err := NewFSWithOpt(d, opt)
+		require.NoError(t, err)
+		return fs
+	}
+
+	for _, tc := range []struct {
+		name       string
+		sequential FS
+		parallel   FS
+		targets    []string
+	}{
+		{"fs", newFS(nil), newFS(&FSOpt{Parallelism: 4}), []string{filepath.FromSlash("a/d")}},
+		// io/fs.WalkDir follows a symlink passed as the target
+		{"rootfs", NewRootFS(root), NewRootFSWithOpt(root, &FSOpt{Parallelism: 4}), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, target := range append([]string{"", "a", "/e", "g", "missing"}, tc.targets...) {
+				for _, skip := range []string{"", "a", filepath.FromSlash("e/f010"), "h05"} {
+					expected := recordWalk(t, tc.sequential, target, skip)
+					actual := recordWalk(t, tc.parallel, target, skip)
+					require.Equal(t, expected, actual, "target %q skip %q", target, skip)
+				}
+			}
+
+			var paths []string
+			err := tc.parallel.Walk(context.TODO(), "", func(p string, entry gofs.DirEntry, err error) error {
+				require.NoError(t, err)
+				paths = append(paths, p)
+				if p == filepath.FromSlash("a/b") {
+					return filepath.SkipAll
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", filepath.FromSlash("a/b")}, paths)
+
+			errTest := errors.New("test error")
+			err = tc.parallel.Walk(context.TODO(), "", func(p string, entry gofs.DirEntry, err error) error {
+				if p == "e" {
+					return errTest
+				}
+				return nil
+			})
+			require.ErrorIs(t, err, errTest)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			err = tc.parallel.Walk(ctx, "", func(p string, entry gofs.DirEntry, err error) error {
+				cancel()
+				return nil
+			})
+			require.ErrorIs(t, err, context.Canceled)
+		})
+	}
+}
+
+// recordWalk walks target in fs and returns the stats of the walked paths.
+// Returning SkipDir from the callback at skip skips a directory or the rest
+// of the parent directory of a file.
+func recordWalk(t *testing.T, fs FS, target, skip string) []*types.Stat {
+	var out []*types.Stat
+	err := fs.Walk(context.TODO(), target, func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := entry.Info()
+		require.NoError(t, err)
+		out = append(out, fi.Sys().(*types.Stat))
+		if p == skip {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return out
+}
@@ -0,0 +1,257 @@
+package fsutil
+
+import (
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+	"github.com/pkg/errors"
+)
+
+// PatternMode controls the syntax of the include and exclude patterns of
+// FilterOpt.
+type PatternMode int
+
+const (
+	// PatternModeGlob patterns use the .dockerignore syntax of
+	// github.com/moby/patternmatcher.
+	PatternModeGlob PatternMode = iota
+	// PatternModeRegexp patterns are regular expressions that need to match
+	// the whole slash separated path. Like with globs, a pattern that matches
+	// a directory also matches everything inside it, and a leading "!" marks
+	// an exception.
+	PatternModeRegexp
+)
+
+func (m PatternMode) String() string {
+	switch m {
+	case PatternModeGlob:
+		return "glob"
+	case PatternModeRegexp:
+		return "regexp"
+	}
+	return "unknown"
+}
+
+// filterMatcher matches paths against the include or exclude patterns of a
+// FilterOpt.
+type filterMatcher struct {
+	// glob is the matcher for PatternModeGlob
+	glob *patternmatcher.PatternMatcher
+	// regexps are the patterns for PatternModeRegexp
+	regexps  []*regexp.Regexp
+	foldCase bool
+	patterns []filterMatcherPattern
+}
+
+// filterMatcherPattern is a single pattern of a filterMatcher.
+type filterMatcherPattern struct {
+	exclusion bool
+	// pattern is the pattern without the "!" of exclusions
+	pattern string
+	// prefix is the literal prefix of all the paths that the pattern matches,
+	// with native separators. If literal is set, the pattern only matches
+	// prefix and the paths inside it.
+	prefix  string
+	literal bool
+}
+
+// filterMatchInfo tracks the matches of the parent directory while walking.
+type filterMatchInfo struct {
+	glob          patternmatcher.MatchInfo
+	parentMatched []bool
+}
+
+func newFilterMatcher(patterns []string, mode PatternMode, foldCase bool) (*filterMatcher, error) {
+	m := &filterMatcher{foldCase: foldCase}
+	switch mode {
+	case PatternModeGlob:
+		if foldCase {
+			lower := make([]string, len(patterns))
+			for i, p := range patterns {
+				lower[i] = strings.ToLower(p)
+			}
+			patterns = lower
+		}
+		pm, err := patternmatcher.New(patterns)
+		if err != nil {
+			return nil, err
+		}
+		patternChars := "*[]?^"
+		if filepath.Separator != '\\' {
+			patternChars += `\`
+		}
+		for _, p := range pm.Patterns() {
+			prefix := patternWithoutTrailingGlob(p)
+			m.patterns = append(m.patterns, filterMatcherPattern{
+				exclusion: p.Exclusion(),
+				pattern:   p.String(),
+				prefix:    prefix,
+				literal:   !strings.ContainsAny(prefix, patternChars),
+			})
+		}
+		m.glob = pm
+	case PatternModeRegexp:
+		for _, p := range patterns {
+			if strings.TrimSpace(p) == "" {
+				continue
+			}
+			mp := filterMatcherPattern{pattern: p}
+			if p[0] == '!' {
+				if len(p) == 1 {
+					return nil, errors.New("illegal exclusion pattern: \"!\"")
+				}
+				mp.exclusion = true
+				mp.pattern = p[1:]
+			}
+			flags := syntax.Perl
+			if foldCase {
+				flags |= syntax.FoldCase
+			}
+			re, err := syntax.Parse(mp.pattern, flags)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid pattern %q", p)
+			}
+			prefix, literal := regexpLiteralPrefix(re.Simplify(), foldCase)
+			mp.prefix, mp.literal = filepath.FromSlash(prefix), literal
+			expr := "^(?:" + mp.pattern + ")$"
+			if foldCase {
+				expr = "(?i)" + expr
+			}
+			compiled, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid pattern %q", p)
+			}
+			m.regexps = append(m.regexps, compiled)
+			m.patterns = append(m.patterns, mp)
+		}
+	default:
+		return nil, errors.Errorf("invalid pattern mode %d", mode)
+	}
+	return m, nil
+}
+
+// single returns a matcher for only the pattern p of m, as if it was not an
+// exclusion.
+func (m *filterMatcher) single(p filterMatcherPattern) (*filterMatcher, error) {
+	mode := PatternModeGlob
+	if m.glob == nil {
+		mode = PatternModeRegexp
+	}
+	return newFilterMatcher([]string{p.pattern}, mode, m.foldCase)
+}
+
+// regexpLiteralPrefix returns the literal prefix of the strings that re
+// matches, and whether re only matches the prefix. Case-insensitive parts are
+// lowercased if foldCase is set, and end the prefix otherwise.
+func regexpLiteralPrefix(re *syntax.Regexp, foldCase bool) (string, bool) {
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	var prefix strings.Builder
+	for _, sub := range subs {
+		if sub.Op != syntax.OpLiteral {
+			return prefix.String(), false
+		}
+		s := string(sub.Rune)
+		if sub.Flags&syntax.FoldCase != 0 {
+			if !foldCase {
+				return prefix.String(), false
+			}
+			s = strings.ToLower(s)
+		}
+		prefix.WriteString(s)
+	}
+	return prefix.String(), true
+}
+
+func (m *filterMatcher) path(p string) string {
+	if m.foldCase && m.glob != nil {
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
+// MatchesOrParentMatches reports whether p, or one of its parent directories,
+// matches the patterns.
+func (m *filterMatcher) MatchesOrParentMatches(p string) (bool, error) {
+	if m.glob != nil {
+		return m.glob.MatchesOrParentMatches(m.path(p))
+	}
+	matched, _, err := m.MatchesUsingParentResults(p, filterMatchInfo{})
+	return matched, err
+}
+
+// MatchesUsingParentResults reports whether p matches the patterns, using the
+// results of its parent directory.
+func (m *filterMatcher) MatchesUsingParentResults(p string, parent filterMatchInfo) (bool, filterMatchInfo, error) {
+	if m.glob != nil {
+		matched, info, err := m.glob.MatchesUsingParentResults(m.path(p), parent.glob)
+		return matched, filterMatchInfo{glob: info}, err
+	}
+
+	// same as patternmatcher.MatchesUsingParentResults
+	parentMatched := parent.parentMatched
+	if len(parentMatched) != 0 && len(parentMatched) != len(m.regexps) {
+		return false, filterMatchInfo{}, errors.New("wrong number of values in parentMatched")
+	}
+	p = filepath.ToSlash(p)
+	matched := false
+	info := filterMatchInfo{parentMatched: make([]bool, len(m.regexps))}
+	for i, re := range m.regexps {
+		match := len(parentMatched) != 0 && parentMatched[i]
+		if !match {
+			// the result can not change
+			if m.patterns[i].exclusion != matched {
+				continue
+			}
+			match = re.MatchString(p)
+			if !match && len(parentMatched) == 0 {
+				for dir := p; !match; {
+					j := strings.LastIndexByte(dir, '/')
+					if j == -1 {
+						break
+					}
+					dir = dir[:j]
+					match = re.MatchString(dir)
+				}
+			}
+		}
+		info.parentMatched[i] = match
+		if match {
+			matched = !m.patterns[i].exclusion
+		}
+	}
+	return matched, info, nil
+}
+
+// mayMatchInside reports whether anything inside the directory p could match
+// the patterns that are exclusions if exclusion is set, or the other patterns
+// otherwise. Globs are only analyzed if all these patterns are literal.
+func (m *filterMatcher) mayMatchInside(p string, exclusion bool) bool {
+	dirSlash := p + string(filepath.Separator)
+	if m.foldCase {
+		dirSlash = strings.ToLower(dirSlash)
+	}
+	for _, pat := range m.patterns {
+		if pat.exclusion != exclusion {
+			continue
+		}
+		if !pat.literal {
+			if m.glob != nil {
+				return true
+			}
+			if strings.HasPrefix(dirSlash, pat.prefix) || strings.HasPrefix(pat.prefix, dirSlash) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(pat.prefix+string(filepath.Separator), dirSlash) {
+			return true
+		}
+	}
+	return false
+}
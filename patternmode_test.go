@@ -0,0 +1,183 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatternModeRegexp(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD docs dir",
+		"ADD docs/a.md file",
+		"ADD lib.v1 dir",
+		"ADD lib.v1/c.go file",
+		"ADD link+1 symlink lib.v1",
+		"ADD src dir",
+		"ADD src/keep_test.go file",
+		"ADD src/main.go file",
+		"ADD src/main_test.go file",
+		"ADD src/sub dir",
+		"ADD src/sub/b.go file",
+		"ADD src/sub/b.txt file",
+		"ADD vendor dir",
+		"ADD vendor/v.go file",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+
+	var decisions []string
+	fs, err := NewFilterFS(base, &FilterOpt{
+		PatternMode:     PatternModeRegexp,
+		IncludePatterns: []string{`src/.*\.go`, `docs`},
+		ExcludePatterns: []string{`.*_test\.go`, `!src/keep_test\.go`},
+		FollowPaths:     []string{"link+1"},
+		Trace: func(d *FilterDecision) {
+			if d.Result == FilterPruned {
+				decisions = append(decisions, filepath.ToSlash(d.Path))
+			}
+		},
+	})
+	require.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir docs
+file docs/a.md
+dir lib.v1
+file lib.v1/c.go
+symlink:lib.v1 link+1
+dir src
+file src/keep_test.go
+file src/main.go
+dir src/sub
+file src/sub/b.go
+`), b.String())
+	// vendor can not contain anything that matches the prefixes of the
+	// include patterns
+	assert.Equal(t, []string{"vendor"}, decisions)
+
+	_, err = statPath(context.TODO(), fs, filepath.FromSlash("src/main_test.go"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = fs.Open(filepath.FromSlash("src/sub/b.txt"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	rc, err := fs.Open(filepath.FromSlash("src/keep_test.go"))
+	require.NoError(t, err)
+	rc.Close()
+
+	_, err = NewFilterFS(base, &FilterOpt{PatternMode: PatternModeRegexp, IncludePatterns: []string{"a("}})
+	require.Error(t, err)
+	_, err = NewFilterFS(base, &FilterOpt{PatternMode: PatternMode(10), IncludePatterns: []string{"a"}})
+	require.Error(t, err)
+}
+
+func TestPatternModeCaseInsensitive(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD Docs dir",
+		"ADD Docs/A.JPG file",
+		"ADD Docs/b.md file",
+		"ADD Src dir",
+		"ADD Src/Main.go file",
+		"ADD vendor dir",
+		"ADD vendor/v.go file",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	base, err := NewFS(d)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		mode    PatternMode
+		include []string
+		exclude []string
+	}{
+		{
+			mode:    PatternModeGlob,
+			include: []string{"docs", "src/main.GO"},
+			exclude: []string{"**/*.jpg"},
+		},
+		{
+			mode:    PatternModeRegexp,
+			include: []string{"docs", `src/main\.GO`},
+			exclude: []string{`.*\.jpg`},
+		},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			var decisions []string
+			fs, err := NewFilterFS(base, &FilterOpt{
+				PatternMode:     tc.mode,
+				CaseInsensitive: true,
+				IncludePatterns: tc.include,
+				ExcludePatterns: tc.exclude,
+				Trace: func(d *FilterDecision) {
+					if d.Result == FilterPruned {
+						decisions = append(decisions, filepath.ToSlash(d.Path))
+					}
+				},
+			})
+			require.NoError(t, err)
+
+			b := &bytes.Buffer{}
+			err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.FromSlash(`dir Docs
+file Docs/b.md
+dir Src
+file Src/Main.go
+`), b.String())
+			assert.Equal(t, []string{"vendor"}, decisions)
+
+			_, err = statPath(context.TODO(), fs, filepath.FromSlash("Docs/A.JPG"))
+			require.ErrorIs(t, err, os.ErrNotExist)
+			stat, err := statPath(context.TODO(), fs, "Src")
+			require.NoError(t, err)
+			assert.True(t, stat.IsDir())
+
+			// without CaseInsensitive nothing matches
+			fs, err = NewFilterFS(base, &FilterOpt{
+				PatternMode:     tc.mode,
+				IncludePatterns: tc.include,
+				ExcludePatterns: tc.exclude,
+			})
+			require.NoError(t, err)
+			b.Reset()
+			err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Empty(t, b.String())
+		})
+	}
+}
+
+func TestRegexpLiteralPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		foldCase bool
+		prefix   string
+		literal  bool
+	}{
+		{pattern: `foo/bar`, prefix: "foo/bar", literal: true},
+		{pattern: `foo/bar\.go`, prefix: "foo/bar.go", literal: true},
+		{pattern: `foo/.*`, prefix: "foo/", literal: false},
+		{pattern: `Foo/Bar`, foldCase: true, prefix: "foo/bar", literal: true},
+		{pattern: `x(?i)Foo/.*`, prefix: "x", literal: false},
+		{pattern: `(?i)Foo/.*`, foldCase: true, prefix: "foo/", literal: false},
+		{pattern: `.*\.go`, prefix: "", literal: false},
+		{pattern: `a|b`, prefix: "", literal: false},
+	} {
+		m, err := newFilterMatcher([]string{tc.pattern}, PatternModeRegexp, tc.foldCase)
+		require.NoError(t, err)
+		require.Len(t, m.patterns, 1)
+		assert.Equal(t, filepath.FromSlash(tc.prefix), m.patterns[0].prefix, tc.pattern)
+		assert.Equal(t, tc.literal, m.patterns[0].literal, tc.pattern)
+	}
+}
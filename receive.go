@@ -115,6 +115,8 @@ type receiver struct {
 	filter       FilterFunc
 	differ       DiffType
 	metadataOnly FilterFunc
+	content      *contentSelection
+	watch        bool
 
 	notifyHashed   ChangeFunc
 	contentHasher  ContentHasher
@@ -214,7 +216,7 @@ func (r *receiver) run(ctx context.Context) error {
 		if !r.merge {
 			destWalker = r.destWalker()
 		}
-		err := doubleWalkDiff(ctx, dw.HandleChange, destWalker, w.fill, r.filter, r.differ)
+		err := doubleWalkDiff(ctx, dw.HandleChange, destWalker, w.fill, r.filter, r.differ, nil)
 		if err != nil {
 			return err
 		}
@@ -250,6 +252,11 @@ func (r *receiver) run(ctx context.Context) error {
 				return errors.Errorf("error from sender: %s", p.Data)
 			case types.PACKET_STAT:
 				if p.Stat == nil {
+					if r.content != nil {
+						if err := r.content.missing(); err != nil {
+							return err
+						}
+					}
 					if err := w.update(nil); err != nil {
 						return err
 					}
@@ -262,6 +269,16 @@ func (r *receiver) run(ctx context.Context) error {
 					// e.g. a linux path foo/bar\baz cannot be represented on windows
 					return errors.WithStack(&os.PathError{Path: p.Stat.Path, Err: syscall.EINVAL, Op: "unrepresentable path"})
 				}
+				if r.content != nil {
+					ok, err := r.content.match(p.Stat)
+					if err != nil {
+						return err
+					}
+					if !ok {
+						i++
+						continue
+					}
+				}
 				var metaOnly bool
 				if metadataTransfer {
 					if path == metadataPath {
@@ -324,22 +341,14 @@ func (r *receiver) run(ctx context.Context) error {
 					return err
 				}
 			case types.PACKET_DATA:
-				r.muPipes.Lock()
-				pw, ok := r.pipes[p.ID]
-				r.muPipes.Unlock()
-				if !ok {
-					return errors.Errorf("invalid file request %d", p.ID)
-				}
-				if len(p.Data) == 0 {
-					if err := pw.Close(); err != nil {
-						return err
-					}
-				} else {
-					if _, err := pw.Write(p.Data); err != nil {
-						return err
-					}
+				if err := r.handleData(&p); err != nil {
+					return err
 				}
 			case types.PACKET_FIN:
+				if r.watch {
+					// keep the connection open for the changes that follow
+					return nil
+				}
 				for {
 					var p types.Packet
 					if err := r.conn.RecvMsg(&p); err != nil {
@@ -364,6 +373,20 @@ func (r *receiver) run(ctx context.Context) error {
 	return r.writeMetadata(metadataBuffer)
 }
 
+func (r *receiver) handleData(p *types.Packet) error {
+	r.muPipes.Lock()
+	pw, ok := r.pipes[p.ID]
+	r.muPipes.Unlock()
+	if !ok {
+		return errors.Errorf("invalid file request %d", p.ID)
+	}
+	if len(p.Data) == 0 {
+		return pw.Close()
+	}
+	_, err := pw.Write(p.Data)
+	return err
+}
+
 func (r *receiver) newDiskWriter(ctx context.Context, opt DiskWriterOpt) (receiveDiskWriter, error) {
 	if r.root != nil {
 		return NewRootDiskWriter(ctx, r.root, opt)
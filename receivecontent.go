@@ -0,0 +1,191 @@
+package fsutil
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// ReceiveContent fetches the contents of paths that were recorded in the
+// metadata file by an earlier MetadataOnly receive into dest. conn needs to be
+// connected to a sender serving the same tree as the original transfer.
+//
+// Only the requested files, their parent directories and the targets of
+// requested hardlinks are written. Everything else in dest, including the
+// metadata file, is left untouched. If the sender reports a stat for a
+// requested path that does not match the recorded one, the transfer fails.
+func ReceiveContent(ctx context.Context, conn Stream, dest string, paths []string, opt ReceiveOpt) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dt, err := os.ReadFile(filepath.Join(dest, metadataPath))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sel, err := newContentSelection(dt, paths)
+	if err != nil {
+		return err
+	}
+
+	r := newContentReceiver(conn, opt, sel)
+	r.dest = dest
+	return r.run(ctx)
+}
+
+// ReceiveContentRoot is like ReceiveContent but writes into a Root.
+func ReceiveContentRoot(ctx context.Context, conn Stream, dest Root, paths []string, opt ReceiveOpt) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	f, err := dest.OpenFile(metadataPath, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dt, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sel, err := newContentSelection(dt, paths)
+	if err != nil {
+		return err
+	}
+
+	r := newContentReceiver(conn, opt, sel)
+	r.root = dest
+	return r.run(ctx)
+}
+
+func newContentReceiver(conn Stream, opt ReceiveOpt, sel *contentSelection) *receiver {
+	// existing files in dest are never removed, and the metadata file is
+	// not rewritten
+	opt.Merge = true
+	opt.MetadataOnly = nil
+	r := newReceiver(conn, opt)
+	r.content = sel
+	return r
+}
+
+// contentSelection tracks the entries of a metadata file that need to be
+// written by ReceiveContent. Paths are kept in the unix-style wire format.
+type contentSelection struct {
+	recorded map[string]*types.Stat
+	seen     map[string]struct{}
+}
+
+func newContentSelection(dt []byte, paths []string) (*contentSelection, error) {
+	stats, err := parseMetadata(dt)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]*types.Stat, len(stats))
+	for _, st := range stats {
+		all[st.Path] = st
+	}
+
+	s := &contentSelection{
+		recorded: map[string]*types.Stat{},
+		seen:     map[string]struct{}{},
+	}
+	for _, p := range paths {
+		p = path.Clean(strings.TrimPrefix(filepath.ToSlash(p), "/"))
+		st, ok := all[p]
+		if !ok {
+			return nil, errors.WithStack(&os.PathError{Path: p, Err: syscall.ENOENT, Op: "metadata lookup"})
+		}
+		if !fileCanRequestData(os.FileMode(st.Mode)) {
+			return nil, errors.WithStack(&os.PathError{Path: p, Err: syscall.EINVAL, Op: "fetch non-regular file"})
+		}
+		if err := s.add(all, p); err != nil {
+			return nil, err
+		}
+		// hardlinks are created from their target that may not have been
+		// written by the original transfer
+		if st.Linkname != "" {
+			if err := s.add(all, st.Linkname); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *contentSelection) add(all map[string]*types.Stat, p string) error {
+	for p != "." && p != "/" {
+		if _, ok := s.recorded[p]; ok {
+			return nil
+		}
+		st, ok := all[p]
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: p, Err: syscall.ENOENT, Op: "metadata lookup"})
+		}
+		s.recorded[p] = st
+		p = path.Dir(p)
+	}
+	return nil
+}
+
+// match reports whether the stat received from the sender is part of the
+// selection and checks that it still matches the recorded metadata.
+func (s *contentSelection) match(st *types.Stat) (bool, error) {
+	rec, ok := s.recorded[st.Path]
+	if !ok {
+		return false, nil
+	}
+	if rec.IsDir() {
+		if !st.IsDir() {
+			return false, errors.WithStack(&os.PathError{Path: st.Path, Err: syscall.ENOTDIR, Op: "changed since metadata transfer"})
+		}
+	} else if rec.Mode != st.Mode || rec.Size != st.Size || rec.ModTime != st.ModTime || rec.Linkname != st.Linkname {
+		return false, errors.WithStack(&os.PathError{Path: st.Path, Err: syscall.ESTALE, Op: "changed since metadata transfer"})
+	}
+	s.seen[st.Path] = struct{}{}
+	return true, nil
+}
+
+// missing returns an error if some of the selected paths were not sent.
+func (s *contentSelection) missing() error {
+	var missing []string
+	for p := range s.recorded {
+		if _, ok := s.seen[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return errors.Errorf("paths missing from sender: %s", strings.Join(missing, ", "))
+}
+
+// parseMetadata decodes the framed stat records written by a MetadataOnly
+// receive.
+func parseMetadata(dt []byte) ([]*types.Stat, error) {
+	var stats []*types.Stat
+	for len(dt) > 0 {
+		if len(dt) < 4 {
+			return nil, errors.Errorf("invalid metadata: short frame header")
+		}
+		n := binary.LittleEndian.Uint32(dt[:4])
+		dt = dt[4:]
+		if uint64(n) > uint64(len(dt)) {
+			return nil, errors.Errorf("invalid metadata: short frame")
+		}
+		st := &types.Stat{}
+		if err := st.Unmarshal(dt[:n]); err != nil {
+			return nil, errors.Wrap(err, "invalid metadata")
+		}
+		stats = append(stats, st)
+		dt = dt[n:]
+	}
+	return stats, nil
+}
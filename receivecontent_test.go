@@ -0,0 +1,154 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+type receiveContentTestFunc func(context.Context, Stream, string, []string, ReceiveOpt) error
+
+func TestReceiveContent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		receive receiveContentTestFunc
+	}{
+		{
+			name:    "DiskWriter",
+			receive: ReceiveContent,
+		},
+		{
+			name: "RootDiskWriter",
+			receive: func(ctx context.Context, conn Stream, dest string, paths []string, opt ReceiveOpt) error {
+				osroot, err := os.OpenRoot(dest)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				destRoot := NewRoot(osroot)
+
+				err = ReceiveContentRoot(ctx, conn, destRoot, paths, opt)
+				if closeErr := destRoot.Close(); err == nil {
+					err = closeErr
+				}
+				return err
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testReceiveContent(t, tc.receive)
+		})
+	}
+}
+
+func testReceiveContent(t *testing.T, receive receiveContentTestFunc) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+		"ADD foo2 file dat2",
+		"ADD zzz dir",
+		"ADD zzz/aa file data3",
+		"ADD zzz/bb file >zzz/aa",
+		"ADD zzz/cc file data4",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	fs, err := NewFS(d)
+	require.NoError(t, err)
+
+	dest := t.TempDir()
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, fs, nil)
+	})
+	eg.Go(func() error {
+		return Receive(ctx, s2, dest, ReceiveOpt{
+			MetadataOnly: func(p string, s *types.Stat) bool {
+				return p == "foo2"
+			},
+		})
+	})
+	require.NoError(t, eg.Wait())
+
+	ts := newNotificationBuffer()
+	chs := &changes{fn: ts.HandleChange}
+
+	eg, ctx = errgroup.WithContext(context.Background())
+	s1, s2 = sockPairProto(ctx)
+
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, fs, nil)
+	})
+	eg.Go(func() error {
+		return receive(ctx, s2, dest, []string{"foo", "/zzz/bb"}, ReceiveOpt{
+			NotifyHashed:  chs.HandleChange,
+			ContentHasher: simpleSHA256Hasher,
+		})
+	})
+	require.NoError(t, eg.Wait())
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.FromSlash(`file .fsutil-metadata
+file foo
+file foo2
+dir zzz
+file zzz/aa
+file zzz/bb >zzz/aa
+`), b.String())
+
+	dt, err := os.ReadFile(filepath.Join(dest, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	dt, err = os.ReadFile(filepath.Join(dest, "zzz/bb"))
+	require.NoError(t, err)
+	assert.Equal(t, "data3", string(dt))
+
+	dt, err = os.ReadFile(filepath.Join(dest, metadataPath))
+	require.NoError(t, err)
+	assert.Equal(t, 6, len(parseFSMetadata(t, dt)))
+
+	_, ok := chs.c["foo"]
+	assert.True(t, ok)
+	_, ok = chs.c["foo2"]
+	assert.False(t, ok)
+
+	// modified files can't be fetched with the old metadata
+	err = os.WriteFile(filepath.Join(d, "zzz/cc"), []byte("data5"), 0644)
+	require.NoError(t, err)
+
+	eg, ctx = errgroup.WithContext(context.Background())
+	s1, s2 = sockPairProto(ctx)
+
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, fs, nil)
+	})
+	err = receive(ctx, s2, dest, []string{"zzz/cc"}, ReceiveOpt{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, syscall.ESTALE)
+	assert.Error(t, eg.Wait())
+
+	err = receive(context.Background(), nil, dest, []string{"notexist"}, ReceiveOpt{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, syscall.ENOENT)
+
+	err = receive(context.Background(), nil, dest, []string{"zzz"}, ReceiveOpt{})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, syscall.EINVAL)
+}
@@ -0,0 +1,235 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// RenameDetection controls how moved files are found when computing changes.
+type RenameDetection int
+
+const (
+	// RenameDetectNone reports a moved file as a delete and an add.
+	RenameDetectNone RenameDetection = iota
+	// RenameDetectInode pairs a deleted and an added file that are the same
+	// inode. This only finds files moved between trees on the same
+	// filesystem, like a directory and a hardlinked copy of it, and is only
+	// supported for the FS types of the host filesystem.
+	RenameDetectInode
+	// RenameDetectContent pairs a deleted and an added file with the same
+	// size and content digest. Only the files with a size that is both
+	// deleted and added are read.
+	RenameDetectContent
+)
+
+func (d RenameDetection) String() string {
+	switch d {
+	case RenameDetectNone:
+		return "none"
+	case RenameDetectInode:
+		return "inode"
+	case RenameDetectContent:
+		return "content"
+	}
+	return "unknown"
+}
+
+// RenameInfo is the os.FileInfo of a ChangeKindRename change, with the stat
+// of the new path of the change.
+type RenameInfo struct {
+	os.FileInfo
+	// OldPath is the path that the file is moved from.
+	OldPath string
+}
+
+// renameKeyFunc returns the identity of the regular file at p for pairing
+// moved files, or "" if it can not be paired.
+type renameKeyFunc func(p string, stat *types.Stat) (string, error)
+
+// renameDetector pairs the deleted and added regular files of
+// doubleWalkDiff. The changes that a rename could depend on are deferred until
+// the walk is complete.
+type renameDetector struct {
+	lowerKey renameKeyFunc
+	upperKey renameKeyFunc
+
+	deleted []*currentPath
+	added   []*currentPath
+	// pending contains the deferred changes of regular files in walk order
+	pending []renameChange
+	// deletes contains the deferred deletes in walk order
+	deletes []string
+}
+
+type renameChange struct {
+	kind ChangeKind
+	path string
+	stat *types.Stat
+}
+
+// newRenameDetector returns a detector for the changes from lower to upper,
+// or nil for RenameDetectNone.
+func newRenameDetector(d RenameDetection, lower, upper FS) (*renameDetector, error) {
+	switch d {
+	case RenameDetectNone:
+		return nil, nil
+	case RenameDetectInode, RenameDetectContent:
+	default:
+		return nil, errors.Errorf("invalid rename detection %d", d)
+	}
+	if d == RenameDetectContent {
+		return &renameDetector{lowerKey: contentRenameKey(lower), upperKey: contentRenameKey(upper)}, nil
+	}
+	lowerKey, upperKey := inodeRenameKey(lower), inodeRenameKey(upper)
+	if lowerKey == nil || upperKey == nil {
+		return nil, errors.Errorf("inode rename detection is not supported for %T and %T", lower, upper)
+	}
+	return &renameDetector{lowerKey: lowerKey, upperKey: upperKey}, nil
+}
+
+func contentRenameKey(fs FS) renameKeyFunc {
+	return func(p string, _ *types.Stat) (string, error) {
+		rc, err := fs.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		dgst, err := digest.SHA256.FromReader(rc)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read %s", p)
+		}
+		return dgst.String(), nil
+	}
+}
+
+// inodeRenameKey returns the key function for the FS types that are backed by
+// a directory of the host filesystem, or nil.
+func inodeRenameKey(f FS) renameKeyFunc {
+	var lstat func(string) (os.FileInfo, error)
+	switch f := f.(type) {
+	case *fs:
+		lstat = func(p string) (os.FileInfo, error) {
+			return os.Lstat(filepath.Join(f.root, p))
+		}
+	case *IndexedFS:
+		lstat = func(p string) (os.FileInfo, error) {
+			return os.Lstat(filepath.Join(f.root, p))
+		}
+	case *rootFS:
+		lstat = f.root.Lstat
+	default:
+		return nil
+	}
+	return func(p string, _ *types.Stat) (string, error) {
+		fi, err := lstat(p)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		dev, ino, _, ok := statChange(fi)
+		if !ok {
+			return "", nil
+		}
+		return fmt.Sprintf("%d:%d", dev, ino), nil
+	}
+}
+
+// renameCandidate reports whether the file of stat can be paired.
+func renameCandidate(stat *types.Stat) bool {
+	return os.FileMode(stat.Mode).IsRegular() && stat.Linkname == ""
+}
+
+// delete records a deleted path of the lower tree. Deletes of the files inside
+// a deleted directory are only recorded for pairing and are not reported.
+func (r *renameDetector) delete(f *currentPath, report bool) {
+	if renameCandidate(f.stat) {
+		r.deleted = append(r.deleted, f)
+	}
+	if report {
+		r.deletes = append(r.deletes, f.path)
+	}
+}
+
+// change records an added or modified regular file. f is the upper entry as
+// compared, and stat the stat to report.
+func (r *renameDetector) change(kind ChangeKind, f *currentPath, stat *types.Stat) {
+	if kind == ChangeKindAdd && renameCandidate(f.stat) {
+		r.added = append(r.added, f)
+	}
+	r.pending = append(r.pending, renameChange{kind: kind, path: f.path, stat: stat})
+}
+
+// pairs returns the old paths of the added files that are moved.
+func (r *renameDetector) pairs() (map[string]string, error) {
+	bySize := map[int64][]*currentPath{}
+	for _, f := range r.deleted {
+		bySize[f.stat.Size] = append(bySize[f.stat.Size], f)
+	}
+	var (
+		sources = map[string][]string{}
+		keyed   = map[int64]bool{}
+		out     = map[string]string{}
+	)
+	for _, f := range r.added {
+		deleted := bySize[f.stat.Size]
+		if len(deleted) == 0 {
+			continue
+		}
+		if !keyed[f.stat.Size] {
+			keyed[f.stat.Size] = true
+			for _, d := range deleted {
+				k, err := r.lowerKey(d.path, d.stat)
+				if err != nil {
+					return nil, err
+				}
+				if k != "" {
+					sources[k] = append(sources[k], d.path)
+				}
+			}
+		}
+		k, err := r.upperKey(f.path, f.stat)
+		if err != nil {
+			return nil, err
+		}
+		if s := sources[k]; k != "" && len(s) > 0 {
+			out[f.path] = s[0]
+			sources[k] = s[1:]
+		}
+	}
+	return out, nil
+}
+
+// flush reports the deferred changes, with the moved files as
+// ChangeKindRename, and then the deletes of the paths that were not moved.
+func (r *renameDetector) flush(changeFn ChangeFunc) error {
+	pairs, err := r.pairs()
+	if err != nil {
+		return err
+	}
+	moved := make(map[string]struct{}, len(pairs))
+	for _, c := range r.pending {
+		if old, ok := pairs[c.path]; ok && c.kind == ChangeKindAdd {
+			moved[old] = struct{}{}
+			if err := changeFn(ChangeKindRename, c.path, &RenameInfo{FileInfo: &StatInfo{c.stat}, OldPath: old}, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := changeFn(c.kind, c.path, &StatInfo{c.stat}, nil); err != nil {
+			return err
+		}
+	}
+	for _, p := range r.deletes {
+		if _, ok := moved[p]; ok {
+			continue
+		}
+		if err := changeFn(ChangeKindDelete, p, &StatInfo{nil}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formatRenameChange(out *bytes.Buffer) ChangeFunc {
+	return func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		out.WriteString(kind.String() + " " + p)
+		if ri, ok := fi.(*RenameInfo); ok {
+			out.WriteString(" from=" + ri.OldPath)
+		}
+		out.WriteString("\n")
+		return nil
+	}
+}
+
+func TestChangesRenames(t *testing.T) {
+	a := NewMemFS()
+	require.NoError(t, a.AddDir("d", 0755))
+	require.NoError(t, a.AddFile("d/big", []byte("data1"), 0644))
+	require.NoError(t, a.AddFile("keep", []byte("k"), 0644))
+	require.NoError(t, a.AddFile("x", []byte("data2"), 0644))
+
+	b := NewMemFS()
+	require.NoError(t, b.AddDir("d2", 0755))
+	require.NoError(t, b.AddFile("d2/big", []byte("data1"), 0644))
+	require.NoError(t, b.AddFile("keep", []byte("k"), 0644))
+	require.NoError(t, b.AddFile("x2", []byte("data2"), 0644))
+	require.NoError(t, b.AddFile("y", []byte("data2"), 0644))
+
+	for _, tc := range []struct {
+		detect   RenameDetection
+		expected string
+	}{
+		{
+			detect: RenameDetectNone,
+			expected: `delete d
+add d2
+add d2/big
+delete x
+add x2
+add y
+`,
+		},
+		{
+			detect: RenameDetectContent,
+			expected: `add d2
+rename d2/big from=d/big
+rename x2 from=x
+add y
+delete d
+`,
+		},
+	} {
+		t.Run(tc.detect.String(), func(t *testing.T) {
+			var out bytes.Buffer
+			err := ChangesWithOpt(context.TODO(), a, b, &ChangesOpt{DetectRenames: tc.detect}, formatRenameChange(&out))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.FromSlash(tc.expected), out.String())
+		})
+	}
+
+	// the same size and metadata, but different content
+	c := NewMemFS()
+	require.NoError(t, c.AddDir("d2", 0755))
+	require.NoError(t, c.AddFile("d2/big", []byte("data1"), 0644))
+	require.NoError(t, c.AddFile("keep", []byte("k"), 0644))
+	require.NoError(t, c.AddFile("x2", []byte("DATA2"), 0644))
+	var out bytes.Buffer
+	err := ChangesWithOpt(context.TODO(), a, c, &ChangesOpt{DetectRenames: RenameDetectContent}, formatRenameChange(&out))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`add d2
+rename d2/big from=d/big
+add x2
+delete d
+delete x
+`), out.String())
+
+	err = ChangesWithOpt(context.TODO(), a, b, &ChangesOpt{DetectRenames: RenameDetectInode}, formatRenameChange(&out))
+	require.Error(t, err)
+}
+
+func TestChangesRenameInode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inodes are not supported on windows")
+	}
+	da, db := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(da, "f"), []byte("data"), 0644))
+	require.NoError(t, os.Link(filepath.Join(da, "f"), filepath.Join(db, "g")))
+	require.NoError(t, os.WriteFile(filepath.Join(db, "new"), []byte("data"), 0644))
+
+	a, err := NewFS(da)
+	require.NoError(t, err)
+	b, err := NewFS(db)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	err = ChangesWithOpt(context.TODO(), a, b, &ChangesOpt{DetectRenames: RenameDetectInode}, formatRenameChange(&out))
+	require.NoError(t, err)
+	assert.Equal(t, `rename g from=f
+add new
+`, out.String())
+}
@@ -51,6 +51,7 @@ type sender struct {
 	progressCurrent   int
 	progressCurrentMu sync.Mutex
 	sendpipeline      chan *sendHandle
+	watch             *watchState
 }
 
 func (s *sender) run(ctx context.Context) error {
@@ -59,7 +60,11 @@ func (s *sender) run(ctx context.Context) error {
 	defer s.updateProgress(0, true)
 
 	g.Go(func() error {
-		err := s.walk(ctx)
+		walk := s.walk
+		if s.watch != nil {
+			walk = s.watchLoop
+		}
+		err := walk(ctx)
 		if err != nil {
 			s.conn.SendMsg(&types.Packet{Type: types.PACKET_ERR, Data: []byte(err.Error())})
 		}
@@ -103,7 +108,18 @@ func (s *sender) run(ctx context.Context) error {
 					return err
 				}
 			case types.PACKET_FIN:
-				return s.conn.SendMsg(&types.Packet{Type: types.PACKET_FIN})
+				if s.watch == nil {
+					return s.conn.SendMsg(&types.Packet{Type: types.PACKET_FIN})
+				}
+				// in watch mode FIN acknowledges a batch of changes
+				if err := s.conn.SendMsg(&types.Packet{Type: types.PACKET_FIN}); err != nil {
+					return err
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case s.watch.acks <- struct{}{}:
+				}
 			}
 		}
 	})
@@ -161,6 +177,9 @@ func (s *sender) walk(ctx context.Context) error {
 		if !ok {
 			return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
 		}
+		if s.watch != nil {
+			s.watch.state[path] = stat.Clone()
+		}
 		stat.Path = filepath.ToSlash(stat.Path)
 		stat.Linkname = filepath.ToSlash(stat.Linkname)
 		p := &types.Packet{
@@ -0,0 +1,13 @@
+//go:build !(dragonfly || linux || openbsd || solaris || darwin || freebsd || netbsd)
+
+package fsutil
+
+import (
+	"os"
+)
+
+// statChange returns the device, inode and change time of fi. They are not
+// available on this platform.
+func statChange(_ os.FileInfo) (dev, ino uint64, ctime int64, ok bool) {
+	return 0, 0, 0, false
+}
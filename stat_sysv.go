@@ -0,0 +1,17 @@
+//go:build dragonfly || linux || openbsd || solaris
+
+package fsutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// statChange returns the device, inode and change time of fi.
+func statChange(fi os.FileInfo) (dev, ino uint64, ctime int64, ok bool) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(s.Dev), uint64(s.Ino), s.Ctim.Nano(), true
+}
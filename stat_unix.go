@@ -58,21 +58,28 @@ func setUnixOpt(fi os.FileInfo, stat *types.Stat, path string, seenFiles map[uin
 			stat.Devminor = int64(minor(uint64(s.Rdev)))
 		}
 
-		ino := s.Ino
-		linked := false
-		if seenFiles != nil {
-			if s.Nlink > 1 {
-				if oldpath, ok := seenFiles[ino]; ok {
-					stat.Linkname = oldpath
-					stat.Size = 0
-					linked = true
-				}
-			}
-			if !linked {
-				seenFiles[ino] = path
-			}
+		if oldpath, ok := markHardlink(fi, path, seenFiles); ok {
+			stat.Linkname = oldpath
+			stat.Size = 0
+		}
+	}
+}
+
+// markHardlink records path as the first link of its inode in seenFiles, or
+// returns the path recorded for the inode before if it has multiple links.
+func markHardlink(fi os.FileInfo, path string, seenFiles map[uint64]string) (string, bool) {
+	if seenFiles == nil {
+		return "", false
+	}
+	s := fi.Sys().(*syscall.Stat_t)
+	ino := s.Ino
+	if s.Nlink > 1 {
+		if oldpath, ok := seenFiles[ino]; ok {
+			return oldpath, true
 		}
 	}
+	seenFiles[ino] = path
+	return "", false
 }
 
 func major(device uint64) uint64 {
@@ -14,3 +14,7 @@ func loadXattr(_ string, _ *types.Stat) error {
 
 func setUnixOpt(_ os.FileInfo, _ *types.Stat, _ string, _ map[uint64]string) {
 }
+
+func markHardlink(_ os.FileInfo, _ string, _ map[uint64]string) (string, bool) {
+	return "", false
+}
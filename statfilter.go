@@ -0,0 +1,137 @@
+package fsutil
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// FileType is a set of file types for StatFilter.
+type FileType uint32
+
+const (
+	FileTypeRegular FileType = 1 << iota
+	FileTypeSymlink
+	// FileTypeDevice matches both block and character devices.
+	FileTypeDevice
+	FileTypeNamedPipe
+	FileTypeSocket
+)
+
+// fileTypeOf returns the FileType of mode, or 0 for directories and
+// irregular files.
+func fileTypeOf(mode os.FileMode) FileType {
+	switch {
+	case mode.IsRegular():
+		return FileTypeRegular
+	case mode&os.ModeSymlink != 0:
+		return FileTypeSymlink
+	case mode&os.ModeDevice != 0:
+		return FileTypeDevice
+	case mode&os.ModeNamedPipe != 0:
+		return FileTypeNamedPipe
+	case mode&os.ModeSocket != 0:
+		return FileTypeSocket
+	}
+	return 0
+}
+
+// StatFilter selects paths by their stat info instead of their path. A path
+// is only included if it matches all the conditions that are set.
+//
+// Directories are kept so that their contents can be walked, and are only
+// subject to Uid, Gid, PermAll and PermNone when PruneDirs is set.
+type StatFilter struct {
+	// MinSize and MaxSize limit the size of regular files when non-zero.
+	// They do not apply to the hardlinks after the first link of a file, as
+	// their size is reported as zero by some FS types.
+	MinSize int64
+	MaxSize int64
+	// ModifiedAfter and ModifiedBefore limit the modification time when set.
+	ModifiedAfter  *time.Time
+	ModifiedBefore *time.Time
+	// Types limits the file types when non-zero.
+	Types FileType
+	// Uid and Gid limit the owner when set.
+	Uid *uint32
+	Gid *uint32
+	// PermAll are the permission bits, including os.ModeSetuid,
+	// os.ModeSetgid and os.ModeSticky, that must all be set. PermNone are the
+	// ones that must all be unset.
+	PermAll  os.FileMode
+	PermNone os.FileMode
+	// PruneDirs skips the directories that do not match Uid, Gid, PermAll and
+	// PermNone together with their contents.
+	PruneDirs bool
+}
+
+func (f *StatFilter) validate() error {
+	if f.MinSize < 0 || f.MaxSize < 0 || (f.MaxSize != 0 && f.MinSize > f.MaxSize) {
+		return errors.Errorf("invalid stat filter size range %d-%d", f.MinSize, f.MaxSize)
+	}
+	if f.ModifiedAfter != nil && f.ModifiedBefore != nil && !f.ModifiedAfter.Before(*f.ModifiedBefore) {
+		return errors.Errorf("invalid stat filter time range %s-%s", f.ModifiedAfter, f.ModifiedBefore)
+	}
+	if f.PermAll&f.PermNone != 0 {
+		return errors.Errorf("invalid stat filter permissions: %s set in both PermAll and PermNone", f.PermAll&f.PermNone)
+	}
+	return nil
+}
+
+// mapFunc returns a MapFunc that applies the filter before calling next, so
+// next is not called for the excluded paths.
+func (f StatFilter) mapFunc(next MapFunc) MapFunc {
+	return func(p string, stat *types.Stat) MapResult {
+		if res := f.match(stat); res != MapResultKeep {
+			return res
+		}
+		if next != nil {
+			return next(p, stat)
+		}
+		return MapResultKeep
+	}
+}
+
+func (f *StatFilter) match(stat *types.Stat) MapResult {
+	mode := os.FileMode(stat.Mode)
+	if mode.IsDir() {
+		if f.PruneDirs && !f.matchOwnerPerm(stat) {
+			return MapResultSkipDir
+		}
+		return MapResultKeep
+	}
+	if !f.matchOwnerPerm(stat) {
+		return MapResultExclude
+	}
+	if f.Types != 0 && f.Types&fileTypeOf(mode) == 0 {
+		return MapResultExclude
+	}
+	if mode.IsRegular() && stat.Linkname == "" {
+		if stat.Size < f.MinSize || (f.MaxSize != 0 && stat.Size > f.MaxSize) {
+			return MapResultExclude
+		}
+	}
+	if f.ModifiedAfter != nil || f.ModifiedBefore != nil {
+		mtime := time.Unix(0, stat.ModTime)
+		if f.ModifiedAfter != nil && !mtime.After(*f.ModifiedAfter) {
+			return MapResultExclude
+		}
+		if f.ModifiedBefore != nil && !mtime.Before(*f.ModifiedBefore) {
+			return MapResultExclude
+		}
+	}
+	return MapResultKeep
+}
+
+func (f *StatFilter) matchOwnerPerm(stat *types.Stat) bool {
+	if f.Uid != nil && stat.Uid != *f.Uid {
+		return false
+	}
+	if f.Gid != nil && stat.Gid != *f.Gid {
+		return false
+	}
+	mode := os.FileMode(stat.Mode)
+	return mode&f.PermAll == f.PermAll && mode&f.PermNone == 0
+}
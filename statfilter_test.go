@@ -0,0 +1,183 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestStatFilter(t *testing.T) {
+	base := NewMemFS()
+	require.NoError(t, base.AddDir("a", 0755))
+	require.NoError(t, base.AddFile("a/big", bytes.Repeat([]byte("x"), 100), 0644))
+	require.NoError(t, base.AddFile("a/exec", []byte("0123456789"), 0755))
+	require.NoError(t, base.AddHardlink("a/hl", "a/exec"))
+	require.NoError(t, base.AddSymlink("a/link", "big"))
+	require.NoError(t, base.AddFile("a/small", []byte("x"), 0644))
+	require.NoError(t, base.AddDevice("dev", os.ModeDevice|os.ModeCharDevice|0666, 1, 3))
+	require.NoError(t, base.AddDevice("fifo", os.ModeNamedPipe|0644, 0, 0))
+	require.NoError(t, base.AddFile("new", []byte("data"), 0644))
+	require.NoError(t, base.SetModTime("new", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.NoError(t, base.AddDir("priv", 0700))
+	require.NoError(t, base.AddFile("priv/f", []byte("data"), 0600))
+	require.NoError(t, base.SetOwner("priv", 1000, 1000))
+	require.NoError(t, base.SetOwner("priv/f", 1000, 1000))
+
+	uid := uint32(1000)
+	after := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		filter   StatFilter
+		patterns []string
+		expected string
+	}{
+		{
+			name:   "size",
+			filter: StatFilter{MinSize: 2, MaxSize: 50},
+			expected: `dir a
+file a/exec
+file a/hl >a/exec
+symlink:big a/link
+file dev
+file fifo
+file new
+dir priv
+file priv/f
+`,
+		},
+		{
+			name:   "type",
+			filter: StatFilter{Types: FileTypeSymlink},
+			expected: `dir a
+symlink:big a/link
+dir priv
+`,
+		},
+		{
+			name:   "nodevices",
+			filter: StatFilter{Types: FileTypeRegular | FileTypeSymlink | FileTypeNamedPipe},
+			expected: `dir a
+file a/big
+file a/exec
+file a/hl >a/exec
+symlink:big a/link
+file a/small
+file fifo
+file new
+dir priv
+file priv/f
+`,
+		},
+		{
+			name:   "mtime",
+			filter: StatFilter{ModifiedAfter: &after},
+			expected: `dir a
+file new
+dir priv
+`,
+		},
+		{
+			name:   "owner",
+			filter: StatFilter{Uid: &uid},
+			expected: `dir a
+dir priv
+file priv/f
+`,
+		},
+		{
+			name:   "ownerprune",
+			filter: StatFilter{Uid: &uid, PruneDirs: true},
+			expected: `dir priv
+file priv/f
+`,
+		},
+		{
+			name:   "perm",
+			filter: StatFilter{PermAll: 0100, PermNone: 0002},
+			expected: `dir a
+file a/exec
+file a/hl >a/exec
+dir priv
+`,
+		},
+		{
+			name:   "permprune",
+			filter: StatFilter{PermNone: 0044, PruneDirs: true},
+			expected: `dir priv
+file priv/f
+`,
+		},
+		{
+			name:     "patterns",
+			filter:   StatFilter{MaxSize: 50},
+			patterns: []string{"a"},
+			expected: `dir a
+file a/exec
+file a/hl >a/exec
+symlink:big a/link
+file a/small
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := NewFilterFS(base, &FilterOpt{
+				IncludePatterns: tc.patterns,
+				StatFilter:      &tc.filter,
+			})
+			require.NoError(t, err)
+
+			b := &bytes.Buffer{}
+			err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, b.String())
+		})
+	}
+}
+
+func TestStatFilterStat(t *testing.T) {
+	base := NewMemFS()
+	require.NoError(t, base.AddDir("a", 0755))
+	require.NoError(t, base.AddFile("a/big", bytes.Repeat([]byte("x"), 100), 0644))
+	require.NoError(t, base.AddFile("a/exec", []byte("0123456789"), 0755))
+	require.NoError(t, base.AddFile("new", []byte("data"), 0644))
+	require.NoError(t, base.AddDir("priv", 0700))
+	require.NoError(t, base.AddFile("priv/f", []byte("data"), 0600))
+
+	var mapped []string
+	fs, err := NewFilterFS(base, &FilterOpt{
+		StatFilter: &StatFilter{MaxSize: 50, PermNone: 0044, PruneDirs: true},
+		Map: func(p string, _ *types.Stat) MapResult {
+			mapped = append(mapped, p)
+			return MapResultKeep
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = statPath(context.TODO(), fs, "a/big")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = statPath(context.TODO(), fs, "a")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = statPath(context.TODO(), fs, "a/exec")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	stat, err := statPath(context.TODO(), fs, "priv/f")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stat.Size)
+
+	stats, err := readDirPath(context.TODO(), fs, "")
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, "priv", stats[0].Path)
+	assert.Equal(t, []string{"priv", "priv/f", "priv"}, mapped)
+
+	_, err = NewFilterFS(NewMemFS(), &FilterOpt{StatFilter: &StatFilter{MinSize: 10, MaxSize: 5}})
+	require.Error(t, err)
+	_, err = NewFilterFS(NewMemFS(), &FilterOpt{StatFilter: &StatFilter{PermAll: 0700, PermNone: 0100}})
+	require.Error(t, err)
+}
@@ -0,0 +1,312 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	gofs "io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+const paxSchilyXattr = "SCHILY.xattr."
+
+// NewTarFS returns an FS serving the contents of the tar archive in r. The
+// archive may be gzip compressed. It is indexed once when NewTarFS is called;
+// file contents of uncompressed archives are read from r on Open, while the
+// file contents of compressed archives are kept in memory.
+//
+// Directories that have no entry of their own in the archive are synthesized.
+// If a path appears more than once the last entry wins, as it would when
+// extracting the archive.
+func NewTarFS(r io.ReaderAt) (FS, error) {
+	var magic [2]byte
+	n, err := r.ReadAt(magic[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "failed to read tar archive")
+	}
+
+	var (
+		rd         io.Reader = io.NewSectionReader(r, 0, math.MaxInt64)
+		compressed bool
+	)
+	if n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(rd)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read gzip header")
+		}
+		defer gz.Close()
+		rd = gz
+		compressed = true
+	}
+
+	fs := &tarFS{
+		r:       r,
+		entries: map[string]*tarEntry{},
+	}
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read tar archive")
+		}
+		if err := fs.add(hdr, tr, rd, compressed); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.paths = make([]string, 0, len(fs.entries))
+	for p := range fs.entries {
+		fs.paths = append(fs.paths, filepath.FromSlash(p))
+	}
+	slices.SortFunc(fs.paths, ComparePath)
+	return fs, nil
+}
+
+type tarFS struct {
+	r       io.ReaderAt
+	entries map[string]*tarEntry
+	// paths are the native paths of all entries in walk order
+	paths []string
+}
+
+type tarEntry struct {
+	stat *types.Stat
+	// inode is the entry holding the data and metadata, which differs from
+	// the entry itself for hardlinks
+	inode *tarEntry
+
+	offset int64
+	data   []byte
+}
+
+func (fs *tarFS) add(hdr *tar.Header, tr *tar.Reader, rd io.Reader, compressed bool) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+	p := cleanTarPath(hdr.Name)
+	if p == "" {
+		return nil
+	}
+	if err := fs.mkparents(p); err != nil {
+		return err
+	}
+
+	e := &tarEntry{}
+	e.inode = e
+
+	if hdr.Typeflag == tar.TypeLink {
+		te, ok := fs.entries[cleanTarPath(hdr.Linkname)]
+		if !ok {
+			return errors.WithStack(&os.PathError{Op: "link", Path: hdr.Linkname, Err: syscall.ENOENT})
+		}
+		if te.inode.stat.IsDir() {
+			return errors.WithStack(&os.PathError{Op: "link", Path: hdr.Linkname, Err: syscall.EPERM})
+		}
+		e.inode = te.inode
+		fs.replace(p, e)
+		return nil
+	}
+
+	fi := hdr.FileInfo()
+	stat := &types.Stat{
+		Mode:     uint32(fi.Mode()),
+		Uid:      uint32(hdr.Uid),
+		Gid:      uint32(hdr.Gid),
+		ModTime:  hdr.ModTime.UnixNano(),
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+	for k, v := range hdr.PAXRecords {
+		if key, ok := strings.CutPrefix(k, paxSchilyXattr); ok {
+			if stat.Xattrs == nil {
+				stat.Xattrs = map[string][]byte{}
+			}
+			stat.Xattrs[key] = []byte(v)
+		}
+	}
+
+	switch {
+	case fi.IsDir():
+	case fi.Mode()&os.ModeSymlink != 0:
+		stat.Linkname = hdr.Linkname
+		stat.Size = int64(len(hdr.Linkname))
+	case fi.Mode().IsRegular():
+		stat.Size = hdr.Size
+		if compressed || isSparseTarHeader(hdr) {
+			// no random access to the data, keep it in memory
+			dt, err := io.ReadAll(tr)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", hdr.Name)
+			}
+			e.data = dt
+			stat.Size = int64(len(dt))
+		} else {
+			offset, err := rd.(io.Seeker).Seek(0, io.SeekCurrent)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			e.offset = offset
+		}
+	}
+	e.stat = stat
+	fs.replace(p, e)
+	return nil
+}
+
+// replace adds e at p, removing anything that was previously there unless
+// both the old and the new entry are directories.
+func (fs *tarFS) replace(p string, e *tarEntry) {
+	if old, ok := fs.entries[p]; ok && old.inode.stat.IsDir() && !e.inode.stat.IsDir() {
+		prefix := p + "/"
+		for k := range fs.entries {
+			if strings.HasPrefix(k, prefix) {
+				delete(fs.entries, k)
+			}
+		}
+	}
+	e.stat = e.inode.stat
+	fs.entries[p] = e
+}
+
+// mkparents synthesizes the parent directories of p that do not have an entry
+// in the archive.
+func (fs *tarFS) mkparents(p string) error {
+	dir := path.Dir(p)
+	if dir == "." {
+		return nil
+	}
+	if e, ok := fs.entries[dir]; ok {
+		if !e.inode.stat.IsDir() {
+			return errors.WithStack(&os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR})
+		}
+		return nil
+	}
+	if err := fs.mkparents(dir); err != nil {
+		return err
+	}
+	e := &tarEntry{stat: &types.Stat{Mode: uint32(os.ModeDir | 0755)}}
+	e.inode = e
+	fs.entries[dir] = e
+	return nil
+}
+
+func (fs *tarFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	seenFiles := map[*tarEntry]string{}
+	return walkSorted(ctx, fs.paths, target, func(p string) *types.Stat {
+		e := fs.entries[filepath.ToSlash(p)]
+		stat := e.stat.Clone()
+		stat.Path = p
+		if os.FileMode(stat.Mode).IsRegular() {
+			if oldpath, ok := seenFiles[e.inode]; ok {
+				stat.Linkname = oldpath
+				stat.Size = 0
+			} else {
+				seenFiles[e.inode] = p
+			}
+		}
+		return stat
+	}, fn)
+}
+
+func (fs *tarFS) Open(p string) (io.ReadCloser, error) {
+	ra, err := fs.OpenReaderAt(p)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.NewSectionReader(ra, 0, ra.Size())), nil
+}
+
+func (fs *tarFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	e, err := fs.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	ino := e.inode
+	if ino.stat.IsDir() {
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.EISDIR})
+	}
+	if !os.FileMode(ino.stat.Mode).IsRegular() {
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.EINVAL})
+	}
+	if ino.data != nil {
+		return &bytesReadAtCloser{bytes.NewReader(ino.data)}, nil
+	}
+	return &sectionReadAtCloser{io.NewSectionReader(fs.r, ino.offset, ino.stat.Size)}, nil
+}
+
+type sectionReadAtCloser struct {
+	*io.SectionReader
+}
+
+func (*sectionReadAtCloser) Close() error {
+	return nil
+}
+
+// resolve returns the entry for p, following symlinks in the last path
+// component. Symlinks can not point outside of the archive root.
+func (fs *tarFS) resolve(p string) (*tarEntry, error) {
+	name, err := resolveArchivePath(p, func(name string) *types.Stat {
+		if e, ok := fs.entries[name]; ok {
+			return e.inode.stat
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs.entries[name], nil
+}
+
+// resolveArchivePath returns the slash separated archive path that p resolves
+// to, following symlinks in the last path component. lookup returns the stat
+// of the entry at an archive path, or nil if there is none.
+func resolveArchivePath(p string, lookup func(string) *types.Stat) (string, error) {
+	name := cleanTarPath(filepath.ToSlash(p))
+	for range memFSMaxSymlinks {
+		stat := lookup(name)
+		if stat == nil {
+			return "", errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ENOENT})
+		}
+		if os.FileMode(stat.Mode)&os.ModeSymlink == 0 {
+			return name, nil
+		}
+		link := filepath.ToSlash(stat.Linkname)
+		if !path.IsAbs(link) {
+			link = path.Join(path.Dir(name), link)
+		}
+		name = cleanTarPath(link)
+	}
+	return "", errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.ELOOP})
+}
+
+// cleanTarPath returns the slash separated, relative form of an archive path.
+// The archive root is returned as an empty string.
+func cleanTarPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func isSparseTarHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
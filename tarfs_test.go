@@ -0,0 +1,211 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func testTarArchive(t *testing.T, hdrs []*tar.Header, data map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		dt := data[hdr.Name]
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(dt))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(dt))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestTarFS(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	dt := testTarArchive(t, []*tar.Header{
+		{Name: "foo/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime},
+		{Name: "foo/zz", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1001, ModTime: mtime, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.foo": "bar",
+		}},
+		{Name: "foo/bar", Typeflag: tar.TypeLink, Linkname: "foo/zz"},
+		{Name: "./a/b/c", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "foo/zz", Mode: 0777},
+		{Name: "link2", Typeflag: tar.TypeLink, Linkname: "link"},
+		{Name: "dev", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "dup", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dup", Typeflag: tar.TypeReg, Mode: 0755},
+	}, map[string]string{
+		"foo/zz":  "data1",
+		"./a/b/c": "data2",
+		"dup":     "data3",
+	})
+
+	for _, tc := range []struct {
+		name string
+		dt   []byte
+	}{
+		{"plain", dt},
+		{"gzip", gzipBytes(t, dt)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := NewTarFS(bytes.NewReader(tc.dt))
+			require.NoError(t, err)
+
+			b := &bytes.Buffer{}
+			err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.FromSlash(`dir a
+dir a/b
+file a/b/c
+file dev
+file dup
+dir foo
+file foo/bar
+file foo/zz >foo/bar
+symlink:foo/zz link
+symlink:foo/zz link2
+`), b.String())
+
+			b.Reset()
+			err = fs.Walk(context.TODO(), "foo/zz", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.FromSlash(`file foo/zz
+`), b.String())
+
+			stats := map[string]*types.Stat{}
+			err = fs.Walk(context.TODO(), "", func(p string, entry os.DirEntry, err error) error {
+				require.NoError(t, err)
+				fi, err := entry.Info()
+				require.NoError(t, err)
+				stats[p] = fi.Sys().(*types.Stat)
+				if p == "a" {
+					return filepath.SkipDir
+				}
+				return nil
+			})
+			require.NoError(t, err)
+
+			_, ok := stats[filepath.FromSlash("a/b")]
+			assert.False(t, ok)
+			assert.Equal(t, uint32(os.ModeDir|0755), stats["a"].Mode)
+			assert.Equal(t, uint32(os.ModeDir|0700), stats["foo"].Mode)
+			assert.Equal(t, uint32(0755), stats["dup"].Mode)
+			assert.Equal(t, &types.Stat{
+				Path:    filepath.FromSlash("foo/bar"),
+				Mode:    0644,
+				Uid:     1000,
+				Gid:     1001,
+				Size:    5,
+				ModTime: mtime.UnixNano(),
+				Xattrs:  map[string][]byte{"user.foo": []byte("bar")},
+			}, stats[filepath.FromSlash("foo/bar")])
+			assert.Equal(t, uint32(os.ModeDevice|os.ModeCharDevice|0666), stats["dev"].Mode)
+			assert.Equal(t, int64(1), stats["dev"].Devmajor)
+			assert.Equal(t, int64(3), stats["dev"].Devminor)
+			assert.Equal(t, int64(len("foo/zz")), stats["link"].Size)
+
+			for p, expected := range map[string]string{
+				"foo/zz":  "data1",
+				"foo/bar": "data1",
+				"link":    "data1",
+				"link2":   "data1",
+				"a/b/c":   "data2",
+				"dup":     "data3",
+			} {
+				rc, err := fs.Open(filepath.FromSlash(p))
+				require.NoError(t, err, p)
+				dt, err := io.ReadAll(rc)
+				require.NoError(t, err)
+				require.NoError(t, rc.Close())
+				assert.Equal(t, expected, string(dt), p)
+			}
+
+			_, err = fs.Open("foo")
+			require.ErrorIs(t, err, syscall.EISDIR)
+			_, err = fs.Open("missing")
+			require.ErrorIs(t, err, syscall.ENOENT)
+		})
+	}
+}
+
+func TestTarFSErrors(t *testing.T) {
+	dt := testTarArchive(t, []*tar.Header{
+		{Name: "foo", Typeflag: tar.TypeLink, Linkname: "bar"},
+	}, nil)
+	_, err := NewTarFS(bytes.NewReader(dt))
+	require.ErrorIs(t, err, syscall.ENOENT)
+
+	dt = testTarArchive(t, []*tar.Header{
+		{Name: "foo", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "foo/bar", Typeflag: tar.TypeReg, Mode: 0644},
+	}, nil)
+	_, err = NewTarFS(bytes.NewReader(dt))
+	require.ErrorIs(t, err, syscall.ENOTDIR)
+
+	_, err = NewTarFS(bytes.NewReader([]byte("invalid")))
+	require.Error(t, err)
+}
+
+func TestTarFSSend(t *testing.T) {
+	forEachReceiveDiskWriter(t, func(t *testing.T, receive receiveTestFunc) {
+		fs, err := NewTarFS(bytes.NewReader(testTarArchive(t, []*tar.Header{
+			{Name: "foo/bar", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "foo/baz", Typeflag: tar.TypeLink, Linkname: "foo/bar"},
+			{Name: "qux", Typeflag: tar.TypeSymlink, Linkname: "foo/bar"},
+		}, map[string]string{
+			"foo/bar": "data1",
+		})))
+		require.NoError(t, err)
+
+		dest := t.TempDir()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		eg, ctx := errgroup.WithContext(ctx)
+		s1, s2 := sockPairProto(ctx)
+
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, fs, nil)
+		})
+		eg.Go(func() error {
+			return receive(ctx, s2, dest, ReceiveOpt{})
+		})
+		require.NoError(t, eg.Wait())
+
+		b := &bytes.Buffer{}
+		require.NoError(t, Walk(context.Background(), dest, nil, bufWalk(b)))
+		assert.Equal(t, filepath.FromSlash(`dir foo
+file foo/bar
+file foo/baz >foo/bar
+symlink:foo/bar qux
+`), b.String())
+
+		dt, err := os.ReadFile(filepath.Join(dest, "foo/baz"))
+		require.NoError(t, err)
+		assert.Equal(t, "data1", string(dt))
+	})
+}
+
+func gzipBytes(t *testing.T, dt []byte) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write(dt)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
@@ -6,6 +6,7 @@ const (
 	PACKET_DATA = Packet_PACKET_DATA
 	PACKET_FIN  = Packet_PACKET_FIN
 	PACKET_ERR  = Packet_PACKET_ERR
+	PACKET_DEL  = Packet_PACKET_DEL
 )
 
 func (p *Packet) Marshal() ([]byte, error) {
@@ -0,0 +1,127 @@
+package fsutil
+
+import (
+	gofs "io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// WalkErrorPolicy controls how a walk handles an entry that can not be read,
+// for example a directory without read permission. Entries that are removed
+// during the walk are always skipped.
+type WalkErrorPolicy int
+
+const (
+	// WalkErrorFail passes the error on, which fails the walk unless the
+	// WalkDirFunc ignores it.
+	WalkErrorFail WalkErrorPolicy = iota
+
+	// WalkErrorSkip skips the entry and continues. A directory that can not
+	// be listed is still walked as an empty directory.
+	WalkErrorSkip
+
+	// WalkErrorCollect skips the entry like WalkErrorSkip and returns the
+	// errors of all skipped entries as WalkErrors when the walk is done.
+	WalkErrorCollect
+)
+
+// WalkErrorHandler is called with the path of an entry that can not be read
+// and the error, and returns the policy for that entry.
+type WalkErrorHandler func(p string, err error) WalkErrorPolicy
+
+// WalkErrors is returned by a walk with WalkErrorCollect that skipped some
+// entries. It holds their errors in walk order.
+type WalkErrors []error
+
+func (e WalkErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "failed to read some entries: " + strings.Join(msgs, "; ")
+}
+
+func (e WalkErrors) Unwrap() []error {
+	return e
+}
+
+// walkErrorHandler applies a WalkErrorPolicy during a single walk. A nil
+// handler fails on all errors.
+type walkErrorHandler struct {
+	policy  WalkErrorPolicy
+	handler WalkErrorHandler
+	errs    WalkErrors
+}
+
+func newWalkErrorHandler(policy WalkErrorPolicy, handler WalkErrorHandler) *walkErrorHandler {
+	if policy == WalkErrorFail && handler == nil {
+		return nil
+	}
+	return &walkErrorHandler{policy: policy, handler: handler}
+}
+
+// handle returns err if the walk should fail on the error of the entry at p,
+// and nil if the entry should be skipped. Not-exist errors are returned
+// unchanged.
+func (h *walkErrorHandler) handle(p string, err error) error {
+	if h == nil || isNotExist(err) {
+		return err
+	}
+	policy := h.policy
+	if h.handler != nil {
+		policy = h.handler(p, err)
+	}
+	switch policy {
+	case WalkErrorSkip:
+		return nil
+	case WalkErrorCollect:
+		h.errs = append(h.errs, err)
+		return nil
+	}
+	return err
+}
+
+// wrap returns a WalkDirFunc that applies the policy to the errors passed to
+// fn and to the errors of stating the entries, before calling fn.
+func (h *walkErrorHandler) wrap(fn gofs.WalkDirFunc) gofs.WalkDirFunc {
+	if h == nil {
+		return fn
+	}
+	return func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			if h.handle(p, err) == nil {
+				return nil
+			}
+			return fn(p, entry, err)
+		}
+		if entry != nil {
+			if _, err := entry.Info(); err != nil && !isNotExist(err) {
+				if err := h.skipEntry(p, entry, err); err == nil || err == filepath.SkipDir {
+					return err
+				}
+			}
+		}
+		return fn(p, entry, nil)
+	}
+}
+
+// skipEntry applies the policy to the error err of stating the entry at p,
+// and returns the result for the walk callback: err if the walk should fail,
+// and otherwise nil or SkipDir for directories.
+func (h *walkErrorHandler) skipEntry(p string, entry gofs.DirEntry, err error) error {
+	if err := h.handle(p, err); err != nil {
+		return err
+	}
+	if entry.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// result returns the error of a walk that returned err.
+func (h *walkErrorHandler) result(err error) error {
+	if err == nil && h != nil && len(h.errs) > 0 {
+		return h.errs
+	}
+	return err
+}
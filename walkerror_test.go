@@ -0,0 +1,225 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// walkErrorFS fails to list the directories in listErrs and to stat the
+// entries in statErrs.
+type walkErrorFS struct {
+	fs       FS
+	listErrs map[string]error
+	statErrs map[string]error
+}
+
+func (fs *walkErrorFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	return fs.fs.Walk(ctx, target, func(p string, entry gofs.DirEntry, err error) error {
+		if err != nil {
+			return fn(p, entry, err)
+		}
+		if err, ok := fs.statErrs[p]; ok {
+			entry = &walkErrorEntry{DirEntry: entry, err: err}
+		}
+		if err := fn(p, entry, nil); err != nil {
+			return err
+		}
+		if err, ok := fs.listErrs[p]; ok {
+			if err := fn(p, entry, err); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func (fs *walkErrorFS) Open(p string) (io.ReadCloser, error) {
+	return fs.fs.Open(p)
+}
+
+type walkErrorEntry struct {
+	gofs.DirEntry
+	err error
+}
+
+func (e *walkErrorEntry) Info() (gofs.FileInfo, error) {
+	return nil, e.err
+}
+
+func TestWalkErrorPolicy(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.AddDir("a", 0755))
+	require.NoError(t, m.AddFile("a/b", []byte("data1"), 0644))
+	require.NoError(t, m.AddDir("c", 0755))
+	require.NoError(t, m.AddFile("c/d", []byte("data2"), 0644))
+	require.NoError(t, m.AddFile("e", []byte("data3"), 0644))
+	require.NoError(t, m.AddFile("f", []byte("data4"), 0644))
+	require.NoError(t, m.AddFile("g", []byte("data5"), 0644))
+
+	errList := &os.PathError{Op: "readdirent", Path: "a", Err: syscall.EACCES}
+	errStat := &os.PathError{Op: "lstat", Path: "e", Err: syscall.EIO}
+	errExcluded := &os.PathError{Op: "lstat", Path: "g", Err: syscall.EIO}
+	src := &walkErrorFS{
+		fs:       m,
+		listErrs: map[string]error{"a": errList},
+		statErrs: map[string]error{"e": errStat, "g": errExcluded},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		opt      FilterOpt
+		expected string
+		errs     []error
+	}{
+		{
+			name: "fail",
+			errs: []error{errList},
+		},
+		{
+			name: "skip",
+			opt:  FilterOpt{WalkErrorPolicy: WalkErrorSkip},
+			expected: `dir a
+dir c
+file c/d
+file f
+`,
+		},
+		{
+			name: "collect",
+			opt:  FilterOpt{WalkErrorPolicy: WalkErrorCollect},
+			expected: `dir a
+dir c
+file c/d
+file f
+`,
+			errs: []error{errList, errStat},
+		},
+		{
+			name: "handler",
+			opt: FilterOpt{
+				WalkErrorPolicy: WalkErrorFail,
+				WalkErrorHandler: func(p string, err error) WalkErrorPolicy {
+					if errors.Is(err, syscall.EACCES) {
+						return WalkErrorSkip
+					}
+					return WalkErrorCollect
+				},
+			},
+			expected: `dir a
+dir c
+file c/d
+file f
+`,
+			errs: []error{errStat},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opt.ExcludePatterns = []string{"g"}
+			fs, err := NewFilterFS(src, &tc.opt)
+			require.NoError(t, err)
+
+			b := &bytes.Buffer{}
+			err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+			if tc.expected != "" {
+				assert.Equal(t, filepath.FromSlash(tc.expected), b.String())
+			}
+			if tc.errs == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, e := range tc.errs {
+				require.ErrorIs(t, err, e)
+			}
+			var walkErrs WalkErrors
+			if tc.opt.WalkErrorPolicy == WalkErrorFail && tc.opt.WalkErrorHandler == nil {
+				assert.False(t, errors.As(err, &walkErrs))
+			} else {
+				require.ErrorAs(t, err, &walkErrs)
+				assert.Len(t, walkErrs, len(tc.errs))
+			}
+		})
+	}
+}
+
+func TestWalkErrorPolicyPermission(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("os.Chmod not fully supported on Windows")
+	}
+	if os.Getuid() == 0 {
+		t.Skip("test cannot run as root")
+	}
+
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b dir",
+		"ADD a/b/c file data1",
+		"ADD d file data2",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, os.Chmod(filepath.Join(d, "a/b"), 0000))
+	defer func() {
+		os.Chmod(filepath.Join(d, "a/b"), 0700)
+		os.RemoveAll(d)
+	}()
+
+	osroot, err := os.OpenRoot(d)
+	require.NoError(t, err)
+	root := NewRoot(osroot)
+	defer root.Close()
+
+	for name, newFS := range map[string]func(*FSOpt) FS{
+		"fs": func(opt *FSOpt) FS {
+			fs, err := NewFSWithOpt(d, opt)
+			require.NoError(t, err)
+			return fs
+		},
+		"parallel": func(opt *FSOpt) FS {
+			opt.Parallelism = 4
+			fs, err := NewFSWithOpt(d, opt)
+			require.NoError(t, err)
+			return fs
+		},
+		"rootfs": func(opt *FSOpt) FS {
+			return NewRootFSWithOpt(root, opt)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := newFS(&FSOpt{}).Walk(context.TODO(), "", bufWalkDir(&bytes.Buffer{}))
+			require.ErrorIs(t, err, os.ErrPermission)
+
+			b := &bytes.Buffer{}
+			err = newFS(&FSOpt{WalkErrorPolicy: WalkErrorSkip}).Walk(context.TODO(), "", bufWalkDir(b))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.FromSlash(`dir a
+dir a/b
+file d
+`), b.String())
+
+			var paths []string
+			err = newFS(&FSOpt{
+				WalkErrorPolicy: WalkErrorSkip,
+				WalkErrorHandler: func(p string, err error) WalkErrorPolicy {
+					paths = append(paths, p)
+					return WalkErrorCollect
+				},
+			}).Walk(context.TODO(), "", bufWalkDir(&bytes.Buffer{}))
+			var walkErrs WalkErrors
+			require.ErrorAs(t, err, &walkErrs)
+			require.ErrorIs(t, err, os.ErrPermission)
+			assert.Equal(t, []string{filepath.FromSlash("a/b")}, paths)
+		})
+	}
+}
@@ -0,0 +1,580 @@
+// Watch mode extends the file-transfer protocol described in receive.go so
+// that a sender can keep a receiver up to date after the initial transfer.
+//
+// The protocol operates as follows:
+// - The initial transfer is identical to a regular one, except that the
+//   connection is kept open after the FIN packets have been exchanged.
+// - When the watched tree changes, the sender sends a batch of STAT packets
+//   for added or modified paths and DEL packets for removed paths, in
+//   lexicographic order, followed by an empty STAT packet.
+// - The ID of a file in a batch is its index in the batch. The receiver
+//   requests file contents with REQ packets as in the initial transfer.
+// - After the receiver has applied the batch it sends a FIN packet, and the
+//   sender replies with a FIN packet before it sends the next batch.
+// The session ends when either side is cancelled or sends an ERR packet.
+
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultWatchDebounce = 100 * time.Millisecond
+
+type WatchOpt struct {
+	// Filter is applied to the watched tree for the initial transfer and
+	// for all changes sent after it.
+	Filter *FilterOpt
+
+	// Debounce is how long the tree needs to be quiet after a change before
+	// the pending changes are sent. Defaults to 100ms.
+	Debounce time.Duration
+
+	ProgressCb func(int, bool)
+}
+
+// SendWatch sends the tree at root like Send and then keeps watching it,
+// sending every subsequent change to the receiver until ctx is cancelled or
+// an error occurs. The receiver needs to use ReceiveWatch.
+//
+// Changes are detected with inotify, so SendWatch is only supported on Linux.
+// If the kernel event queue overflows, the whole tree is rescanned.
+func SendWatch(ctx context.Context, conn Stream, root string, opt WatchOpt) error {
+	base, err := NewFS(root)
+	if err != nil {
+		return err
+	}
+	// NewFS resolves symlinks in root, so watch the same directory it walks
+	root = base.(*fs).root
+	fs, err := NewFilterFS(base, opt.Filter)
+	if err != nil {
+		return err
+	}
+
+	events := newWatchEvents()
+	w, err := newWatcher(root, events)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	debounce := opt.Debounce
+	if debounce <= 0 {
+		debounce = defaultWatchDebounce
+	}
+
+	s := &sender{
+		conn:         &syncStream{Stream: conn},
+		fs:           WithHardlinkReset(fs),
+		files:        make(map[uint32]string),
+		progressCb:   opt.ProgressCb,
+		sendpipeline: make(chan *sendHandle, 128),
+		watch: &watchState{
+			events:   events,
+			debounce: debounce,
+			state:    map[string]*types.Stat{},
+			acks:     make(chan struct{}),
+		},
+	}
+	return s.run(ctx)
+}
+
+// ReceiveWatch receives a tree sent with SendWatch into dest and then keeps
+// applying the changes sent by the sender until ctx is cancelled or an error
+// occurs. MetadataOnly transfers are not supported in watch mode.
+func ReceiveWatch(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) error {
+	if opt.MetadataOnly != nil {
+		return errors.New("metadata only transfer is not supported in watch mode")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r := newReceiver(conn, opt)
+	r.dest = dest
+	r.watch = true
+	if err := r.run(ctx); err != nil {
+		return err
+	}
+	return r.runWatch(ctx)
+}
+
+// watchEvents collects the paths reported by a watcher until the sender picks
+// them up. Paths are relative to the watched root.
+type watchEvents struct {
+	mu       sync.Mutex
+	subtrees map[string]struct{}
+	stats    map[string]struct{}
+	overflow bool
+	err      error
+	notify   chan struct{}
+}
+
+func newWatchEvents() *watchEvents {
+	return &watchEvents{
+		subtrees: map[string]struct{}{},
+		stats:    map[string]struct{}{},
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// add marks a path as changed. If subtree is false, only the metadata of the
+// path itself needs to be refreshed.
+func (e *watchEvents) add(p string, subtree bool) {
+	e.mu.Lock()
+	if subtree {
+		e.subtrees[p] = struct{}{}
+	} else {
+		e.stats[p] = struct{}{}
+	}
+	e.mu.Unlock()
+	e.signal()
+}
+
+// rescan marks the whole tree as changed, e.g. after events were lost.
+func (e *watchEvents) rescan() {
+	e.mu.Lock()
+	e.overflow = true
+	e.mu.Unlock()
+	e.signal()
+}
+
+func (e *watchEvents) fail(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+	e.signal()
+}
+
+func (e *watchEvents) signal() {
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and resets the pending changes.
+func (e *watchEvents) take() (subtrees, stats []string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return nil, nil, e.err
+	}
+	if e.overflow {
+		subtrees = []string{""}
+	} else {
+		for p := range e.subtrees {
+			subtrees = append(subtrees, p)
+		}
+		for p := range e.stats {
+			stats = append(stats, p)
+		}
+	}
+	e.overflow = false
+	clear(e.subtrees)
+	clear(e.stats)
+	return subtrees, stats, nil
+}
+
+type watchChange struct {
+	kind ChangeKind
+	path string
+	stat *types.Stat
+}
+
+// watchState is the sender side state of a watch session. state contains the
+// stats that have been sent to the receiver, keyed by native path.
+type watchState struct {
+	events   *watchEvents
+	debounce time.Duration
+	state    map[string]*types.Stat
+	acks     chan struct{}
+}
+
+func (s *sender) watchLoop(ctx context.Context) error {
+	if err := s.walk(ctx); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.watch.acks:
+		}
+		changes, err := s.watch.next(ctx, s.fs)
+		if err != nil {
+			return err
+		}
+		if err := s.sendChanges(changes); err != nil {
+			return err
+		}
+	}
+}
+
+// next waits for the tree to change and returns the changes once the tree has
+// been quiet for the debounce period.
+func (w *watchState) next(ctx context.Context, fs FS) ([]*watchChange, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-w.events.notify:
+		}
+
+		timer := time.NewTimer(w.debounce)
+	debounce:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-w.events.notify:
+				timer.Reset(w.debounce)
+			case <-timer.C:
+				break debounce
+			}
+		}
+
+		subtrees, stats, err := w.events.take()
+		if err != nil {
+			return nil, err
+		}
+		changes, err := w.rescan(ctx, fs, subtrees, stats)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) > 0 {
+			return changes, nil
+		}
+	}
+}
+
+// rescan walks the changed paths and returns the changes compared to the
+// state last sent to the receiver. An empty path in subtrees rescans the whole
+// tree. The state is updated to the new tree.
+func (w *watchState) rescan(ctx context.Context, fs FS, subtrees, stats []string) ([]*watchChange, error) {
+	sort.Strings(subtrees)
+	subtrees = dedupeWatchPaths(subtrees)
+
+	changes := map[string]*watchChange{}
+	for _, p := range subtrees {
+		current, err := watchWalk(ctx, fs, p, true)
+		if err != nil {
+			return nil, err
+		}
+		w.diff(changes, current, func(k string) bool {
+			return p == "" || k == p || strings.HasPrefix(k, p+string(filepath.Separator))
+		})
+	}
+	for _, p := range stats {
+		if p == "" || watchPathCovered(subtrees, p) {
+			continue
+		}
+		current, err := watchWalk(ctx, fs, p, false)
+		if err != nil {
+			return nil, err
+		}
+		w.diff(changes, current, func(k string) bool {
+			return k == p
+		})
+	}
+
+	out := make([]*watchChange, 0, len(changes))
+	for _, c := range changes {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return ComparePath(out[i].path, out[j].path) < 0
+	})
+
+	// paths under a deleted directory are removed with it
+	var rmdir string
+	n := 0
+	for _, c := range out {
+		if rmdir != "" && strings.HasPrefix(c.path, rmdir) {
+			continue
+		}
+		rmdir = ""
+		if c.kind == ChangeKindDelete {
+			rmdir = c.path + string(filepath.Separator)
+		}
+		out[n] = c
+		n++
+	}
+	return out[:n], nil
+}
+
+// diff compares the walked paths with the recorded ones that match inScope
+// and records the differences in changes.
+func (w *watchState) diff(changes map[string]*watchChange, current map[string]*types.Stat, inScope func(string) bool) {
+	for p, old := range w.state {
+		if !inScope(p) {
+			continue
+		}
+		if _, ok := current[p]; !ok {
+			changes[p] = &watchChange{kind: ChangeKindDelete, path: p, stat: old}
+			delete(w.state, p)
+		}
+	}
+	for p, st := range current {
+		old, ok := w.state[p]
+		switch {
+		case !ok:
+			changes[p] = &watchChange{kind: ChangeKindAdd, path: p, stat: st}
+		case !sameWatchStat(old, st):
+			changes[p] = &watchChange{kind: ChangeKindModify, path: p, stat: st}
+		default:
+			continue
+		}
+		w.state[p] = st
+	}
+}
+
+func (s *sender) sendChanges(changes []*watchChange) error {
+	s.mu.Lock()
+	s.files = make(map[uint32]string)
+	s.mu.Unlock()
+
+	for i, c := range changes {
+		var p *types.Packet
+		if c.kind == ChangeKindDelete {
+			p = &types.Packet{
+				Type: types.PACKET_DEL,
+				Stat: &types.Stat{Path: filepath.ToSlash(c.path)},
+			}
+		} else {
+			stat := c.stat.Clone()
+			stat.Path = filepath.ToSlash(stat.Path)
+			stat.Linkname = filepath.ToSlash(stat.Linkname)
+			if fileCanRequestData(os.FileMode(stat.Mode)) {
+				s.mu.Lock()
+				s.files[uint32(i)] = c.path
+				s.mu.Unlock()
+			}
+			p = &types.Packet{
+				Type: types.PACKET_STAT,
+				Stat: stat,
+			}
+		}
+		s.updateProgress(p.Size(), false)
+		if err := s.conn.SendMsg(p); err != nil {
+			return errors.Wrapf(err, "failed to send change %s", c.path)
+		}
+	}
+	return errors.Wrapf(s.conn.SendMsg(&types.Packet{Type: types.PACKET_STAT}), "failed to send last change")
+}
+
+// watchWalk returns the stats for target, and for everything under it if
+// subtree is set.
+func watchWalk(ctx context.Context, fs FS, target string, subtree bool) (map[string]*types.Stat, error) {
+	m := map[string]*types.Stat{}
+	if target == "" {
+		target = string(filepath.Separator)
+	}
+	err := fs.Walk(ctx, target, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+		m[path] = stat
+		if !subtree {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func sameWatchStat(a, b *types.Stat) bool {
+	if a.Mode != b.Mode || a.Uid != b.Uid || a.Gid != b.Gid || a.ModTime != b.ModTime ||
+		a.Devmajor != b.Devmajor || a.Devminor != b.Devminor {
+		return false
+	}
+	// hardlinks depend on which paths were part of the walk, so they are
+	// compared by their metadata only
+	if os.FileMode(a.Mode).IsRegular() && (a.Linkname != "" || b.Linkname != "") {
+		return maps.EqualFunc(a.Xattrs, b.Xattrs, bytes.Equal)
+	}
+	return a.Size == b.Size && a.Linkname == b.Linkname && maps.EqualFunc(a.Xattrs, b.Xattrs, bytes.Equal)
+}
+
+// dedupeWatchPaths removes paths that are under another path of the sorted
+// input.
+func dedupeWatchPaths(in []string) []string {
+	out := in[:0]
+	for _, p := range in {
+		if watchPathCovered(out, p) {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func watchPathCovered(parents []string, p string) bool {
+	for _, parent := range parents {
+		if parent == "" || p == parent || strings.HasPrefix(p, parent+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *receiver) runWatch(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+	batches := make(chan []*watchChange)
+
+	g.Go(func() (retErr error) {
+		defer func() {
+			if retErr != nil {
+				r.conn.SendMsg(&types.Packet{Type: types.PACKET_ERR, Data: []byte(retErr.Error())})
+			}
+		}()
+		for {
+			var batch []*watchChange
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case batch = <-batches:
+			}
+			if err := r.applyWatchBatch(ctx, batch); err != nil {
+				return err
+			}
+			if err := r.conn.SendMsg(&types.Packet{Type: types.PACKET_FIN}); err != nil {
+				return err
+			}
+		}
+	})
+
+	g.Go(func() error {
+		var batch []*watchChange
+		var p types.Packet
+		for {
+			p.ResetVT()
+			if err := r.conn.RecvMsg(&p); err != nil {
+				return err
+			}
+			if r.progressCb != nil {
+				r.progressCb(p.Size(), false)
+			}
+
+			switch p.Type {
+			case types.PACKET_ERR:
+				return errors.Errorf("error from sender: %s", p.Data)
+			case types.PACKET_STAT, types.PACKET_DEL:
+				if p.Stat == nil {
+					if p.Type == types.PACKET_DEL {
+						return errors.Errorf("invalid delete without path")
+					}
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case batches <- batch:
+					}
+					batch = nil
+					break
+				}
+				path := filepath.FromSlash(p.Stat.Path)
+				if filepath.ToSlash(path) != p.Stat.Path {
+					return errors.WithStack(&os.PathError{Path: p.Stat.Path, Err: syscall.EINVAL, Op: "unrepresentable path"})
+				}
+				if err := validateWatchPath(path); err != nil {
+					return err
+				}
+				c := &watchChange{kind: ChangeKindAdd, path: path}
+				if p.Type == types.PACKET_DEL {
+					c.kind = ChangeKindDelete
+				} else {
+					c.stat = p.Stat.Clone()
+					c.stat.Path = path
+					c.stat.Linkname = filepath.FromSlash(c.stat.Linkname)
+				}
+				batch = append(batch, c)
+			case types.PACKET_DATA:
+				if err := r.handleData(&p); err != nil {
+					return err
+				}
+			case types.PACKET_FIN:
+				// reply to the FIN sent after applying a batch
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+func (r *receiver) applyWatchBatch(ctx context.Context, batch []*watchChange) error {
+	r.mu.Lock()
+	r.files = make(map[string]uint32)
+	for i, c := range batch {
+		if c.kind != ChangeKindDelete && fileCanRequestData(os.FileMode(c.stat.Mode)) {
+			r.files[c.path] = uint32(i)
+		}
+	}
+	r.mu.Unlock()
+
+	dw, err := r.newDiskWriter(ctx, DiskWriterOpt{
+		AsyncDataCb:   r.asyncDataFunc,
+		NotifyCb:      r.notifyHashed,
+		ContentHasher: r.contentHasher,
+		Filter:        r.filter,
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range batch {
+		if c.kind == ChangeKindDelete {
+			if err := dw.HandleChange(ChangeKindDelete, c.path, nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		kind := ChangeKindAdd
+		if _, err := os.Lstat(filepath.Join(r.dest, c.path)); err == nil {
+			kind = ChangeKindModify
+		}
+		if err := dw.HandleChange(kind, c.path, &StatInfo{c.stat}, nil); err != nil {
+			return err
+		}
+	}
+	return dw.Wait(ctx)
+}
+
+func validateWatchPath(p string) error {
+	if p != filepath.Clean(p) || p == "." {
+		return errors.WithStack(&os.PathError{Path: p, Err: syscall.EINVAL, Op: "unclean path"})
+	}
+	if filepath.IsAbs(p) {
+		return errors.WithStack(&os.PathError{Path: p, Err: syscall.EINVAL, Op: "absolute path"})
+	}
+	if p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+		return errors.WithStack(&os.PathError{Path: p, Err: syscall.EINVAL, Op: "escape check"})
+	}
+	return nil
+}
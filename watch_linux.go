@@ -0,0 +1,166 @@
+package fsutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	gofs "io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB |
+	unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+type inotifyWatcher struct {
+	root   string
+	f      *os.File
+	events *watchEvents
+	done   chan struct{}
+
+	mu  sync.Mutex
+	wds map[int32]string
+}
+
+func newWatcher(root string, events *watchEvents) (*inotifyWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize inotify")
+	}
+	w := &inotifyWatcher{
+		root: root,
+		// non-blocking descriptors use the runtime poller, so Close
+		// interrupts a pending Read
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		events: events,
+		done:   make(chan struct{}),
+		wds:    map[int32]string{},
+	}
+	if err := w.addRecursive(""); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Close() error {
+	err := w.f.Close()
+	<-w.done
+	return err
+}
+
+// addRecursive adds watches for the directory at the relative path p and all
+// directories under it.
+func (w *inotifyWatcher) addRecursive(p string) error {
+	return filepath.WalkDir(filepath.Join(w.root, p), func(path string, d gofs.DirEntry, err error) error {
+		if err != nil {
+			if isNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		wd, err := unix.InotifyAddWatch(int(w.f.Fd()), path, inotifyMask)
+		if err != nil {
+			// raced with a removal
+			if isNotExist(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "failed to watch %s", path)
+		}
+		w.mu.Lock()
+		w.wds[int32(wd)] = rel
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.done)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.events.fail(errors.Wrap(err, "failed to read inotify events"))
+			}
+			return
+		}
+		if err := w.handle(buf[:n]); err != nil {
+			w.events.fail(err)
+			return
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(dt []byte) error {
+	for len(dt) >= unix.SizeofInotifyEvent {
+		wd := int32(binary.NativeEndian.Uint32(dt[0:4]))
+		mask := binary.NativeEndian.Uint32(dt[4:8])
+		nameLen := int(binary.NativeEndian.Uint32(dt[12:16]))
+		dt = dt[unix.SizeofInotifyEvent:]
+		if nameLen > len(dt) {
+			return errors.Errorf("invalid inotify event")
+		}
+		name := string(bytes.TrimRight(dt[:nameLen], "\x00"))
+		dt = dt[nameLen:]
+
+		if mask&unix.IN_Q_OVERFLOW != 0 {
+			// events were lost, pick up directories that may have been
+			// created in the meantime and rescan everything
+			if err := w.addRecursive(""); err != nil {
+				return err
+			}
+			w.events.rescan()
+			continue
+		}
+
+		w.mu.Lock()
+		dir, ok := w.wds[wd]
+		if mask&unix.IN_IGNORED != 0 {
+			delete(w.wds, wd)
+		}
+		w.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		if name == "" {
+			switch {
+			case mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 && dir == "":
+				w.events.rescan()
+			case mask&unix.IN_ATTRIB != 0 && dir != "":
+				w.events.add(dir, false)
+			}
+			continue
+		}
+
+		p := filepath.Join(dir, name)
+		if mask&unix.IN_ISDIR != 0 && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			if err := w.addRecursive(p); err != nil {
+				return err
+			}
+		}
+		w.events.add(p, true)
+		if dir != "" && mask&(unix.IN_CREATE|unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 {
+			// the parent directory mtime changes with its entries
+			w.events.add(dir, false)
+		}
+	}
+	return nil
+}
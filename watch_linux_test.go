@@ -0,0 +1,117 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestSendWatch(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/a file data2",
+		"ADD foo/b dir",
+		"ADD foo/b/c file data3",
+		"ADD zzz file data4",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+	s1, s2 := sockPairProto(ctx)
+
+	ts := newNotificationBuffer()
+	chs := &changes{fn: ts.HandleChange}
+
+	eg.Go(func() error {
+		return SendWatch(ctx, s1, d, WatchOpt{
+			Filter: &FilterOpt{
+				ExcludePatterns: []string{"zzz"},
+			},
+			Debounce: 10 * time.Millisecond,
+		})
+	})
+	eg.Go(func() error {
+		return ReceiveWatch(ctx, s2, dest, ReceiveOpt{
+			NotifyHashed:  chs.HandleChange,
+			ContentHasher: simpleSHA256Hasher,
+		})
+	})
+
+	waitTree := func(expected string) {
+		t.Helper()
+		var last string
+		require.Eventually(t, func() bool {
+			b := &bytes.Buffer{}
+			if err := Walk(context.Background(), dest, nil, bufWalk(b)); err != nil {
+				return false
+			}
+			last = b.String()
+			return last == expected
+		}, 10*time.Second, 10*time.Millisecond, "last tree:\n%s", &last)
+	}
+
+	waitTree(`file bar
+dir foo
+file foo/a
+dir foo/b
+file foo/b/c
+`)
+
+	require.NoError(t, os.WriteFile(filepath.Join(d, "foo/a"), []byte("data22"), 0644))
+	require.NoError(t, os.RemoveAll(filepath.Join(d, "foo/b")))
+	require.NoError(t, os.Mkdir(filepath.Join(d, "foo/d"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "foo/d/e"), []byte("data5"), 0644))
+	require.NoError(t, os.Symlink("../bar", filepath.Join(d, "foo/f")))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "zzz"), []byte("data6"), 0644))
+
+	waitTree(`file bar
+dir foo
+file foo/a
+dir foo/d
+file foo/d/e
+symlink:../bar foo/f
+`)
+
+	require.Eventually(t, func() bool {
+		dt, err := os.ReadFile(filepath.Join(dest, "foo/a"))
+		return err == nil && string(dt) == "data22"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	dt, err := os.ReadFile(filepath.Join(dest, "foo/d/e"))
+	require.NoError(t, err)
+	assert.Equal(t, "data5", string(dt))
+
+	chs.mu.Lock()
+	k, ok := chs.c[filepath.FromSlash("foo/b")]
+	chs.mu.Unlock()
+	assert.True(t, ok)
+	assert.Equal(t, ChangeKindDelete, k)
+
+	require.NoError(t, os.Rename(filepath.Join(d, "foo/d"), filepath.Join(d, "foo/g")))
+
+	waitTree(`file bar
+dir foo
+file foo/a
+symlink:../bar foo/f
+dir foo/g
+file foo/g/e
+`)
+
+	cancel()
+	err = eg.Wait()
+	// the receiver may get the cancellation forwarded by the sender first
+	require.ErrorContains(t, err, context.Canceled.Error())
+}
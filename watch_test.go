@@ -0,0 +1,120 @@
+package fsutil
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestWatchRescan(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/a file data2",
+		"ADD foo/b dir",
+		"ADD foo/b/c file data3",
+		"ADD zzz dir",
+		"ADD zzz/x file data4",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	fs, err := NewFS(d)
+	require.NoError(t, err)
+
+	ctx := context.TODO()
+	current, err := watchWalk(ctx, fs, "", true)
+	require.NoError(t, err)
+	w := &watchState{state: current}
+
+	changes, err := w.rescan(ctx, fs, []string{""}, nil)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	require.NoError(t, os.WriteFile(filepath.Join(d, "foo/a"), []byte("data22"), 0644))
+	require.NoError(t, os.RemoveAll(filepath.Join(d, "foo/b")))
+	require.NoError(t, os.Mkdir(filepath.Join(d, "foo/d"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "foo/d/e"), []byte("data5"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(d, "zzz/x")))
+
+	// only changes under the reported paths are picked up
+	changes, err = w.rescan(ctx, fs, []string{filepath.FromSlash("foo/d"), filepath.FromSlash("foo/a"), "foo"}, []string{"zzz"})
+	require.NoError(t, err)
+	require.Equal(t, filepath.FromSlash(`modify foo
+modify foo/a
+delete foo/b
+add foo/d
+add foo/d/e
+modify zzz
+`), watchChangesString(changes))
+
+	_, ok := w.state[filepath.FromSlash("foo/b/c")]
+	require.False(t, ok)
+	_, ok = w.state[filepath.FromSlash("zzz/x")]
+	require.True(t, ok)
+
+	// full rescan catches up with everything else
+	changes, err = w.rescan(ctx, fs, []string{""}, nil)
+	require.NoError(t, err)
+	require.Equal(t, filepath.FromSlash(`delete zzz/x
+`), watchChangesString(changes))
+
+	require.NoError(t, os.RemoveAll(filepath.Join(d, "foo")))
+	changes, err = w.rescan(ctx, fs, []string{"foo"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, `delete foo
+`, watchChangesString(changes))
+}
+
+func TestWatchEvents(t *testing.T) {
+	e := newWatchEvents()
+	e.add("foo", true)
+	e.add("bar", false)
+
+	subtrees, stats, err := e.take()
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo"}, subtrees)
+	require.Equal(t, []string{"bar"}, stats)
+
+	e.add("foo", true)
+	e.rescan()
+	subtrees, stats, err = e.take()
+	require.NoError(t, err)
+	require.Equal(t, []string{""}, subtrees)
+	require.Empty(t, stats)
+
+	subtrees, stats, err = e.take()
+	require.NoError(t, err)
+	require.Empty(t, subtrees)
+	require.Empty(t, stats)
+}
+
+func TestSameWatchStat(t *testing.T) {
+	a := &types.Stat{Path: "foo", Mode: 0644, Size: 5, ModTime: 1}
+	require.True(t, sameWatchStat(a, a.Clone()))
+
+	b := a.Clone()
+	b.Xattrs = map[string][]byte{"user.foo": []byte("bar")}
+	require.False(t, sameWatchStat(a, b))
+
+	// hardlink state depends on the walked paths
+	b = a.Clone()
+	b.Linkname = "bar"
+	b.Size = 0
+	require.True(t, sameWatchStat(a, b))
+	b.ModTime = 2
+	require.False(t, sameWatchStat(a, b))
+}
+
+func watchChangesString(changes []*watchChange) string {
+	var sb strings.Builder
+	for _, c := range changes {
+		sb.WriteString(c.kind.String() + " " + c.path + "\n")
+	}
+	return sb.String()
+}
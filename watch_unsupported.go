@@ -0,0 +1,19 @@
+//go:build !linux
+
+package fsutil
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+type unsupportedWatcher struct{}
+
+func newWatcher(_ string, _ *watchEvents) (*unsupportedWatcher, error) {
+	return nil, errors.Errorf("watching for changes is not supported on %s", runtime.GOOS)
+}
+
+func (*unsupportedWatcher) Close() error {
+	return nil
+}
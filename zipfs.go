@@ -0,0 +1,197 @@
+package fsutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	gofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// NewZipFS returns an FS serving the contents of the zip archive in r with
+// the given size. Modes, symlinks, modification times and owners are read
+// from the fields written by WriteZip and by the Info-ZIP tools. Entries of
+// archives created on Windows get the permissions that archive/zip derives
+// from their MS-DOS attributes.
+//
+// Stored files are read from r on Open, while compressed files are
+// decompressed on every Open.
+//
+// Directories that have no entry of their own in the archive are synthesized.
+// If a path appears more than once the last entry wins.
+func NewZipFS(r io.ReaderAt, size int64) (FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read zip archive")
+	}
+
+	fs := &zipFS{
+		r:       r,
+		entries: map[string]*zipEntry{},
+	}
+	for _, f := range zr.File {
+		if err := fs.add(f); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.paths = make([]string, 0, len(fs.entries))
+	for p := range fs.entries {
+		fs.paths = append(fs.paths, filepath.FromSlash(p))
+	}
+	slices.SortFunc(fs.paths, ComparePath)
+	return fs, nil
+}
+
+type zipFS struct {
+	r       io.ReaderAt
+	entries map[string]*zipEntry
+	// paths are the native paths of all entries in walk order
+	paths []string
+}
+
+type zipEntry struct {
+	stat *types.Stat
+	// file is nil for synthesized directories
+	file *zip.File
+}
+
+func (fs *zipFS) add(f *zip.File) error {
+	p := cleanTarPath(f.Name)
+	if p == "" {
+		return nil
+	}
+	if err := fs.mkparents(p); err != nil {
+		return err
+	}
+
+	mode := f.Mode()
+	stat := &types.Stat{
+		Mode:    uint32(mode),
+		ModTime: f.Modified.UnixNano(),
+	}
+	if uid, gid, ok := parseZipUnixExtra(f.Extra); ok {
+		stat.Uid = uid
+		stat.Gid = gid
+	}
+
+	switch {
+	case mode.IsDir():
+	case mode&os.ModeSymlink != 0:
+		rc, err := f.Open()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", f.Name)
+		}
+		dt, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", f.Name)
+		}
+		stat.Linkname = string(dt)
+		stat.Size = int64(len(dt))
+	case mode.IsRegular():
+		stat.Size = int64(f.UncompressedSize64)
+	default:
+		return errors.WithStack(&os.PathError{Op: "zip", Path: f.Name, Err: syscall.ENOTSUP})
+	}
+
+	if old, ok := fs.entries[p]; ok && old.stat.IsDir() && !stat.IsDir() {
+		prefix := p + "/"
+		for k := range fs.entries {
+			if strings.HasPrefix(k, prefix) {
+				delete(fs.entries, k)
+			}
+		}
+	}
+	fs.entries[p] = &zipEntry{stat: stat, file: f}
+	return nil
+}
+
+// mkparents synthesizes the parent directories of p that do not have an entry
+// in the archive.
+func (fs *zipFS) mkparents(p string) error {
+	dir := path.Dir(p)
+	if dir == "." {
+		return nil
+	}
+	if e, ok := fs.entries[dir]; ok {
+		if !e.stat.IsDir() {
+			return errors.WithStack(&os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR})
+		}
+		return nil
+	}
+	if err := fs.mkparents(dir); err != nil {
+		return err
+	}
+	fs.entries[dir] = &zipEntry{stat: &types.Stat{Mode: uint32(os.ModeDir | 0755)}}
+	return nil
+}
+
+func (fs *zipFS) Walk(ctx context.Context, target string, fn gofs.WalkDirFunc) error {
+	return walkSorted(ctx, fs.paths, target, func(p string) *types.Stat {
+		stat := fs.entries[filepath.ToSlash(p)].stat.Clone()
+		stat.Path = p
+		return stat
+	}, fn)
+}
+
+func (fs *zipFS) Open(p string) (io.ReadCloser, error) {
+	e, err := fs.resolveFile(p)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := e.file.Open()
+	return rc, errors.WithStack(err)
+}
+
+func (fs *zipFS) OpenReaderAt(p string) (ReadAtCloser, error) {
+	e, err := fs.resolveFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.file.Method == zip.Store {
+		offset, err := e.file.DataOffset()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &sectionReadAtCloser{io.NewSectionReader(fs.r, offset, e.stat.Size)}, nil
+	}
+	rc, err := e.file.Open()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rc.Close()
+	dt, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &bytesReadAtCloser{bytes.NewReader(dt)}, nil
+}
+
+// resolveFile returns the regular file entry for p, following symlinks in
+// the last path component.
+func (fs *zipFS) resolveFile(p string) (*zipEntry, error) {
+	name, err := resolveArchivePath(p, func(name string) *types.Stat {
+		if e, ok := fs.entries[name]; ok {
+			return e.stat
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	e := fs.entries[name]
+	if e.stat.IsDir() {
+		return nil, errors.WithStack(&os.PathError{Op: "open", Path: p, Err: syscall.EISDIR})
+	}
+	return e, nil
+}
@@ -0,0 +1,130 @@
+package fsutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func TestZipFS(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	m := NewMemFS()
+	require.NoError(t, m.AddDir("a", 0700))
+	require.NoError(t, m.AddFile("a/b", []byte("data1"), 0755))
+	require.NoError(t, m.AddFile("a/c", bytes.Repeat([]byte("data2"), 100), 0644))
+	require.NoError(t, m.AddSymlink("a/d", "b"))
+	require.NoError(t, m.AddHardlink("e", "a/c"))
+	require.NoError(t, m.SetOwner("a/b", 1000, 1001))
+	require.NoError(t, m.SetModTime("a/b", mtime))
+
+	buf := &bytes.Buffer{}
+	err := WriteZip(context.TODO(), m, buf, &ZipOpt{
+		Method: func(stat *types.Stat) uint16 {
+			if stat.Size < 100 {
+				return zip.Store
+			}
+			return zip.Deflate
+		},
+	})
+	require.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	methods := map[string]uint16{}
+	for _, f := range zr.File {
+		methods[f.Name] = f.Method
+	}
+	assert.Equal(t, map[string]uint16{
+		"a/":  zip.Store,
+		"a/b": zip.Store,
+		"a/c": zip.Deflate,
+		"a/d": zip.Store,
+		"e":   zip.Deflate,
+	}, methods)
+
+	fs, err := NewZipFS(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = fs.Walk(context.TODO(), "", bufWalkDir(b))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash(`dir a
+file a/b
+file a/c
+symlink:b a/d
+file e
+`), b.String())
+
+	stats := indexedWalkStats(t, fs)
+	assert.Equal(t, &types.Stat{
+		Path:    filepath.FromSlash("a/b"),
+		Mode:    0755,
+		Uid:     1000,
+		Gid:     1001,
+		Size:    5,
+		ModTime: mtime.UnixNano(),
+	}, stats["a/b"])
+	assert.Equal(t, uint32(os.ModeDir|0700), stats["a"].Mode)
+	assert.Equal(t, int64(500), stats["e"].Size)
+
+	for p, expected := range map[string]string{
+		"a/b": "data1",
+		"a/d": "data1",
+		"e":   string(bytes.Repeat([]byte("data2"), 100)),
+	} {
+		rc, err := fs.Open(filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		dt, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, expected, string(dt), p)
+
+		ra, err := OpenReaderAt(fs, filepath.FromSlash(p))
+		require.NoError(t, err, p)
+		dt = make([]byte, 3)
+		_, err = ra.ReadAt(dt, 2)
+		require.NoError(t, err)
+		require.NoError(t, ra.Close())
+		assert.Equal(t, expected[2:5], string(dt), p)
+	}
+
+	_, err = fs.Open("a")
+	require.ErrorIs(t, err, syscall.EISDIR)
+	_, err = fs.Open("missing")
+	require.ErrorIs(t, err, syscall.ENOENT)
+}
+
+func TestZipFSWindows(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	w, err := zw.Create("dir/file.txt")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("data1"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	fs, err := NewZipFS(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	stats := indexedWalkStats(t, fs)
+	assert.Equal(t, uint32(os.ModeDir|0755), stats["dir"].Mode)
+	assert.Equal(t, uint32(0666), stats["dir/file.txt"].Mode)
+	assert.Equal(t, int64(5), stats["dir/file.txt"].Size)
+}
+
+func TestWriteZipErrors(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.AddDevice("dev", os.ModeDevice|os.ModeCharDevice|0644, 1, 3))
+	err := WriteZip(context.TODO(), m, io.Discard, nil)
+	require.ErrorIs(t, err, syscall.ENOTSUP)
+}
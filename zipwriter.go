@@ -0,0 +1,154 @@
+package fsutil
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// zipUnixExtraID is the Info-ZIP "ux" extra field holding the uid and gid
+const zipUnixExtraID = 0x7875
+
+// ZipOpt controls how WriteZip stores the entries.
+type ZipOpt struct {
+	// Method returns the compression method of a regular file, zip.Store or
+	// zip.Deflate. Defaults to zip.Deflate for all files. Directories and
+	// symlinks are always stored.
+	Method func(*types.Stat) uint16
+}
+
+// WriteZip writes the contents of fs to w as a zip archive. Modes and
+// symlinks are stored in the unix external attributes, modification times
+// in the extended timestamp extra field with a precision of a second, and
+// owners in the Info-ZIP unix extra field.
+//
+// Zip archives have no hardlinks, so every link is written as a copy of the
+// file. Xattrs are not stored, and device, fifo and socket entries can not be
+// written.
+func WriteZip(ctx context.Context, fs FS, w io.Writer, opt *ZipOpt) error {
+	method := func(*types.Stat) uint16 { return zip.Deflate }
+	if opt != nil && opt.Method != nil {
+		method = opt.Method
+	}
+
+	zw := zip.NewWriter(w)
+	sizes := map[string]int64{}
+	err := fs.Walk(ctx, "/", func(path string, entry os.DirEntry, err error) error {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+
+		mode := os.FileMode(stat.Mode)
+		hdr := &zip.FileHeader{
+			Name:     filepath.ToSlash(path),
+			Method:   zip.Store,
+			Modified: time.Unix(0, stat.ModTime).UTC(),
+			Extra:    zipUnixExtra(stat.Uid, stat.Gid),
+		}
+		hdr.SetMode(mode)
+
+		var content io.Reader
+		switch {
+		case mode.IsDir():
+			hdr.Name += "/"
+		case mode&os.ModeSymlink != 0:
+			content = strings.NewReader(stat.Linkname)
+		case mode.IsRegular():
+			if stat.Linkname != "" {
+				stat = stat.Clone()
+				stat.Size = sizes[stat.Linkname]
+				stat.Linkname = ""
+			} else {
+				sizes[path] = stat.Size
+			}
+			hdr.Method = method(stat)
+			rc, err := fs.Open(path)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			content = rc
+		default:
+			return errors.WithStack(&os.PathError{Op: "zip", Path: path, Err: syscall.ENOTSUP})
+		}
+
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write file header %s", hdr.Name)
+		}
+		if content != nil {
+			if _, err := io.Copy(zf, content); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(zw.Close())
+}
+
+// zipUnixExtra returns the Info-ZIP unix extra field for uid and gid.
+func zipUnixExtra(uid, gid uint32) []byte {
+	b := make([]byte, 15)
+	binary.LittleEndian.PutUint16(b[0:], zipUnixExtraID)
+	binary.LittleEndian.PutUint16(b[2:], 11)
+	b[4] = 1 // version
+	b[5] = 4
+	binary.LittleEndian.PutUint32(b[6:], uid)
+	b[10] = 4
+	binary.LittleEndian.PutUint32(b[11:], gid)
+	return b
+}
+
+// parseZipUnixExtra returns the uid and gid from the Info-ZIP unix extra
+// field in the extra data of a zip entry.
+func parseZipUnixExtra(extra []byte) (uid, gid uint32, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return 0, 0, false
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != zipUnixExtraID || len(field) < 2 || field[0] != 1 {
+			continue
+		}
+		field = field[1:]
+		var ids [2]uint32
+		for i := range ids {
+			if len(field) < 1 || len(field) < 1+int(field[0]) {
+				return 0, 0, false
+			}
+			n := int(field[0])
+			var v uint64
+			for j := n - 1; j >= 0; j-- {
+				v = v<<8 | uint64(field[1+j])
+			}
+			ids[i] = uint32(v)
+			field = field[1+n:]
+		}
+		return ids[0], ids[1], true
+	}
+	return 0, 0, false
+}